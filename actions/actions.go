@@ -0,0 +1,33 @@
+// Package actions executes container actions against a Docker daemon. It is
+// shared by the agent and by the master for its local containers.
+package actions
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
+)
+
+// Execute runs a container action (start, stop, restart, pause, unpause, kill)
+func Execute(ctx context.Context, cli *client.Client, action, containerID string) error {
+	switch action {
+	case protocol.CommandStart:
+		return cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	case protocol.CommandStop:
+		return cli.ContainerStop(ctx, containerID, container.StopOptions{})
+	case protocol.CommandRestart:
+		return cli.ContainerRestart(ctx, containerID, container.StopOptions{})
+	case protocol.CommandPause:
+		return cli.ContainerPause(ctx, containerID)
+	case protocol.CommandUnpause:
+		return cli.ContainerUnpause(ctx, containerID)
+	case protocol.CommandKill:
+		return cli.ContainerKill(ctx, containerID, "SIGKILL")
+	}
+	return fmt.Errorf("unsupported action %q", action)
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
+)
+
+const (
+	defaultAlertsDir   = "state/alerts"
+	alertRulesPoll     = 30 * time.Second
+	alertRetryInterval = 30 * time.Second
+	maxPendingAlerts   = 1000
+
+	// A log_pattern alert resolves once this many collection intervals pass
+	// without a match
+	logResolveCycles = 3
+)
+
+// alertEvaluator runs the master's alert rules against local samples, logs
+// and events. Rules and undelivered alerts are kept on disk, so alerting
+// keeps working through a master outage and across restarts; alerts the
+// master cannot take are notified directly and reconciled once it is back.
+type alertEvaluator struct {
+	hostID string
+	tr     transport
+	dir    string
+	cli    *client.Client
+
+	mu       sync.Mutex
+	rules    protocol.AlertRuleSet
+	states   map[string]*resourceState // by rule ID + "/" + container ID
+	logsSeen map[string]time.Time
+	pending  []protocol.AgentAlert
+
+	checkingLogs atomic.Bool
+	wake         chan struct{}
+}
+
+func startAlertEvaluator(hostID string, tr transport, cfg *agentConfig) *alertEvaluator {
+	if err := os.MkdirAll(cfg.Alerts.Dir, 0755); err != nil {
+		log.Printf("Alerts: cannot create %s, local evaluation disabled: %v", cfg.Alerts.Dir, err)
+		return nil
+	}
+
+	e := &alertEvaluator{
+		hostID:   hostID,
+		tr:       tr,
+		dir:      cfg.Alerts.Dir,
+		states:   make(map[string]*resourceState),
+		logsSeen: make(map[string]time.Time),
+		wake:     make(chan struct{}, 1),
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		log.Printf("Alerts: failed to create Docker client, log rules disabled: %v", err)
+	}
+	e.cli = cli
+
+	if data, err := os.ReadFile(e.path("rules.json")); err == nil {
+		var set protocol.AlertRuleSet
+		if err := json.Unmarshal(data, &set); err == nil {
+			compileSilences(set.Silences)
+			e.rules = set
+			log.Printf("Alerts: loaded %d cached rules (revision %s)", len(set.Rules), set.Revision)
+		}
+	}
+	if data, err := os.ReadFile(e.path("pending.json")); err == nil {
+		json.Unmarshal(data, &e.pending)
+	}
+	if data, err := os.ReadFile(e.path("state.json")); err == nil {
+		json.Unmarshal(data, &e.states)
+	}
+
+	go e.deliverLoop()
+	return e
+}
+
+func (e *alertEvaluator) path(name string) string {
+	return filepath.Join(e.dir, name)
+}
+
+// Revision is the rule set in use, reported to the master in the agent
+// status; empty until the agent has received rules
+func (e *alertEvaluator) Revision() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rules.Revision
+}
+
+// SetRules replaces the rule set and caches it for restarts
+func (e *alertEvaluator) SetRules(set protocol.AlertRuleSet) {
+	e.mu.Lock()
+	if set.Revision == e.rules.Revision {
+		e.mu.Unlock()
+		return
+	}
+	compileSilences(set.Silences)
+	e.rules = set
+	kept := make(map[string]*resourceState)
+	for _, rule := range set.Rules {
+		for key, st := range e.states {
+			if st.RuleID == rule.ID {
+				kept[key] = st
+			}
+		}
+	}
+	e.states = kept
+	e.saveStates()
+	e.mu.Unlock()
+
+	if err := writeJSONFile(e.path("rules.json"), set); err != nil {
+		log.Printf("Alerts: failed to cache rules: %v", err)
+	}
+	log.Printf("Alerts: evaluating %d rules and %d silences (revision %s)", len(set.Rules), len(set.Silences), set.Revision)
+}
+
+func compileSilences(silences []protocol.Silence) {
+	for i := range silences {
+		if err := silences[i].Compile(); err != nil {
+			log.Printf("Alerts: silence %s has an invalid schedule: %v", silences[i].ID, err)
+		}
+	}
+}
+
+// silenceID returns the silence muting an alert of the rule on a container
+// at the given time, or ""
+func (e *alertEvaluator) silenceID(ruleID string, c protocol.ContainerMetrics, at time.Time) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range e.rules.Silences {
+		if active, _ := s.Window(at); active && s.MatchesRule(ruleID) && s.MatchesContainer(c.ID, c.Name, c.Image, c.Labels) {
+			return s.ID
+		}
+	}
+	return ""
+}
+
+// pollRules fetches the rule set from the master. Over the WebSocket stream
+// changes are also pushed as they happen; polling covers the HTTP transport
+// and rules pushed before the evaluator was up.
+func (e *alertEvaluator) pollRules(alertsURL string) {
+	rulesURL := alertsURL + "/rules?host_id=" + url.QueryEscape(e.hostID)
+	for {
+		set, err := fetchAlertRules(rulesURL, e.Revision())
+		if err != nil {
+			log.Printf("Alerts: failed to fetch rules: %v", err)
+		} else if set != nil {
+			e.SetRules(*set)
+		}
+		time.Sleep(alertRulesPoll)
+	}
+}
+
+// fetchAlertRules returns nil when the master's rules still match revision
+func fetchAlertRules(rulesURL, revision string) (*protocol.AlertRuleSet, error) {
+	req, err := http.NewRequest("GET", rulesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+currentConfig().Master.Token)
+	if revision != "" {
+		req.Header.Set("If-None-Match", `"`+revision+`"`)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("master returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var set protocol.AlertRuleSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// rulesFor returns the rules of the given types whose container ID is a
+// prefix of the container's full ID
+func (e *alertEvaluator) rulesFor(containerID string, ruleTypes ...string) []protocol.AlertRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var matched []protocol.AlertRule
+	for _, rule := range e.rules.Rules {
+		if rule.ContainerID == "" || containerID == "" || !strings.HasPrefix(containerID, rule.ContainerID) {
+			continue
+		}
+		for _, t := range ruleTypes {
+			if rule.Type == t {
+				matched = append(matched, rule)
+			}
+		}
+	}
+	return matched
+}
+
+// resourceState is a rule's condition holding on one container: pending
+// until it has held for the rule's for_seconds, then firing until the value
+// drops to the resolve threshold or, for log rules, until matches stop
+type resourceState struct {
+	RuleID      string    `json:"rule_id"`
+	ContainerID string    `json:"container_id"`
+	ActiveAt    time.Time `json:"active_at"`
+	Firing      bool      `json:"firing"`
+	Message     string    `json:"message"`
+	LastMatch   time.Time `json:"last_match,omitempty"` // log rules only
+}
+
+// CheckMetrics evaluates resource rules against one collection cycle. Only
+// transitions send alerts: firing once the condition has held long enough,
+// and resolved once it has cleared.
+func (e *alertEvaluator) CheckMetrics(containers []protocol.ContainerMetrics) {
+	now := time.Now()
+	seen := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		seen[c.ID] = true
+		for _, rule := range e.rulesFor(c.ID, "high_cpu", "high_memory") {
+			value, message := c.CPUPercent, "High CPU usage: "+strconv.FormatFloat(c.CPUPercent, 'f', 2, 64)+"%"
+			if rule.Type == "high_memory" {
+				value, message = c.MemoryMB, "High Memory usage: "+strconv.FormatFloat(c.MemoryMB, 'f', 2, 64)+" MB"
+			}
+			resolveAt := rule.ResolveThreshold
+			if resolveAt == 0 {
+				resolveAt = rule.Threshold
+			}
+
+			key := rule.ID + "/" + c.ID
+			var fire, resolve, changed bool
+			e.mu.Lock()
+			st := e.states[key]
+			switch {
+			case value > rule.Threshold:
+				if st == nil {
+					st = &resourceState{RuleID: rule.ID, ContainerID: c.ID, ActiveAt: now}
+					e.states[key] = st
+					changed = true
+				}
+				if !st.Firing && now.Sub(st.ActiveAt).Seconds() >= rule.ForSeconds {
+					st.Firing, st.Message = true, message
+					fire, changed = true, true
+				}
+			case st != nil && !st.Firing:
+				delete(e.states, key)
+				changed = true
+			case st != nil && value <= resolveAt:
+				delete(e.states, key)
+				resolve, changed = true, true
+			}
+			if changed {
+				e.saveStates()
+			}
+			e.mu.Unlock()
+
+			if fire {
+				e.fire(rule, c, value, message, false)
+			}
+			if resolve {
+				e.fire(rule, c, value, "Resolved: "+st.Message, true)
+			}
+		}
+	}
+
+	// Containers that went away take their alerts with them; an empty cycle
+	// is more likely a Docker hiccup than every container stopping
+	if len(containers) == 0 {
+		return
+	}
+	e.mu.Lock()
+	gone := 0
+	for key, st := range e.states {
+		if !seen[st.ContainerID] {
+			delete(e.states, key)
+			gone++
+		}
+	}
+	if gone > 0 {
+		e.saveStates()
+	}
+	e.mu.Unlock()
+
+	if e.cli != nil && e.checkingLogs.CompareAndSwap(false, true) {
+		go func() {
+			defer e.checkingLogs.Store(false)
+			e.checkLogs(containers)
+		}()
+	}
+}
+
+// checkLogs scans the log lines written since the last check for each
+// log_pattern rule; the first check of a container only sets the mark
+func (e *alertEvaluator) checkLogs(containers []protocol.ContainerMetrics) {
+	for _, c := range containers {
+		rules := e.rulesFor(c.ID, "log_pattern")
+		if len(rules) == 0 {
+			continue
+		}
+
+		e.mu.Lock()
+		since, ok := e.logsSeen[c.ID]
+		if !ok {
+			e.logsSeen[c.ID] = time.Now()
+		}
+		e.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		last, matches := e.scanLogs(c.ID, since, rules)
+		e.mu.Lock()
+		e.logsSeen[c.ID] = last
+		e.mu.Unlock()
+		for _, rule := range rules {
+			e.checkLogRule(rule, c, matches[rule.ID])
+		}
+	}
+}
+
+// checkLogRule moves a log_pattern rule's state on one container along like
+// CheckMetrics does for resource rules: matches make it pending, then firing
+// once they have kept coming for for_seconds, and it resolves after
+// logResolveCycles intervals without one. Only transitions send alerts.
+func (e *alertEvaluator) checkLogRule(rule protocol.AlertRule, c protocol.ContainerMetrics, n int) {
+	now := time.Now()
+	quiet := logResolveCycles * time.Duration(collectInterval.Load())
+	message := fmt.Sprintf("Log pattern matched: '%s' found (%d lines)", rule.Pattern, n)
+
+	key := rule.ID + "/" + c.ID
+	var fire, resolve, changed bool
+	e.mu.Lock()
+	st := e.states[key]
+	switch {
+	case n > 0:
+		if st == nil {
+			st = &resourceState{RuleID: rule.ID, ContainerID: c.ID, ActiveAt: now}
+			e.states[key] = st
+			changed = true
+		}
+		st.LastMatch = now
+		if !st.Firing && now.Sub(st.ActiveAt).Seconds() >= rule.ForSeconds {
+			st.Firing, st.Message = true, message
+			fire, changed = true, true
+		}
+	case st != nil && now.Sub(st.LastMatch) > quiet:
+		delete(e.states, key)
+		resolve, changed = st.Firing, true
+	}
+	if changed {
+		e.saveStates()
+	}
+	e.mu.Unlock()
+
+	if fire {
+		e.fire(rule, c, float64(n), message, false)
+	}
+	if resolve {
+		e.fire(rule, c, 0, "Resolved: "+st.Message, true)
+	}
+}
+
+// scanLogs counts lines since the given time that match each rule's
+// pattern (a regular expression) and returns the point to resume from
+func (e *alertEvaluator) scanLogs(containerID string, since time.Time, rules []protocol.AlertRule) (time.Time, map[string]int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	matches := make(map[string]int)
+	info, err := e.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return since, matches
+	}
+	reader, err := e.cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Since:      since.Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		log.Printf("Alerts: failed to read logs of %s: %v", containerID[:12], err)
+		return since, matches
+	}
+	defer reader.Close()
+
+	patterns := make(map[string]*regexp.Regexp, len(rules))
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil || rule.Pattern == "" {
+			continue
+		}
+		patterns[rule.ID] = pattern
+	}
+
+	last := since
+	readLogStream(reader, info.Config != nil && info.Config.Tty, func(stream, raw string) {
+		line := parseLogLine(containerID, "", stream, raw)
+		if line.Timestamp.After(last) {
+			last = line.Timestamp.Add(time.Nanosecond)
+		}
+		for id, pattern := range patterns {
+			if pattern.MatchString(line.Message) {
+				matches[id]++
+			}
+		}
+	})
+	return last, matches
+}
+
+// CheckEvent fires event rules (oom, die, unhealthy) for a container event
+func (e *alertEvaluator) CheckEvent(ev protocol.ContainerEvent) {
+	ruleType, message := "", ""
+	switch {
+	case ev.Action == "oom":
+		ruleType, message = "container_oom", "Container was killed by the OOM killer"
+	case ev.Action == "die" && ev.ExitCode != "0":
+		ruleType, message = "container_died", "Container exited with code "+ev.ExitCode
+	case ev.Action == "health_status" && ev.Status == "unhealthy":
+		ruleType, message = "container_unhealthy", "Container health check is failing"
+	default:
+		return
+	}
+	c := protocol.ContainerMetrics{ID: ev.ContainerID, Name: ev.Name, Image: ev.Image, Labels: ev.Labels}
+	for _, rule := range e.rulesFor(ev.ContainerID, ruleType) {
+		e.fire(rule, c, 0, message, false)
+	}
+}
+
+// fire queues an alert, or its resolution, for the master and wakes the
+// delivery loop. An alert a silence covers is marked so it is never notified
+// from the agent.
+func (e *alertEvaluator) fire(rule protocol.AlertRule, c protocol.ContainerMetrics, value float64, message string, resolved bool) {
+	alert := protocol.AgentAlert{
+		ID:            newAlertID(),
+		RuleID:        rule.ID,
+		ContainerID:   c.ID,
+		ContainerName: c.Name,
+		Type:          rule.Type,
+		Message:       message,
+		Value:         value,
+		FiredAt:       time.Now().UTC(),
+		Resolved:      resolved,
+	}
+	alert.SilenceID = e.silenceID(rule.ID, c, alert.FiredAt)
+	if alert.SilenceID != "" {
+		log.Printf("Alert: %s on %s: %s (silenced by %s)", rule.Type, c.Name, message, alert.SilenceID)
+	} else {
+		log.Printf("Alert: %s on %s: %s", rule.Type, c.Name, message)
+	}
+
+	e.mu.Lock()
+	e.pending = append(e.pending, alert)
+	if drop := len(e.pending) - maxPendingAlerts; drop > 0 {
+		log.Printf("Alerts: dropping %d undelivered alerts", drop)
+		e.pending = e.pending[drop:]
+	}
+	e.savePending()
+	e.mu.Unlock()
+
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverLoop hands pending alerts to the master as they fire and retries
+// the undelivered ones every alertRetryInterval
+func (e *alertEvaluator) deliverLoop() {
+	ticker := time.NewTicker(alertRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.wake:
+		case <-ticker.C:
+		}
+		e.deliver()
+	}
+}
+
+// deliver sends the pending alerts to the master. When the master cannot be
+// reached, alerts not yet notified are notified directly and kept for
+// reconciliation; a master that answers but refuses them does its own
+// notifying.
+func (e *alertEvaluator) deliver() {
+	e.mu.Lock()
+	batch := append([]protocol.AgentAlert(nil), e.pending...)
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	err := e.tr.Send(protocol.TypeAlerts, protocol.NewAgentAlertPayload(e.hostID, batch))
+	var rejected *rejectedError
+	switch {
+	case err == nil:
+		e.remove(batch)
+		log.Printf("Alerts: delivered %d alerts to master", len(batch))
+		return
+	case errors.As(err, &rejected):
+		// The master is up and would refuse them again
+		e.remove(batch)
+		log.Printf("Alerts: master rejected %d alerts, dropping them: %v", len(batch), err)
+		return
+	case errors.Is(err, errUnsupported):
+		// The master is up but cannot take them; it notifies its own
+		// alerts, so notifying here could send them twice
+		log.Printf("Alerts: master does not accept agent alerts, %d pending: %v", len(batch), err)
+		return
+	}
+
+	log.Printf("Alerts: master unreachable, %d alerts pending: %v", len(batch), err)
+	notified := make(map[string]bool)
+	for _, alert := range batch {
+		if !alert.Notified && alert.SilenceID == "" {
+			e.notify(alert)
+			notified[alert.ID] = true
+		}
+	}
+	if len(notified) == 0 {
+		return
+	}
+	e.mu.Lock()
+	for i := range e.pending {
+		if notified[e.pending[i].ID] {
+			e.pending[i].Notified = true
+		}
+	}
+	e.savePending()
+	e.mu.Unlock()
+}
+
+// remove drops the given alerts from the pending ones. Alerts may have been
+// queued or dropped since the batch was taken, so this goes by ID.
+func (e *alertEvaluator) remove(batch []protocol.AgentAlert) {
+	done := make(map[string]bool, len(batch))
+	for _, alert := range batch {
+		done[alert.ID] = true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := e.pending[:0]
+	for _, alert := range e.pending {
+		if !done[alert.ID] {
+			kept = append(kept, alert)
+		}
+	}
+	e.pending = kept
+	e.savePending()
+}
+
+// notify sends an alert's notifications straight from the agent
+func (e *alertEvaluator) notify(alert protocol.AgentAlert) {
+	rule, ok := e.rule(alert.RuleID)
+	if !ok {
+		return
+	}
+	text := fmt.Sprintf("[DockScope Alert] %s on %s (host %s): %s", alert.Type, alert.ContainerName, e.hostID, alert.Message)
+
+	if rule.SlackWebhook != "" {
+		if err := postSlack(rule.SlackWebhook, text); err != nil {
+			log.Printf("Alerts: Slack notification failed: %v", err)
+		}
+	}
+	if rule.Email != "" {
+		if err := sendAlertMail(rule.Email, "[DockScope Alert] "+alert.Type, text); err != nil {
+			log.Printf("Alerts: email notification failed: %v", err)
+		}
+	}
+}
+
+func (e *alertEvaluator) rule(id string) (protocol.AlertRule, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range e.rules.Rules {
+		if rule.ID == id {
+			return rule, true
+		}
+	}
+	return protocol.AlertRule{}, false
+}
+
+// saveStates persists resource alert states; callers hold e.mu
+func (e *alertEvaluator) saveStates() {
+	if err := writeJSONFile(e.path("state.json"), e.states); err != nil {
+		log.Printf("Alerts: failed to save alert states: %v", err)
+	}
+}
+
+// savePending persists undelivered alerts; callers hold e.mu
+func (e *alertEvaluator) savePending() {
+	if err := writeJSONFile(e.path("pending.json"), e.pending); err != nil {
+		log.Printf("Alerts: failed to save pending alerts: %v", err)
+	}
+}
+
+func postSlack(webhook, text string) error {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	resp, err := http.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendAlertMail uses the agent's alerts.smtp settings
+func sendAlertMail(to, subject, body string) error {
+	cfg := currentConfig().Alerts.SMTP
+	if cfg.Addr == "" {
+		return fmt.Errorf("alerts.smtp.addr is not set")
+	}
+	from := cfg.From
+	if from == "" {
+		from = cfg.Username
+	}
+	msg := []byte("To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + body + "\r\n")
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, _ := strings.Cut(cfg.Addr, ":")
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	return smtp.SendMail(cfg.Addr, auth, from, []string{to}, msg)
+}
+
+// writeJSONFile replaces path atomically
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newAlertID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
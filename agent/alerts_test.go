@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dockscope/protocol"
+)
+
+func TestLogRuleFiresOncePerTransition(t *testing.T) {
+	collectInterval.Store(int64(10 * time.Second))
+	e := &alertEvaluator{
+		hostID: "h1",
+		dir:    t.TempDir(),
+		states: make(map[string]*resourceState),
+		wake:   make(chan struct{}, 1),
+	}
+	rule := protocol.AlertRule{ID: "errors", Type: "log_pattern", Pattern: "ERROR", ContainerID: "abc"}
+	c := protocol.ContainerMetrics{ID: "abc123", Name: "web"}
+
+	// Matches on every check only fire the first time
+	for i := 0; i < 5; i++ {
+		e.checkLogRule(rule, c, 3)
+	}
+	if len(e.pending) != 1 || e.pending[0].Resolved {
+		t.Fatalf("pending = %+v, want one firing alert", e.pending)
+	}
+
+	// A quiet check soon after keeps it firing
+	e.checkLogRule(rule, c, 0)
+	if len(e.pending) != 1 {
+		t.Fatalf("pending = %+v, want still one alert", e.pending)
+	}
+
+	e.states["errors/abc123"].LastMatch = time.Now().Add(-time.Minute)
+	e.checkLogRule(rule, c, 0)
+	if len(e.pending) != 2 || !e.pending[1].Resolved {
+		t.Fatalf("pending = %+v, want the alert resolved", e.pending)
+	}
+	if len(e.states) != 0 {
+		t.Errorf("states = %v, want none after resolving", e.states)
+	}
+}
+
+type failingTransport struct{ err error }
+
+func (t failingTransport) Send(string, any) error { return t.err }
+
+func TestDeliverNotifiesOnlyWhenMasterUnreachable(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		notified   bool
+		keepsAlert bool
+	}{
+		{"unreachable", errors.New("connection refused"), true, true},
+		{"rejected", &rejectedError{status: 400, err: errors.New("master returned 400")}, false, false},
+		{"unsupported", fmt.Errorf("%w: master returned 404", errUnsupported), false, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var posts atomic.Int32
+			slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				posts.Add(1)
+			}))
+			defer slack.Close()
+
+			e := &alertEvaluator{
+				hostID: "h1",
+				tr:     failingTransport{tc.err},
+				dir:    t.TempDir(),
+				rules:  protocol.AlertRuleSet{Rules: []protocol.AlertRule{{ID: "cpu", Type: "high_cpu", SlackWebhook: slack.URL}}},
+				states: make(map[string]*resourceState),
+				wake:   make(chan struct{}, 1),
+			}
+			e.pending = []protocol.AgentAlert{{ID: "a1", RuleID: "cpu", Type: "high_cpu", FiredAt: time.Now()}}
+
+			e.deliver()
+			if got := posts.Load() > 0; got != tc.notified {
+				t.Errorf("notified = %v, want %v", got, tc.notified)
+			}
+			if got := len(e.pending) == 1; got != tc.keepsAlert {
+				t.Errorf("pending = %+v, want kept %v", e.pending, tc.keepsAlert)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"dockscope/pki"
+)
+
+// apiDocker serves the agent API; the master proxies log and stats requests
+// for this host's containers here
+var apiDocker *client.Client
+
+func startLogServer(agent *agentConfig) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		log.Fatalf("Agent API: failed to create Docker client: %v", err)
+	}
+	apiDocker = cli
+
+	http.HandleFunc("/logs", logHandler)
+	http.HandleFunc("/containers/stats", statsHandler)
+	http.HandleFunc("/containers/inspect", inspectHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/status", statusHandler)
+
+	addr := agent.API.Listen
+	if agent.TLS.CertFile == "" {
+		log.Printf("Agent log API running on %s", addr)
+		log.Fatal(http.ListenAndServe(addr, nil))
+	}
+
+	// With a CA configured only the master's client certificate is accepted
+	cfg, err := pki.ServerConfig(agent.TLS.CertFile, agent.TLS.KeyFile, agent.TLS.CAFile, agent.TLS.CAFile != "")
+	if err != nil {
+		log.Fatalf("Failed to configure log API TLS: %v", err)
+	}
+	server := &http.Server{Addr: addr, TLSConfig: cfg}
+	log.Printf("Agent log API running on %s (TLS)", addr)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// authorized accepts the master's client certificate (api.master_cn), the
+// agent's own token or the api_token the master issued for this host. Other
+// agents' certificates chain to the same CA, so the CN must match.
+func authorized(r *http.Request) bool {
+	cfg := currentConfig()
+	if cn := pki.PeerCommonName(r.TLS); cn != "" {
+		return cn == cfg.API.MasterCN
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	return tokenEqual(token, cfg.Master.Token) || tokenEqual(token, cfg.API.Token)
+}
+
+func tokenEqual(given, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// logHandler streams a container's logs. By default each line is a JSON
+// object (NDJSON) tagged with its stream and timestamp; format=raw returns
+// Docker's own stream, multiplexed unless the container has a TTY, which is
+// what the master proxies. With follow the response is chunked and flushed
+// line by line until the client goes away.
+// Query: id, tail (default 100, or "all"), since, until, stdout, stderr,
+// timestamps (raw only; NDJSON always has them), follow, format.
+func logHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	containerID := q.Get("id")
+	if containerID == "" {
+		http.Error(w, "Missing container ID", http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "raw" {
+		http.Error(w, "Invalid format: use ndjson or raw", http.StatusBadRequest)
+		return
+	}
+
+	options := types.ContainerLogsOptions{
+		ShowStdout: boolParam(q.Get("stdout"), true),
+		ShowStderr: boolParam(q.Get("stderr"), true),
+		Timestamps: boolParam(q.Get("timestamps"), false) || format == "ndjson",
+		Follow:     boolParam(q.Get("follow"), false),
+		Tail:       q.Get("tail"),
+		Since:      q.Get("since"),
+		Until:      q.Get("until"),
+	}
+	if options.Tail == "" {
+		options.Tail = "100"
+	}
+	if err := validateLogOptions(options); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The request context ends the stream when the client goes away
+	info, err := apiDocker.ContainerInspect(r.Context(), containerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, "Container not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to inspect container: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tty := info.Config != nil && info.Config.Tty
+
+	reader, err := apiDocker.ContainerLogs(r.Context(), containerID, options)
+	if err != nil {
+		http.Error(w, "Failed to fetch logs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if options.Follow && flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if format == "raw" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Tty", strconv.FormatBool(tty))
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return
+				}
+				flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	enc := json.NewEncoder(w)
+	name := strings.TrimPrefix(info.Name, "/")
+	readLogStream(reader, tty, func(stream, raw string) {
+		if enc.Encode(parseLogLine(info.ID, name, stream, raw)) == nil {
+			flush()
+		}
+	})
+}
+
+// validateLogOptions rejects parameters Docker would fail on with a vague error
+func validateLogOptions(o types.ContainerLogsOptions) error {
+	if !o.ShowStdout && !o.ShowStderr {
+		return errors.New("stdout and stderr cannot both be false")
+	}
+	if o.Tail != "all" {
+		if n, err := strconv.Atoi(o.Tail); err != nil || n < 0 {
+			return fmt.Errorf("invalid tail %q: use a line count or \"all\"", o.Tail)
+		}
+	}
+	if o.Since != "" && !validLogTime(o.Since) {
+		return fmt.Errorf("invalid since %q: use RFC3339, a Unix timestamp or a duration like 10m", o.Since)
+	}
+	if o.Until != "" && !validLogTime(o.Until) {
+		return fmt.Errorf("invalid until %q: use RFC3339, a Unix timestamp or a duration like 10m", o.Until)
+	}
+	return nil
+}
+
+// validLogTime accepts the time formats Docker does: RFC3339, Unix seconds
+// (with optional fraction) and a duration relative to now
+func validLogTime(v string) bool {
+	if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return true
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return true
+	}
+	_, err := time.ParseDuration(v)
+	return err == nil
+}
+
+// statsHandler returns a one-shot Docker stats sample (types.StatsJSON)
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	containerID := r.URL.Query().Get("id")
+	if containerID == "" {
+		http.Error(w, "Missing container ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	stats, err := apiDocker.ContainerStatsOneShot(ctx, containerID)
+	if err != nil {
+		http.Error(w, "Failed to get stats: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer stats.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Ostype", stats.OSType)
+	io.Copy(w, stats.Body)
+}
+
+// inspectHandler returns the Docker inspect document of a container
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	containerID := r.URL.Query().Get("id")
+	if containerID == "" {
+		http.Error(w, "Missing container ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	info, err := apiDocker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			http.Error(w, "Container not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to inspect container: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func boolParam(v string, def bool) bool {
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	return def
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// batcher collects items and hands them to send in batches, either when a
+// batch is full or every interval. Failed batches are retried on the next
+// flush; past maxPending the oldest items are dropped.
+type batcher[T any] struct {
+	name       string
+	in         chan T
+	maxBatch   int
+	maxPending int
+	interval   time.Duration
+	send       func([]T) error
+
+	mu      sync.Mutex
+	pending []T
+}
+
+func newBatcher[T any](name string, maxBatch, maxPending int, interval time.Duration, send func([]T) error) *batcher[T] {
+	b := &batcher[T]{
+		name:       name,
+		in:         make(chan T, maxBatch),
+		maxBatch:   maxBatch,
+		maxPending: maxPending,
+		interval:   interval,
+		send:       send,
+	}
+	go b.run()
+	return b
+}
+
+// Add queues an item, blocking only while the intake channel is full
+func (b *batcher[T]) Add(item T) {
+	b.in <- item
+}
+
+// SetMaxPending changes the buffer cap; items already buffered are kept
+func (b *batcher[T]) SetMaxPending(n int) {
+	b.mu.Lock()
+	b.maxPending = n
+	b.mu.Unlock()
+}
+
+// Pending returns the number of buffered items not yet delivered
+func (b *batcher[T]) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+func (b *batcher[T]) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case item := <-b.in:
+			b.mu.Lock()
+			b.pending = append(b.pending, item)
+			full := len(b.pending) >= b.maxBatch
+			b.mu.Unlock()
+			if full {
+				b.flush()
+			}
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+func (b *batcher[T]) flush() {
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	batch := b.pending
+	if len(batch) > b.maxBatch {
+		batch = batch[:b.maxBatch]
+	}
+	b.pending = b.pending[len(batch):]
+	b.mu.Unlock()
+
+	if err := b.send(batch); err != nil {
+		log.Printf("Failed to ship %d %s: %v", len(batch), b.name, err)
+
+		// Keep the batch for the next flush, dropping the oldest items past the cap
+		b.mu.Lock()
+		b.pending = append(append([]T{}, batch...), b.pending...)
+		if over := len(b.pending) - b.maxPending; over > 0 {
+			log.Printf("%s buffer full, dropping %d oldest", b.name, over)
+			b.pending = b.pending[over:]
+		}
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
+)
+
+const (
+	defaultCollectWorkers = 8
+	defaultStatsTimeout   = 5 * time.Second
+)
+
+// collector samples every running container with a bounded worker pool,
+// reusing one Docker client across cycles. Worker count and timeout are read
+// from the current config each cycle, so a reload applies to the next one.
+type collector struct {
+	hostID string
+	cli    *client.Client
+	host   *hostCollector
+}
+
+func newCollector(hostID string, cfg *agentConfig) (*collector, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("create Docker client: %w", err)
+	}
+	return &collector{hostID: hostID, cli: cli, host: newHostCollector(cfg)}, nil
+}
+
+// Collect samples all running containers. Containers whose stats or inspect
+// call exceeds the per-container timeout are skipped for this cycle.
+func (c *collector) Collect() protocol.MetricsPayload {
+	start := time.Now()
+	limits := currentConfig().Collect
+	timeout := time.Duration(limits.StatsTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	containers, err := c.cli.ContainerList(ctx, types.ContainerListOptions{All: false})
+	cancel()
+	if err != nil {
+		log.Printf("Failed to list containers: %v", err)
+		status.failed("docker", err)
+		payload := protocol.NewMetricsPayload(c.hostID, start, nil)
+		payload.Host = c.host.Collect()
+		payload.CollectionMs = msSince(start)
+		return payload
+	}
+
+	filter := currentFilter()
+	allowed := containers[:0]
+	for _, container := range containers {
+		if filter.Allow(strings.TrimPrefix(container.Names[0], "/"), container.Image, container.Labels) {
+			allowed = append(allowed, container)
+		}
+	}
+	containers = allowed
+
+	jobs := make(chan types.Container)
+	results := make([]*protocol.ContainerMetrics, len(containers))
+	index := make(map[string]int, len(containers))
+	for i, container := range containers {
+		index[container.ID] = i
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < limits.Workers && w < len(containers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for container := range jobs {
+				if m, err := c.sample(container, timeout); err != nil {
+					log.Printf("Failed to sample container %s: %v", container.ID[:12], err)
+				} else {
+					results[index[container.ID]] = &m
+				}
+			}
+		}()
+	}
+	for _, container := range containers {
+		jobs <- container
+	}
+	close(jobs)
+	wg.Wait()
+
+	metrics := make([]protocol.ContainerMetrics, 0, len(containers))
+	for _, m := range results {
+		if m != nil {
+			metrics = append(metrics, *m)
+		}
+	}
+
+	payload := protocol.NewMetricsPayload(c.hostID, start, metrics)
+	payload.Host = c.host.Collect()
+	payload.CollectionMs = msSince(start)
+	payload.Skipped = len(containers) - len(metrics)
+	status.collected(len(containers))
+	return payload
+}
+
+func (c *collector) sample(container types.Container, timeout time.Duration) (protocol.ContainerMetrics, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stats, err := c.cli.ContainerStats(ctx, container.ID, false)
+	if err != nil {
+		return protocol.ContainerMetrics{}, fmt.Errorf("stats: %w", err)
+	}
+	var containerStats types.StatsJSON
+	err = json.NewDecoder(stats.Body).Decode(&containerStats)
+	stats.Body.Close()
+	if err != nil {
+		return protocol.ContainerMetrics{}, fmt.Errorf("decode stats: %w", err)
+	}
+
+	name := displayName(strings.TrimPrefix(container.Names[0], "/"), container.Labels)
+	m := containerMetrics(containerStats)
+	m.ID = container.ID
+	m.Name = name
+	m.Image = container.Image
+	m.Group = container.Labels[labelGroup]
+	m.Labels = container.Labels
+	m.Timestamp = containerStats.Read.UTC()
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now().UTC()
+	}
+
+	// Restart count, uptime and health are only available from inspect
+	info, err := c.cli.ContainerInspect(ctx, container.ID)
+	if err != nil {
+		log.Printf("Failed to inspect container %s: %v", container.ID[:12], err)
+	} else {
+		applyInspect(&m, info)
+	}
+
+	log.Printf("Container: %s | CPU: %.2f%% | MEM: %.2fMB (%.1f%%) | NET: %d/%d | IO: %d/%d | PIDs: %d | IMAGE: %s",
+		name, m.CPUPercent, m.MemoryMB, m.MemoryPercent, m.NetRxBytes, m.NetTxBytes, m.DiskReadBytes, m.DiskWriteBytes, m.PIDs, container.Image)
+	return m, nil
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
+
+// containerMetrics derives the resource figures of one stats sample
+func containerMetrics(stats types.StatsJSON) protocol.ContainerMetrics {
+	const mb = 1024 * 1024
+
+	m := protocol.ContainerMetrics{
+		CPUPercent: calculateCPUPercent(stats),
+		PIDs:       stats.PidsStats.Current,
+	}
+
+	used := memoryUsage(stats.MemoryStats)
+	m.MemoryMB = float64(used) / mb
+	if limit := stats.MemoryStats.Limit; limit > 0 {
+		m.MemoryLimitMB = float64(limit) / mb
+		m.MemoryPercent = float64(used) / float64(limit) * 100
+	}
+
+	for _, n := range stats.Networks {
+		m.NetRxBytes += n.RxBytes
+		m.NetTxBytes += n.TxBytes
+	}
+
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			m.DiskReadBytes += entry.Value
+		case "write":
+			m.DiskWriteBytes += entry.Value
+		}
+	}
+	return m
+}
+
+// memoryUsage subtracts the page cache the same way `docker stats` does:
+// total_inactive_file on cgroup v1, inactive_file on cgroup v2
+func memoryUsage(mem types.MemoryStats) uint64 {
+	cache, ok := mem.Stats["total_inactive_file"]
+	if !ok {
+		cache = mem.Stats["inactive_file"]
+	}
+	if cache > mem.Usage {
+		return mem.Usage
+	}
+	return mem.Usage - cache
+}
+
+func applyInspect(m *protocol.ContainerMetrics, info types.ContainerJSON) {
+	m.RestartCount = info.RestartCount
+	if info.State == nil {
+		return
+	}
+	if started, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil && info.State.Running {
+		m.UptimeSeconds = int64(time.Since(started).Seconds())
+	}
+	if info.State.Health != nil {
+		m.Health = info.State.Health.Status
+	}
+}
+
+func calculateCPUPercent(stats types.StatsJSON) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage - stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage - stats.PreCPUStats.SystemUsage)
+	// PercpuUsage is empty on cgroup v2
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if systemDelta > 0 && cpuDelta > 0 {
+		return (cpuDelta / systemDelta) * cpus * 100.0
+	}
+	return 0.0
+}
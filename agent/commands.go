@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"dockscope/actions"
+	"dockscope/protocol"
+)
+
+const (
+	commandPollInterval = 5 * time.Second
+	commandTimeout      = 2 * time.Minute
+	maxPendingResults   = 1000
+)
+
+// commandRunner executes container actions queued on the master and reports
+// each outcome back. Results are retried until the master accepts them.
+type commandRunner struct {
+	hostID  string
+	cli     *client.Client
+	results *batcher[protocol.CommandResult]
+}
+
+func startCommandRunner(hostID string, tr transport) *commandRunner {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		log.Printf("Command runner: failed to create Docker client: %v", err)
+		return nil
+	}
+
+	r := &commandRunner{hostID: hostID, cli: cli}
+	r.results = newBatcher("command results", 10, maxPendingResults, time.Second, func(batch []protocol.CommandResult) error {
+		// A failed batch is resent whole; reporting a result twice is harmless.
+		// Results the master refuses for good (an unknown command, or one of
+		// another host) are dropped so they do not hold up the rest.
+		for _, result := range batch {
+			err := tr.Send(protocol.TypeCommandResult, result)
+			var rejected *rejectedError
+			if errors.As(err, &rejected) || errors.Is(err, errUnsupported) {
+				log.Printf("Command %s: master refused result, dropping it: %v", result.CommandID, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return r
+}
+
+// Run executes one container action and queues its result
+func (r *commandRunner) Run(cmd protocol.Command) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	log.Printf("Executing %s on %s (command %s)", cmd.Action, cmd.ContainerID, cmd.ID)
+	result := protocol.CommandResult{
+		Version:   protocol.Version,
+		HostID:    r.hostID,
+		CommandID: cmd.ID,
+		Status:    protocol.CommandSucceeded,
+	}
+	if err := actions.Execute(ctx, r.cli, cmd.Action, cmd.ContainerID); err != nil {
+		log.Printf("Command %s failed: %v", cmd.ID, err)
+		result.Status = protocol.CommandFailed
+		result.Error = err.Error()
+	}
+	r.results.Add(result)
+}
+
+// pollLoop fetches queued commands from the master when using the HTTP
+// transport; over the WebSocket stream commands are pushed instead
+func (r *commandRunner) pollLoop(commandsURL string) {
+	pollURL := commandsURL + "?host_id=" + url.QueryEscape(r.hostID)
+	for {
+		cmds, err := fetchCommands(pollURL)
+		if err != nil {
+			log.Printf("Failed to poll commands: %v", err)
+		}
+		for _, cmd := range cmds {
+			go r.Run(cmd)
+		}
+		time.Sleep(commandPollInterval)
+	}
+}
+
+func fetchCommands(pollURL string) ([]protocol.Command, error) {
+	req, err := http.NewRequest("GET", pollURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+currentConfig().Master.Token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("master returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var cmds []protocol.Command
+	if err := json.NewDecoder(resp.Body).Decode(&cmds); err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// agentConfig holds every agent setting. Values are layered: built-in
+// defaults, then the JSON or YAML config file (-config or AGENT_CONFIG), then
+// environment variables, then command-line flags.
+type agentConfig struct {
+	HostID    string   `json:"host_id"`
+	StateFile string   `json:"state_file"`
+	Interval  duration `json:"interval"`
+
+	Master struct {
+		URL         string `json:"url"`
+		LogsURL     string `json:"logs_url"`
+		EventsURL   string `json:"events_url"`
+		WSURL       string `json:"ws_url"`
+		CommandsURL string `json:"commands_url"`
+		RegisterURL string `json:"register_url"`
+		BatchURL    string `json:"batch_url"`
+		AlertsURL   string `json:"alerts_url"`
+		Transport   string `json:"transport"`   // "http" or "websocket"
+		Compression string `json:"compression"` // "gzip" or "none"
+		Token       string `json:"token"`
+	} `json:"master"`
+
+	TLS struct {
+		CAFile   string `json:"ca_file"`
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+	} `json:"tls"`
+
+	API struct {
+		Listen string `json:"listen"`
+		URL    string `json:"url"`   // advertised to the master (scheme and port only)
+		Token  string `json:"token"` // this host's api_token, issued by the master
+
+		// MasterCN is the only client certificate CN allowed to call the API
+		MasterCN string `json:"master_cn"`
+	} `json:"api"`
+
+	Filters struct {
+		IncludeLabels []string `json:"include_labels"`
+		ExcludeLabels []string `json:"exclude_labels"`
+		IncludeNames  []string `json:"include_names"`
+		ExcludeNames  []string `json:"exclude_names"`
+		IncludeImages []string `json:"include_images"`
+		ExcludeImages []string `json:"exclude_images"`
+	} `json:"filters"`
+
+	Logs struct {
+		Ship       bool `json:"ship"`
+		BatchSize  int  `json:"batch_size"`
+		MaxPending int  `json:"max_pending"`
+	} `json:"logs"`
+
+	// Batch groups several collection cycles into one push
+	Batch struct {
+		MaxPayloads int      `json:"max_payloads"`
+		MaxBytes    int      `json:"max_bytes"`
+		MaxWait     duration `json:"max_wait"` // default: interval × max_payloads
+	} `json:"batch"`
+
+	// Alerts evaluates the master's alert rules locally; SMTP is only used
+	// for notifications sent while the master is unreachable
+	Alerts struct {
+		Enabled bool   `json:"enabled"`
+		Dir     string `json:"dir"` // cached rules and undelivered alerts
+		SMTP    struct {
+			Addr     string `json:"addr"` // host:port
+			Username string `json:"username"`
+			Password string `json:"password"`
+			From     string `json:"from"`
+		} `json:"smtp"`
+	} `json:"alerts"`
+
+	Spool struct {
+		Dir      string `json:"dir"`
+		MaxFiles int    `json:"max_files"`
+	} `json:"spool"`
+
+	Collect struct {
+		Workers      int      `json:"workers"`
+		StatsTimeout duration `json:"stats_timeout"`
+	} `json:"collect"`
+
+	Host struct {
+		Proc string `json:"proc"`
+		Sys  string `json:"sys"`
+		Root string `json:"root"`
+	} `json:"host"`
+
+	path   string // config file this was loaded from, if any
+	filter *containerFilter
+}
+
+// duration accepts "30s"-style strings or a number of seconds in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = duration(time.Duration(v * float64(time.Second)))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*d = duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+func (d duration) String() string { return time.Duration(d).String() }
+
+var agentCfg atomic.Pointer[agentConfig]
+
+// currentConfig returns the configuration in effect, including SIGHUP reloads
+func currentConfig() *agentConfig {
+	return agentCfg.Load()
+}
+
+func defaultConfig() *agentConfig {
+	cfg := &agentConfig{StateFile: defaultStateFile, Interval: duration(10 * time.Second)}
+	cfg.Master.Transport = "http"
+	cfg.Master.Compression = "gzip"
+	cfg.Batch.MaxPayloads = 1
+	cfg.Batch.MaxBytes = 1 << 20
+	cfg.API.Listen = ":8880"
+	cfg.API.MasterCN = "master"
+	cfg.Logs.Ship = true
+	cfg.Logs.BatchSize = logBatchSize
+	cfg.Logs.MaxPending = maxPendingLogLines
+	cfg.Alerts.Enabled = true
+	cfg.Alerts.Dir = defaultAlertsDir
+	cfg.Spool.Dir = defaultSpoolDir
+	cfg.Spool.MaxFiles = defaultSpoolMaxFiles
+	cfg.Collect.Workers = defaultCollectWorkers
+	cfg.Collect.StatsTimeout = duration(defaultStatsTimeout)
+	cfg.Host.Proc = "/proc"
+	cfg.Host.Sys = "/sys"
+	return cfg
+}
+
+// loadConfig builds the configuration from args (os.Args[1:]), the config
+// file and the environment, and validates the result
+func loadConfig(args []string) (*agentConfig, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("AGENT_CONFIG"), "path to a JSON or YAML config file")
+	hostID := fs.String("host-id", "", "host ID (default: generated and kept in the state file)")
+	interval := fs.Duration("interval", 0, "collection interval")
+	masterURL := fs.String("master-url", "", "master metrics URL, e.g. http://master:9448/metrics")
+	transport := fs.String("transport", "", `"http" or "websocket"`)
+	compression := fs.String("compression", "", `"gzip" or "none"`)
+	batchSize := fs.Int("batch-size", 0, "collection cycles per push")
+	batchBytes := fs.Int("batch-bytes", 0, "maximum JSON bytes per push")
+	batchWait := fs.Duration("batch-wait", 0, "longest a partial batch is held back")
+	caFile := fs.String("tls-ca", "", "CA bundle for the master's certificate")
+	certFile := fs.String("tls-cert", "", "agent certificate for mTLS")
+	keyFile := fs.String("tls-key", "", "agent private key for mTLS")
+	listen := fs.String("api-listen", "", "agent API listen address")
+	shipLogs := fs.Bool("ship-logs", true, "ship container logs to the master")
+	alerts := fs.Bool("alerts", true, "evaluate alert rules locally")
+	spoolDir := fs.String("spool-dir", "", "directory for undelivered metrics")
+	spoolMax := fs.Int("spool-max-files", 0, "maximum spooled payloads")
+	workers := fs.Int("workers", 0, "concurrent container samples")
+	statsTimeout := fs.Duration("stats-timeout", 0, "per-container stats timeout")
+	filters := map[string]*string{}
+	for _, name := range []string{"include-labels", "exclude-labels", "include-names", "exclude-names", "include-images", "exclude-images"} {
+		filters[name] = fs.String(name, "", "comma-separated "+strings.ReplaceAll(name, "-", " ")+" filter")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("flags: %w", err)
+	}
+
+	if *path != "" {
+		if err := cfg.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host-id":
+			cfg.HostID = *hostID
+		case "interval":
+			cfg.Interval = duration(*interval)
+		case "master-url":
+			cfg.Master.URL = *masterURL
+		case "transport":
+			cfg.Master.Transport = *transport
+		case "compression":
+			cfg.Master.Compression = *compression
+		case "batch-size":
+			cfg.Batch.MaxPayloads = *batchSize
+		case "batch-bytes":
+			cfg.Batch.MaxBytes = *batchBytes
+		case "batch-wait":
+			cfg.Batch.MaxWait = duration(*batchWait)
+		case "tls-ca":
+			cfg.TLS.CAFile = *caFile
+		case "tls-cert":
+			cfg.TLS.CertFile = *certFile
+		case "tls-key":
+			cfg.TLS.KeyFile = *keyFile
+		case "api-listen":
+			cfg.API.Listen = *listen
+		case "ship-logs":
+			cfg.Logs.Ship = *shipLogs
+		case "alerts":
+			cfg.Alerts.Enabled = *alerts
+		case "spool-dir":
+			cfg.Spool.Dir = *spoolDir
+		case "spool-max-files":
+			cfg.Spool.MaxFiles = *spoolMax
+		case "workers":
+			cfg.Collect.Workers = *workers
+		case "stats-timeout":
+			cfg.Collect.StatsTimeout = duration(*statsTimeout)
+		default:
+			if v, ok := filters[f.Name]; ok {
+				*cfg.filterList(f.Name) = splitList(*v)
+			}
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cfg.deriveEndpoints()
+	return cfg, nil
+}
+
+// readFile reads a JSON or, by its .yaml/.yml extension, YAML config file.
+// YAML is converted to JSON first, so both take the same keys and are
+// decoded and checked the same way.
+func (c *agentConfig) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		var doc any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("config file %s: %v", path, err)
+		}
+		if doc == nil {
+			doc = map[string]any{} // an empty file sets nothing
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("config file %s: %v", path, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			line := bytes.Count(data[:syntax.Offset], []byte("\n")) + 1
+			return fmt.Errorf("config file %s: line %d: %v", path, line, err)
+		}
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	c.path = path
+	return nil
+}
+
+// applyEnv overrides the file with the environment variables the agent has
+// always read, so existing deployments keep working
+func (c *agentConfig) applyEnv() error {
+	str := map[string]*string{
+		"HOST_ID":              &c.HostID,
+		"STATE_FILE":           &c.StateFile,
+		"CENTRAL_SERVER_URL":   &c.Master.URL,
+		"CENTRAL_LOGS_URL":     &c.Master.LogsURL,
+		"CENTRAL_EVENTS_URL":   &c.Master.EventsURL,
+		"CENTRAL_WS_URL":       &c.Master.WSURL,
+		"CENTRAL_COMMANDS_URL": &c.Master.CommandsURL,
+		"CENTRAL_REGISTER_URL": &c.Master.RegisterURL,
+		"CENTRAL_BATCH_URL":    &c.Master.BatchURL,
+		"CENTRAL_ALERTS_URL":   &c.Master.AlertsURL,
+		"AGENT_TRANSPORT":      &c.Master.Transport,
+		"AGENT_COMPRESSION":    &c.Master.Compression,
+		"AUTH_TOKEN":           &c.Master.Token,
+		"TLS_CA_FILE":          &c.TLS.CAFile,
+		"TLS_CERT_FILE":        &c.TLS.CertFile,
+		"TLS_KEY_FILE":         &c.TLS.KeyFile,
+		"AGENT_API_LISTEN":     &c.API.Listen,
+		"AGENT_API_URL":        &c.API.URL,
+		"AGENT_API_TOKEN":      &c.API.Token,
+		"AGENT_API_MASTER_CN":  &c.API.MasterCN,
+		"ALERTS_DIR":           &c.Alerts.Dir,
+		"ALERT_SMTP_ADDR":      &c.Alerts.SMTP.Addr,
+		"ALERT_SMTP_USERNAME":  &c.Alerts.SMTP.Username,
+		"ALERT_SMTP_PASSWORD":  &c.Alerts.SMTP.Password,
+		"ALERT_SMTP_FROM":      &c.Alerts.SMTP.From,
+		"SPOOL_DIR":            &c.Spool.Dir,
+		"HOST_PROC":            &c.Host.Proc,
+		"HOST_SYS":             &c.Host.Sys,
+		"HOST_ROOT":            &c.Host.Root,
+	}
+	for name, dst := range str {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+
+	ints := map[string]*int{
+		"SPOOL_MAX_FILES": &c.Spool.MaxFiles,
+		"COLLECT_WORKERS": &c.Collect.Workers,
+		"LOG_BATCH_SIZE":  &c.Logs.BatchSize,
+		"LOG_MAX_PENDING": &c.Logs.MaxPending,
+		"BATCH_SIZE":      &c.Batch.MaxPayloads,
+		"BATCH_BYTES":     &c.Batch.MaxBytes,
+	}
+	for name, dst := range ints {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = n
+		}
+	}
+
+	durations := map[string]*duration{
+		"COLLECT_INTERVAL": &c.Interval,
+		"STATS_TIMEOUT":    &c.Collect.StatsTimeout,
+		"BATCH_WAIT":       &c.Batch.MaxWait,
+	}
+	for name, dst := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = duration(d)
+		}
+	}
+
+	if v := os.Getenv("SHIP_LOGS"); v != "" {
+		c.Logs.Ship = v != "false"
+	}
+	if v := os.Getenv("AGENT_ALERTS"); v != "" {
+		c.Alerts.Enabled = v != "false"
+	}
+
+	for _, name := range []string{"include-labels", "exclude-labels", "include-names", "exclude-names", "include-images", "exclude-images"} {
+		env := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if v := os.Getenv(env); v != "" {
+			*c.filterList(name) = splitList(v)
+		}
+	}
+	return nil
+}
+
+func (c *agentConfig) filterList(name string) *[]string {
+	switch name {
+	case "include-labels":
+		return &c.Filters.IncludeLabels
+	case "exclude-labels":
+		return &c.Filters.ExcludeLabels
+	case "include-names":
+		return &c.Filters.IncludeNames
+	case "exclude-names":
+		return &c.Filters.ExcludeNames
+	case "include-images":
+		return &c.Filters.IncludeImages
+	}
+	return &c.Filters.ExcludeImages
+}
+
+// deriveEndpoints fills master URLs that were not set from the metrics URL
+func (c *agentConfig) deriveEndpoints() {
+	m := &c.Master
+	base := strings.TrimSuffix(m.URL, "/metrics")
+	for dst, path := range map[*string]string{
+		&m.LogsURL:     "/agent/logs",
+		&m.EventsURL:   "/agent/events",
+		&m.WSURL:       "/agent/ws",
+		&m.CommandsURL: "/agent/commands",
+		&m.RegisterURL: "/agent/register",
+		&m.BatchURL:    "/agent/metrics/batch",
+		&m.AlertsURL:   "/agent/alerts",
+	} {
+		if *dst == "" && m.URL != "" {
+			*dst = base + path
+		}
+	}
+}
+
+// batchWait is how long a partial batch may be held back
+func (c *agentConfig) batchWait() time.Duration {
+	if c.Batch.MaxWait > 0 {
+		return time.Duration(c.Batch.MaxWait)
+	}
+	return time.Duration(c.Interval) * time.Duration(c.Batch.MaxPayloads)
+}
+
+// validate checks the whole configuration and reports every problem at once
+func (c *agentConfig) validate() error {
+	var errs []string
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.Master.URL == "" {
+		bad("master.url is required (CENTRAL_SERVER_URL or -master-url)")
+	}
+	urls := []struct{ name, value string }{
+		{"master.url", c.Master.URL}, {"master.logs_url", c.Master.LogsURL},
+		{"master.events_url", c.Master.EventsURL}, {"master.ws_url", c.Master.WSURL},
+		{"master.commands_url", c.Master.CommandsURL}, {"master.register_url", c.Master.RegisterURL},
+		{"master.batch_url", c.Master.BatchURL}, {"master.alerts_url", c.Master.AlertsURL},
+		{"api.url", c.API.URL},
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.value); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			bad("%s: %q is not an absolute URL", u.name, u.value)
+		}
+	}
+	if c.Master.Transport != "http" && c.Master.Transport != "websocket" {
+		bad("master.transport: must be \"http\" or \"websocket\", got %q", c.Master.Transport)
+	}
+	if c.Master.Compression != "gzip" && c.Master.Compression != "none" {
+		bad("master.compression: must be \"gzip\" or \"none\", got %q", c.Master.Compression)
+	}
+	if c.Batch.MaxPayloads <= 0 {
+		bad("batch.max_payloads: must be positive, got %d", c.Batch.MaxPayloads)
+	}
+	if c.Batch.MaxBytes <= 0 {
+		bad("batch.max_bytes: must be positive, got %d", c.Batch.MaxBytes)
+	}
+	if c.Batch.MaxWait < 0 {
+		bad("batch.max_wait: must not be negative, got %s", c.Batch.MaxWait)
+	}
+	if time.Duration(c.Interval) < time.Second {
+		bad("interval: must be at least 1s, got %s", c.Interval)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		bad("tls: cert_file and key_file must be set together")
+	}
+	files := []struct{ name, path string }{
+		{"tls.ca_file", c.TLS.CAFile}, {"tls.cert_file", c.TLS.CertFile}, {"tls.key_file", c.TLS.KeyFile},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			bad("%s: %v", f.name, err)
+		}
+	}
+	if c.API.Listen == "" {
+		bad("api.listen is required")
+	}
+	if c.Logs.BatchSize <= 0 {
+		bad("logs.batch_size: must be positive, got %d", c.Logs.BatchSize)
+	}
+	if c.Logs.MaxPending < c.Logs.BatchSize {
+		bad("logs.max_pending: must be at least logs.batch_size (%d), got %d", c.Logs.BatchSize, c.Logs.MaxPending)
+	}
+	if c.Alerts.Enabled && c.Alerts.Dir == "" {
+		bad("alerts.dir is required when alerts are enabled")
+	}
+	if c.Spool.Dir == "" {
+		bad("spool.dir is required")
+	}
+	if c.Spool.MaxFiles <= 0 {
+		bad("spool.max_files: must be positive, got %d", c.Spool.MaxFiles)
+	}
+	if c.Collect.Workers <= 0 {
+		bad("collect.workers: must be positive, got %d", c.Collect.Workers)
+	}
+	if time.Duration(c.Collect.StatsTimeout) <= 0 {
+		bad("collect.stats_timeout: must be positive, got %s", c.Collect.StatsTimeout)
+	}
+
+	f := c.Filters
+	filter, err := newContainerFilter(f.IncludeLabels, f.ExcludeLabels, f.IncludeNames, f.ExcludeNames, f.IncludeImages, f.ExcludeImages)
+	if err != nil {
+		bad("filters: %v", err)
+	}
+	c.filter = filter
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// reload re-reads the configuration and applies what can change at runtime:
+// interval, tokens, filters, collection limits, batching, compression and
+// buffer caps. Buffered logs,
+// events and spooled metrics are kept. Anything else needs a restart.
+func reload(outbox *spool, shipper *logShipper) {
+	old := currentConfig()
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+
+	// Token and compression are read per request; the rest of master is wired at startup
+	oldMaster, newMaster := old.Master, cfg.Master
+	oldMaster.Token, newMaster.Token = "", ""
+	oldMaster.Compression, newMaster.Compression = "", ""
+	restart := []struct {
+		name    string
+		changed bool
+	}{
+		{"host_id", cfg.HostID != old.HostID},
+		{"state_file", cfg.StateFile != old.StateFile},
+		{"master", newMaster != oldMaster},
+		{"tls", cfg.TLS != old.TLS},
+		{"api.listen", cfg.API.Listen != old.API.Listen},
+		{"logs.ship", cfg.Logs.Ship != old.Logs.Ship},
+		{"logs.batch_size", cfg.Logs.BatchSize != old.Logs.BatchSize},
+		{"alerts.enabled", cfg.Alerts.Enabled != old.Alerts.Enabled},
+		{"alerts.dir", cfg.Alerts.Dir != old.Alerts.Dir},
+		{"spool.dir", cfg.Spool.Dir != old.Spool.Dir},
+		{"host", cfg.Host != old.Host},
+	}
+	for _, r := range restart {
+		if r.changed {
+			log.Printf("Reload: %s changed, restart the agent to apply it", r.name)
+		}
+	}
+
+	agentCfg.Store(cfg)
+	activeFilter.Store(cfg.filter)
+	// An interval the master set at runtime stays until the configured one changes
+	if cfg.Interval != old.Interval {
+		collectInterval.Store(int64(cfg.Interval))
+	}
+	outbox.SetMaxFiles(cfg.Spool.MaxFiles)
+	outbox.SetBatch(cfg.Batch.MaxPayloads, cfg.Batch.MaxBytes, cfg.batchWait())
+	if shipper != nil {
+		shipper.lines.SetMaxPending(cfg.Logs.MaxPending)
+	}
+
+	log.Printf("Configuration reloaded (interval %s, %d workers, stats timeout %s)", time.Duration(collectInterval.Load()), cfg.Collect.Workers, cfg.Collect.StatsTimeout)
+	cfg.filter.logSummary()
+}
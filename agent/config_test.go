@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFileYAMLMatchesJSON(t *testing.T) {
+	fromJSON, fromYAML := defaultConfig(), defaultConfig()
+	if err := fromJSON.readFile("agent.example.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fromYAML.readFile("agent.example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	fromJSON.path, fromYAML.path = "", ""
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("YAML config = %+v, want the same as JSON %+v", fromYAML, fromJSON)
+	}
+	if time.Duration(fromYAML.Collect.StatsTimeout) != 5*time.Second || fromYAML.Master.Token != "my-agent-secret" {
+		t.Errorf("YAML config = %+v, want the example's values", fromYAML)
+	}
+}
+
+func TestReadFileYAMLErrors(t *testing.T) {
+	for name, tc := range map[string]struct{ content, want string }{
+		"unknown key":  {"intervall: 10s\n", `unknown field "intervall"`},
+		"bad duration": {"interval: soon\n", `invalid duration "soon"`},
+		"syntax":       {"master:\n  url: [\n", "line"},
+	} {
+		path := filepath.Join(t.TempDir(), "agent.yml")
+		if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := defaultConfig().readFile(path)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error = %v, want one mentioning %s", name, err, tc.want)
+		}
+	}
+}
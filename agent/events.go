@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"dockscope/events"
+	"dockscope/protocol"
+)
+
+const (
+	eventFlushInterval = 2 * time.Second
+	eventBatchSize     = 100
+	maxPendingEvents   = 10000
+)
+
+// startEventWatcher forwards Docker container lifecycle events to the master
+// and to the local alert evaluator, if any
+func startEventWatcher(hostID string, tr transport, alerts *alertEvaluator) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		log.Printf("Event watcher: failed to create Docker client: %v", err)
+		return
+	}
+
+	queue := newBatcher("events", eventBatchSize, maxPendingEvents, eventFlushInterval, func(batch []protocol.ContainerEvent) error {
+		return tr.Send(protocol.TypeEvents, protocol.NewEventPayload(hostID, batch))
+	})
+
+	go events.Watch(context.Background(), cli, func(ev protocol.ContainerEvent) {
+		if !currentFilter().Allow(ev.Name, ev.Image, ev.Labels) {
+			return
+		}
+		ev.Name = displayName(ev.Name, ev.Labels)
+		log.Printf("Event: %s %s %s", ev.Name, ev.Action, ev.Status)
+		queue.Add(ev)
+		if alerts != nil {
+			alerts.CheckEvent(ev)
+		}
+	})
+	log.Println("Forwarding container events to master")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Container labels understood by the agent
+const (
+	labelEnable = "dockscope.enable" // "false" opts a container out of monitoring
+	labelName   = "dockscope.name"   // display name instead of the container name
+	labelGroup  = "dockscope.group"  // service group the container belongs to
+)
+
+// containerFilter decides which containers the agent monitors. A container is
+// skipped when it carries dockscope.enable=false or matches any exclude rule.
+// When include rules are set it must also match at least one of them.
+type containerFilter struct {
+	includeLabels []labelSelector
+	excludeLabels []labelSelector
+	includeNames  []*regexp.Regexp
+	excludeNames  []*regexp.Regexp
+	includeImages []*regexp.Regexp
+	excludeImages []*regexp.Regexp
+}
+
+// labelSelector matches "key", "key=value" or "key!=value"
+type labelSelector struct {
+	key, value string
+	negate     bool
+	exists     bool
+}
+
+var activeFilter atomic.Pointer[containerFilter]
+
+// currentFilter returns the filter in effect; it never returns nil
+func currentFilter() *containerFilter {
+	if f := activeFilter.Load(); f != nil {
+		return f
+	}
+	return &containerFilter{}
+}
+
+// newContainerFilter compiles the include and exclude rules. Names and images
+// are globs where * matches anything.
+func newContainerFilter(includeLabels, excludeLabels, includeNames, excludeNames, includeImages, excludeImages []string) (*containerFilter, error) {
+	f := &containerFilter{}
+	var err error
+	if f.includeLabels, err = parseSelectors(includeLabels); err != nil {
+		return nil, fmt.Errorf("include labels: %w", err)
+	}
+	if f.excludeLabels, err = parseSelectors(excludeLabels); err != nil {
+		return nil, fmt.Errorf("exclude labels: %w", err)
+	}
+	if f.includeNames, err = compileGlobs(includeNames); err != nil {
+		return nil, fmt.Errorf("include names: %w", err)
+	}
+	if f.excludeNames, err = compileGlobs(excludeNames); err != nil {
+		return nil, fmt.Errorf("exclude names: %w", err)
+	}
+	if f.includeImages, err = compileGlobs(includeImages); err != nil {
+		return nil, fmt.Errorf("include images: %w", err)
+	}
+	if f.excludeImages, err = compileGlobs(excludeImages); err != nil {
+		return nil, fmt.Errorf("exclude images: %w", err)
+	}
+	return f, nil
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseSelectors(items []string) ([]labelSelector, error) {
+	var selectors []labelSelector
+	for _, item := range items {
+		var sel labelSelector
+		switch {
+		case strings.Contains(item, "!="):
+			sel.key, sel.value, _ = strings.Cut(item, "!=")
+			sel.negate = true
+		case strings.Contains(item, "="):
+			sel.key, sel.value, _ = strings.Cut(item, "=")
+		default:
+			sel.key = item
+			sel.exists = true
+		}
+		sel.key = strings.TrimSpace(sel.key)
+		sel.value = strings.TrimSpace(sel.value)
+		if sel.key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", item)
+		}
+		selectors = append(selectors, sel)
+	}
+	return selectors, nil
+}
+
+func compileGlobs(items []string) ([]*regexp.Regexp, error) {
+	var globs []*regexp.Regexp
+	for _, item := range items {
+		pattern := regexp.QuoteMeta(item)
+		pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+		pattern = strings.ReplaceAll(pattern, `\?`, ".")
+		re, err := regexp.Compile("^" + pattern + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", item, err)
+		}
+		globs = append(globs, re)
+	}
+	return globs, nil
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	v, ok := labels[s.key]
+	switch {
+	case s.exists:
+		return ok
+	case s.negate:
+		return v != s.value
+	}
+	return ok && v == s.value
+}
+
+func anySelector(selectors []labelSelector, labels map[string]string) bool {
+	for _, s := range selectors {
+		if s.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyGlob(globs []*regexp.Regexp, s string) bool {
+	for _, re := range globs {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow reports whether a container should be monitored. name is the Docker
+// container name without the leading slash.
+func (f *containerFilter) Allow(name, image string, labels map[string]string) bool {
+	if strings.EqualFold(labels[labelEnable], "false") {
+		return false
+	}
+	if anySelector(f.excludeLabels, labels) || anyGlob(f.excludeNames, name) || anyGlob(f.excludeImages, image) {
+		return false
+	}
+	if len(f.includeLabels) == 0 && len(f.includeNames) == 0 && len(f.includeImages) == 0 {
+		return true
+	}
+	return anySelector(f.includeLabels, labels) || anyGlob(f.includeNames, name) || anyGlob(f.includeImages, image)
+}
+
+// Empty reports whether the filter has no rules besides the opt-out label
+func (f *containerFilter) Empty() bool {
+	return len(f.includeLabels)+len(f.excludeLabels)+len(f.includeNames)+
+		len(f.excludeNames)+len(f.includeImages)+len(f.excludeImages) == 0
+}
+
+func (f *containerFilter) logSummary() {
+	if f.Empty() {
+		log.Printf("Monitoring all containers (opt out with %s=false)", labelEnable)
+		return
+	}
+	log.Printf("Container filter: include %d label / %d name / %d image rules, exclude %d / %d / %d",
+		len(f.includeLabels), len(f.includeNames), len(f.includeImages),
+		len(f.excludeLabels), len(f.excludeNames), len(f.excludeImages))
+}
+
+// displayName returns the dockscope.name label when set
+func displayName(name string, labels map[string]string) string {
+	if v := strings.TrimSpace(labels[labelName]); v != "" {
+		return v
+	}
+	return name
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"dockscope/protocol"
+)
+
+// Pseudo and container filesystems that say nothing about disk space on the node
+var ignoredFSTypes = map[string]bool{
+	"proc": true, "sysfs": true, "devtmpfs": true, "devpts": true, "tmpfs": true,
+	"cgroup": true, "cgroup2": true, "overlay": true, "squashfs": true, "nsfs": true,
+	"mqueue": true, "debugfs": true, "tracefs": true, "securityfs": true, "pstore": true,
+	"bpf": true, "autofs": true, "hugetlbfs": true, "configfs": true, "fusectl": true,
+	"binfmt_misc": true, "rpc_pipefs": true, "efivarfs": true, "shm": true,
+}
+
+// hostCollector reads node metrics. When the agent runs in a container, mount
+// the host's /proc, /sys and / and point host.proc, host.sys and host.root
+// (HOST_PROC, HOST_SYS, HOST_ROOT) at them.
+type hostCollector struct {
+	procDir string
+	sysDir  string
+	rootDir string
+
+	// previous /proc/stat totals, for CPU usage between cycles
+	prevTotal, prevIdle uint64
+	warned              bool
+}
+
+func newHostCollector(cfg *agentConfig) *hostCollector {
+	return &hostCollector{procDir: cfg.Host.Proc, sysDir: cfg.Host.Sys, rootDir: cfg.Host.Root}
+}
+
+// Collect reads every host metric it can; sources that fail are left empty
+func (h *hostCollector) Collect() *protocol.HostMetrics {
+	m := &protocol.HostMetrics{}
+	var errs []string
+
+	if err := h.readCPU(m); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := h.readLoad(m); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := h.readMemory(m); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := h.readFilesystems(m); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := h.readInterfaces(m); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	// Missing sources don't come back on their own, so only log them once
+	if len(errs) > 0 && !h.warned {
+		log.Printf("Host metrics incomplete: %s", strings.Join(errs, "; "))
+		h.warned = true
+	}
+	return m
+}
+
+// readCPU computes usage since the previous cycle from the aggregate cpu line
+func (h *hostCollector) readCPU(m *protocol.HostMetrics) error {
+	f, err := os.Open(filepath.Join(h.procDir, "stat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "cpu":
+			var total, idle uint64
+			for i, v := range fields[1:] {
+				n, _ := strconv.ParseUint(v, 10, 64)
+				// guest and guest_nice are already counted in user and nice
+				if i >= 8 {
+					break
+				}
+				total += n
+				if i == 3 || i == 4 { // idle, iowait
+					idle += n
+				}
+			}
+			if h.prevTotal > 0 && total > h.prevTotal {
+				busy := float64((total - h.prevTotal) - (idle - h.prevIdle))
+				m.CPUPercent = busy / float64(total-h.prevTotal) * 100
+			}
+			h.prevTotal, h.prevIdle = total, idle
+
+		case strings.HasPrefix(fields[0], "cpu"):
+			m.CPUs++
+		}
+	}
+	return scanner.Err()
+}
+
+func (h *hostCollector) readLoad(m *protocol.HostMetrics) error {
+	data, err := os.ReadFile(filepath.Join(h.procDir, "loadavg"))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("unexpected loadavg %q", data)
+	}
+	m.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	m.Load5, _ = strconv.ParseFloat(fields[1], 64)
+	m.Load15, _ = strconv.ParseFloat(fields[2], 64)
+	return nil
+}
+
+func (h *hostCollector) readMemory(m *protocol.HostMetrics) error {
+	f, err := os.Open(filepath.Join(h.procDir, "meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSuffix(fields[0], ":") {
+		case "MemTotal":
+			m.MemoryTotalBytes = kb * 1024
+		case "MemAvailable":
+			m.MemoryAvailableBytes = kb * 1024
+		case "SwapTotal":
+			m.SwapTotalBytes = kb * 1024
+		case "SwapFree":
+			m.SwapFreeBytes = kb * 1024
+		}
+	}
+	return scanner.Err()
+}
+
+// readFilesystems reports each real filesystem once, from the mount table of
+// the host's init process
+func (h *hostCollector) readFilesystems(m *protocol.HostMetrics) error {
+	f, err := os.Open(filepath.Join(h.procDir, "1", "mounts"))
+	if err != nil {
+		f, err = os.Open(filepath.Join(h.procDir, "mounts"))
+		if err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		device, mount, fsType := fields[0], unescapeMount(fields[1]), fields[2]
+		if ignoredFSTypes[fsType] || seen[device] {
+			continue
+		}
+
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(filepath.Join(h.rootDir, mount), &st); err != nil || st.Blocks == 0 {
+			continue
+		}
+		seen[device] = true
+
+		bsize := uint64(st.Bsize)
+		total := uint64(st.Blocks) * bsize
+		free := uint64(st.Bavail) * bsize
+		used := total - uint64(st.Bfree)*bsize
+
+		fs := protocol.FilesystemUsage{
+			Mount:      mount,
+			Device:     device,
+			Type:       fsType,
+			TotalBytes: total,
+			UsedBytes:  used,
+			FreeBytes:  free,
+		}
+		// Same as df: reserved blocks count as neither used nor available
+		if used+free > 0 {
+			fs.UsedPercent = float64(used) / float64(used+free) * 100
+		}
+		m.Filesystems = append(m.Filesystems, fs)
+	}
+	return scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes (\040 for space) used in /proc/mounts
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// readInterfaces reads counters from /sys/class/net, skipping loopback and
+// container veth pairs
+func (h *hostCollector) readInterfaces(m *protocol.HostMetrics) error {
+	dir := filepath.Join(h.sysDir, "class", "net")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "lo" || strings.HasPrefix(name, "veth") {
+			continue
+		}
+		stat := func(counter string) uint64 {
+			data, err := os.ReadFile(filepath.Join(dir, name, "statistics", counter))
+			if err != nil {
+				return 0
+			}
+			n, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			return n
+		}
+		m.Interfaces = append(m.Interfaces, protocol.InterfaceCounters{
+			Name:      name,
+			RxBytes:   stat("rx_bytes"),
+			TxBytes:   stat("tx_bytes"),
+			RxPackets: stat("rx_packets"),
+			TxPackets: stat("tx_packets"),
+			RxErrors:  stat("rx_errors"),
+			TxErrors:  stat("tx_errors"),
+			RxDropped: stat("rx_dropped"),
+			TxDropped: stat("tx_dropped"),
+		})
+	}
+	return nil
+}
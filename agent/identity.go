@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
+)
+
+// agentVersion is set at build time with -ldflags "-X main.agentVersion=..."
+var agentVersion = "dev"
+
+const defaultStateFile = "state/agent.json"
+
+// agentState is persisted across restarts so the host keeps its identity
+type agentState struct {
+	HostID    string    `json:"host_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// resolveHostID returns the configured ID when set, otherwise the ID stored in
+// the state file, generating and saving a new UUID on first start
+func resolveHostID(id, path string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+
+	var state agentState
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return "", fmt.Errorf("read state file %s: %w", path, err)
+		}
+		if state.HostID != "" {
+			return state.HostID, nil
+		}
+	case !os.IsNotExist(err):
+		return "", err
+	}
+
+	id, err = newUUID()
+	if err != nil {
+		return "", err
+	}
+	state = agentState{HostID: id, CreatedAt: time.Now().UTC()}
+	data, _ = json.MarshalIndent(state, "", "  ")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	log.Printf("Generated host ID %s (saved to %s)", id, path)
+	return id, nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// hostRegistration describes this node. Host details come from the configured
+// host paths, so a containerised agent reports the host, not itself.
+func hostRegistration(hostID string, cfg *agentConfig) protocol.Registration {
+	h := newHostCollector(cfg)
+	reg := protocol.Registration{
+		Version:      protocol.Version,
+		HostID:       hostID,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		CPUs:         runtime.NumCPU(),
+		AgentVersion: agentVersion,
+	}
+
+	if data, err := os.ReadFile(filepath.Join(h.procDir, "sys", "kernel", "hostname")); err == nil {
+		reg.Hostname = strings.TrimSpace(string(data))
+	} else {
+		reg.Hostname, _ = os.Hostname()
+	}
+	if data, err := os.ReadFile(filepath.Join(h.procDir, "sys", "kernel", "osrelease")); err == nil {
+		reg.Kernel = strings.TrimSpace(string(data))
+	}
+	if name := osPrettyName(filepath.Join(h.rootDir, "/etc/os-release")); name != "" {
+		reg.OS = name
+	}
+
+	var m protocol.HostMetrics
+	if err := h.readMemory(&m); err == nil {
+		reg.MemoryBytes = m.MemoryTotalBytes
+	}
+	if err := h.readCPU(&m); err == nil && m.CPUs > 0 {
+		reg.CPUs = m.CPUs
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if v, err := cli.ServerVersion(ctx); err == nil {
+			reg.DockerVersion = v.Version
+		}
+		cancel()
+		cli.Close()
+	}
+	return reg
+}
+
+func osPrettyName(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
+
+// register announces the host to the master, retrying with backoff until accepted
+func register(tr transport, reg protocol.Registration) {
+	backoff := time.Second
+	for {
+		err := tr.Send(protocol.TypeRegister, reg)
+		if err == nil {
+			log.Printf("Registered with master as %s (%s, %s, Docker %s)", reg.HostID, reg.Hostname, reg.OS, reg.DockerVersion)
+			return
+		}
+		log.Printf("Registration failed: %v (retrying in %s)", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 5*time.Minute {
+			backoff = 5 * time.Minute
+		}
+	}
+}
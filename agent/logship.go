@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
+)
+
+const (
+	logFlushInterval   = 2 * time.Second
+	logBatchSize       = 500
+	maxPendingLogLines = 5000
+	logDiscoverEvery   = 5 * time.Second
+)
+
+// logShipper follows the log stream of every running container and pushes
+// batched lines to the master's /agent/logs endpoint.
+type logShipper struct {
+	cli   *client.Client
+	lines *batcher[protocol.LogLine]
+
+	mu       sync.Mutex
+	followed map[string]context.CancelFunc
+	lastSeen map[string]time.Time
+}
+
+func startLogShipper(hostID string, tr transport, batchSize, maxPending int) *logShipper {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		log.Printf("Log shipper: failed to create Docker client: %v", err)
+		return nil
+	}
+
+	s := &logShipper{
+		cli: cli,
+		lines: newBatcher("log lines", batchSize, maxPending, logFlushInterval, func(batch []protocol.LogLine) error {
+			return tr.Send(protocol.TypeLogs, protocol.NewLogPayload(hostID, batch))
+		}),
+		followed: make(map[string]context.CancelFunc),
+		lastSeen: make(map[string]time.Time),
+	}
+	go s.discoverLoop()
+	log.Println("Shipping container logs to master")
+	return s
+}
+
+// SendRecent ships the last tail lines of a container right away, on the master's request
+func (s *logShipper) SendRecent(containerID string, tail int) error {
+	if tail <= 0 {
+		tail = 100
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	info, err := s.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(info.Name, "/")
+
+	reader, err := s.cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Tail:       strconv.Itoa(tail),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	emit := func(stream, raw string) {
+		s.lines.Add(parseLogLine(info.ID, name, stream, raw))
+	}
+	return readLogStream(reader, info.Config != nil && info.Config.Tty, emit)
+}
+
+// discoverLoop starts a follower for new containers and stops followers for removed ones
+func (s *logShipper) discoverLoop() {
+	cli := s.cli
+	for {
+		containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
+		if err != nil {
+			log.Printf("Log shipper: failed to list containers: %v", err)
+		} else {
+			filter := currentFilter()
+			running := make(map[string]bool)
+			for _, c := range containers {
+				name := strings.TrimPrefix(c.Names[0], "/")
+				if !filter.Allow(name, c.Image, c.Labels) {
+					continue
+				}
+				running[c.ID] = true
+				s.mu.Lock()
+				_, ok := s.followed[c.ID]
+				s.mu.Unlock()
+				if !ok {
+					s.follow(cli, c.ID, displayName(name, c.Labels))
+				}
+			}
+
+			s.mu.Lock()
+			for id, cancel := range s.followed {
+				if !running[id] {
+					cancel()
+					delete(s.followed, id)
+					delete(s.lastSeen, id)
+				}
+			}
+			s.mu.Unlock()
+		}
+		time.Sleep(logDiscoverEvery)
+	}
+}
+
+func (s *logShipper) follow(cli *client.Client, containerID, name string) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.mu.Lock()
+	s.followed[containerID] = cancel
+	since, ok := s.lastSeen[containerID]
+	s.mu.Unlock()
+	if !ok {
+		since = time.Now()
+	}
+
+	go func() {
+		defer func() {
+			// Let discoverLoop pick the container up again if the stream ended early
+			s.mu.Lock()
+			if ctx.Err() == nil {
+				delete(s.followed, containerID)
+			}
+			s.mu.Unlock()
+			cancel()
+		}()
+
+		info, err := cli.ContainerInspect(ctx, containerID)
+		if err != nil {
+			log.Printf("Log shipper: failed to inspect container %s: %v", name, err)
+			return
+		}
+
+		reader, err := cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Follow:     true,
+			Timestamps: true,
+			Since:      since.Format(time.RFC3339Nano),
+		})
+		if err != nil {
+			log.Printf("Log shipper: failed to follow logs for %s: %v", name, err)
+			return
+		}
+		defer reader.Close()
+
+		emit := func(stream, raw string) {
+			line := parseLogLine(containerID, name, stream, raw)
+			s.mu.Lock()
+			s.lastSeen[containerID] = line.Timestamp.Add(time.Nanosecond)
+			s.mu.Unlock()
+			s.lines.Add(line)
+		}
+
+		readLogStream(reader, info.Config != nil && info.Config.Tty, emit)
+	}()
+}
+
+// readLogStream splits a Docker log stream into lines. Containers with a TTY
+// send plain output (all of it stdout); the rest send a multiplexed stream.
+func readLogStream(reader io.Reader, tty bool, emit func(stream, raw string)) error {
+	if !tty {
+		readMultiplexed(reader, emit)
+		return nil
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		emit("stdout", scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// readMultiplexed splits Docker's multiplexed stream (8-byte frame headers)
+// into lines; a last line without a newline is emitted when the stream ends
+func readMultiplexed(reader io.Reader, emit func(stream, raw string)) {
+	header := make([]byte, 8)
+	partial := map[string]string{}
+	defer func() {
+		for _, stream := range []string{"stdout", "stderr"} {
+			if partial[stream] != "" {
+				emit(stream, partial[stream])
+			}
+		}
+	}()
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+
+		stream := "stdout"
+		if header[0] == 2 {
+			stream = "stderr"
+		}
+
+		frameSize := binary.BigEndian.Uint32(header[4:])
+		frame := make([]byte, frameSize)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return
+		}
+
+		data := partial[stream] + string(frame)
+		for {
+			idx := strings.IndexByte(data, '\n')
+			if idx < 0 {
+				break
+			}
+			emit(stream, data[:idx])
+			data = data[idx+1:]
+		}
+		partial[stream] = data
+	}
+}
+
+// parseLogLine splits the RFC3339 timestamp Docker prepends when Timestamps is set
+func parseLogLine(containerID, name, stream, raw string) protocol.LogLine {
+	line := protocol.LogLine{
+		ContainerID: containerID,
+		Name:        name,
+		Stream:      stream,
+		Message:     strings.TrimRight(raw, "\r"),
+		Timestamp:   time.Now().UTC(),
+	}
+	parts := strings.SplitN(line.Message, " ", 2)
+	if len(parts) == 2 {
+		if ts, err := time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+			line.Timestamp = ts
+			line.Message = parts[1]
+		}
+	}
+	return line
+}
@@ -2,18 +2,26 @@ package main
 
 import (
 	"bytes"
-	"context"
+	"compress/gzip"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	"github.com/joho/godotenv"
+
+	"dockscope/pki"
+	"dockscope/protocol"
 )
 
 func init() {
@@ -23,192 +31,272 @@ func init() {
 	}
 }
 
-
-
 var (
-	masterURL = os.Getenv("CENTRAL_SERVER_URL")
-	authToken = os.Getenv("AUTH_TOKEN")
-)
-type ContainerMetrics struct {
-	ID     string  `json:"id"`
-	Name   string  `json:"name"`
-	Image  string  `json:"image"`
-	CPU    float64 `json:"cpu"`
-	Memory float64 `json:"memory"`
-}
+	httpClient = &http.Client{Timeout: 30 * time.Second}
 
-type AgentPayload struct {
-	HostID     string             `json:"host_id"`
-	Containers []ContainerMetrics `json:"containers"`
-	Timestamp  string             `json:"timestamp"`
-}
+	// Collection interval in nanoseconds; the master may change it at runtime
+	collectInterval atomic.Int64
+)
 
 func main() {
-	hostID := os.Getenv("HOST_ID")
-	if hostID == "" {
-		hostID = getLocalIP() // fallback to public IP detection
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.path != "" {
+		log.Printf("Loaded configuration from %s", cfg.path)
 	}
-	serverURL := os.Getenv("CENTRAL_SERVER_URL")
+	agentCfg.Store(cfg)
+	collectInterval.Store(int64(cfg.Interval))
 
-	if serverURL == "" {
-		serverURL = masterURL
+	hostID, err := resolveHostID(cfg.HostID, cfg.StateFile)
+	if err != nil {
+		log.Fatalf("Failed to resolve host ID: %v", err)
 	}
 
-	go startLogServer()
+	// TLS material for mTLS with the master. The agent certificate's CN must be the host ID.
+	var tlsConfig *tls.Config
+	if cfg.TLS.CAFile != "" || cfg.TLS.CertFile != "" {
+		tlsConfig, err = pki.ClientConfig(cfg.TLS.CAFile, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
 
-	for {
-		payload := collectMetrics(hostID)
-		log.Printf("Collected %d containers from Host: %s", len(payload.Containers), hostID)
-		pushToServer(serverURL, payload)
-		time.Sleep(10 * time.Second)
+	activeFilter.Store(cfg.filter)
+	cfg.filter.logSummary()
+
+	go startLogServer(cfg)
+
+	// transport "websocket" keeps one persistent, multiplexed connection to the master
+	var shipper *logShipper
+	var runner *commandRunner
+	var alerts *alertEvaluator
+	var tr transport = newHTTPTransport(cfg)
+	streaming := cfg.Master.Transport == "websocket"
+	if streaming {
+		tr = newWSTransport(cfg.Master.WSURL, hostID, tlsConfig, func(cmd protocol.Command) {
+			handleCommand(cmd, shipper, runner)
+		}, func(set protocol.AlertRuleSet) {
+			if alerts != nil {
+				alerts.SetRules(set)
+			}
+		})
+	}
+
+	go register(tr, hostRegistration(hostID, cfg))
+
+	if cfg.Logs.Ship {
+		shipper = startLogShipper(hostID, tr, cfg.Logs.BatchSize, cfg.Logs.MaxPending)
+	}
+	if cfg.Alerts.Enabled {
+		alerts = startAlertEvaluator(hostID, tr, cfg)
+		if alerts != nil {
+			go alerts.pollRules(cfg.Master.AlertsURL)
+		}
+	}
+	startEventWatcher(hostID, tr, alerts)
+
+	runner = startCommandRunner(hostID, tr)
+	if runner != nil && !streaming {
+		go runner.pollLoop(cfg.Master.CommandsURL)
 	}
-}
 
-func collectMetrics(hostID string) AgentPayload {
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	outbox, err := newSpool(cfg.Spool.Dir, cfg.Spool.MaxFiles, func(batch []protocol.MetricsPayload) error {
+		return pushToServer(tr, hostID, batch)
+	})
 	if err != nil {
-		log.Fatalf("Failed to create Docker client: %v", err)
+		log.Fatalf("Failed to open spool: %v", err)
 	}
-	defer cli.Close()
+	outbox.SetBatch(cfg.Batch.MaxPayloads, cfg.Batch.MaxBytes, cfg.batchWait())
+	go outbox.Run()
+	status.watch(outbox, shipper, alerts)
 
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: false})
+	coll, err := newCollector(hostID, cfg)
 	if err != nil {
-		log.Printf("Failed to list containers: %v", err)
-		return AgentPayload{HostID: hostID}
+		log.Fatalf("Failed to start collector: %v", err)
 	}
 
-	var metrics []ContainerMetrics
-	for _, container := range containers {
-		stats, err := cli.ContainerStats(ctx, container.ID, false)
-		if err != nil {
-			log.Printf("Failed to get stats for container %s: %v", container.ID, err)
-			continue
+	// SIGHUP re-reads the config file and environment without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload(outbox, shipper)
 		}
+	}()
 
-		var containerStats types.StatsJSON
-		if err := json.NewDecoder(stats.Body).Decode(&containerStats); err != nil {
-			log.Printf("Failed to decode stats JSON for container %s: %v", container.ID, err)
-			stats.Body.Close()
-			continue
+	for {
+		started := time.Now()
+		payload := coll.Collect()
+		if alerts != nil {
+			alerts.CheckMetrics(payload.Containers)
+		}
+		payload.APIURL = currentConfig().API.URL
+		payload.Agent = status.Snapshot()
+		log.Printf("Collected %d containers from Host: %s in %.0fms (%d skipped)", len(payload.Containers), hostID, payload.CollectionMs, payload.Skipped)
+		if err := outbox.Enqueue(payload); err != nil {
+			log.Printf("Failed to spool payload: %v", err)
 		}
-		stats.Body.Close()
-
-		cpu := calculateCPUPercent(containerStats)
-		mem := float64(containerStats.MemoryStats.Usage) / (1024 * 1024)
-		name := strings.TrimPrefix(container.Names[0], "/")
-
-		log.Printf("Container: %s | CPU: %.2f%% | MEM: %.2fMB | IMAGE: %s", name, cpu, mem, container.Image)
 
-		metrics = append(metrics, ContainerMetrics{
-			ID:     container.ID,
-			Name:   name,
-			Image:  container.Image,
-			CPU:    cpu,
-			Memory: mem,
-		})
+		// Keep cycles on the interval regardless of how long collection took
+		interval := time.Duration(collectInterval.Load())
+		elapsed := time.Since(started)
+		if elapsed >= interval {
+			log.Printf("Collection took %s, longer than the %s interval", elapsed.Round(time.Millisecond), interval)
+			continue
+		}
+		time.Sleep(interval - elapsed)
 	}
+}
 
-	return AgentPayload{
-		HostID:     hostID,
-		Containers: metrics,
-		Timestamp:  time.Now().Format(time.RFC3339),
+// handleCommand applies a command pushed by the master over the WebSocket stream
+func handleCommand(cmd protocol.Command, shipper *logShipper, runner *commandRunner) {
+	if protocol.IsContainerAction(cmd.Action) {
+		if runner == nil {
+			log.Printf("Cannot run %s on %s: no Docker client", cmd.Action, cmd.ContainerID)
+			return
+		}
+		runner.Run(cmd)
+		return
 	}
-}
 
-func calculateCPUPercent(stats types.StatsJSON) float64 {
-	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage - stats.PreCPUStats.CPUUsage.TotalUsage)
-	systemDelta := float64(stats.CPUStats.SystemUsage - stats.PreCPUStats.SystemUsage)
-	if systemDelta > 0 && cpuDelta > 0 {
-		return (cpuDelta / systemDelta) * float64(len(stats.CPUStats.CPUUsage.PercpuUsage)) * 100.0
+	switch cmd.Action {
+	case protocol.CommandSetInterval:
+		if cmd.IntervalSeconds < 1 {
+			return
+		}
+		collectInterval.Store(int64(time.Duration(cmd.IntervalSeconds) * time.Second))
+		log.Printf("Master set collection interval to %ds", cmd.IntervalSeconds)
+	case protocol.CommandSendLogs:
+		if shipper == nil {
+			log.Printf("Master requested logs for %s but log shipping is disabled", cmd.ContainerID)
+			return
+		}
+		if err := shipper.SendRecent(cmd.ContainerID, cmd.Tail); err != nil {
+			log.Printf("Failed to send logs for %s: %v", cmd.ContainerID, err)
+		}
+	default:
+		log.Printf("Ignoring unknown command %q from master", cmd.Action)
 	}
-	return 0.0
 }
 
-func pushToServer(url string, payload AgentPayload) {
-	body, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal payload: %v", err)
-		return
+// pushToServer sends one payload as is and several as a single batch
+func pushToServer(tr transport, hostID string, batch []protocol.MetricsPayload) error {
+	started := time.Now()
+	var err error
+	if len(batch) == 1 || masterNoBatch.Load() {
+		err = pushEach(tr, batch)
+	} else {
+		err = tr.Send(protocol.TypeMetricsBatch, protocol.NewMetricsBatch(hostID, batch))
+		if errors.Is(err, errUnsupported) {
+			log.Printf("Master does not accept metrics batches, sending payloads one at a time")
+			masterNoBatch.Store(true)
+			err = pushEach(tr, batch)
+		}
 	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
-		log.Printf("Failed to create request: %v", err)
-		return
+		status.failed("push", err)
+		return err
 	}
+	status.pushed(time.Since(started))
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+authToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("Failed to send request: %v", err)
-		return
+	last := batch[len(batch)-1]
+	if len(batch) == 1 {
+		log.Printf("Sent metrics to master. Host: %s | Timestamp: %s", last.HostID, last.Timestamp)
+	} else {
+		log.Printf("Sent %d metrics payloads to master. Host: %s | Up to: %s", len(batch), last.HostID, last.Timestamp)
 	}
-	defer resp.Body.Close()
+	return nil
+}
 
-	respBody, _ := io.ReadAll(resp.Body)
-	log.Printf("Sent metrics to master. Host: %s | Response: %s", payload.HostID, string(respBody))
+// pushEach sends payloads one request at a time. On failure the whole batch
+// is resent later; the master stores a payload twice harmlessly.
+func pushEach(tr transport, batch []protocol.MetricsPayload) error {
+	for _, payload := range batch {
+		if err := tr.Send(protocol.TypeMetrics, payload); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// ============ LOG SERVER ============
+// masterNoBatch is set once the master turns out to predate metrics batches;
+// from then on the agent sends single payloads until it restarts
+var masterNoBatch atomic.Bool
 
-func startLogServer() {
-	http.HandleFunc("/logs", logHandler)
-	log.Println("Agent log API running on :8880")
-	log.Fatal(http.ListenAndServe(":8880", nil))
-}
+// masterGzip is set once the master advertises Accept-Encoding: gzip; until
+// then bodies go out uncompressed so older masters keep working
+var masterGzip atomic.Bool
 
-func logHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("Authorization") != "Bearer "+authToken {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+// postJSON sends v to the master and treats any non-200 answer as a failure
+func postJSON(url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
 	}
 
-	containerID := r.URL.Query().Get("id")
-	if containerID == "" {
-		http.Error(w, "Missing container ID", http.StatusBadRequest)
-		return
+	cfg := currentConfig()
+	compressed := cfg.Master.Compression == "gzip" && masterGzip.Load()
+	if compressed {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("compress payload: %w", err)
+		}
+		body = buf.Bytes()
 	}
 
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
-		http.Error(w, "Docker client error", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("create request: %w", err)
 	}
-	defer cli.Close()
 
-	reader, err := cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Tail:       "100",
-	})
-	if err != nil {
-		http.Error(w, "Failed to fetch logs: "+err.Error(), http.StatusInternalServerError)
-		return
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.Master.Token)
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
 	}
-	defer reader.Close()
 
-	w.Header().Set("Content-Type", "text/plain")
-	io.Copy(w, reader)
-}
-
-// ============ UTILS ============
-
-func getLocalIP() string {
-	resp, err := http.Get("http://checkip.amazonaws.com")
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Println("Could not fetch public IP, using fallback.")
-		return "default-host"
+		return fmt.Errorf("send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	ip, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "default-host"
+	if strings.Contains(resp.Header.Get("Accept-Encoding"), "gzip") {
+		masterGzip.Store(true)
+	} else if resp.StatusCode == http.StatusUnsupportedMediaType {
+		masterGzip.Store(false) // resent uncompressed on the next attempt
 	}
-	return strings.TrimSpace(string(ip))
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("master returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %w", errUnsupported, err)
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+			// 401 and 403 are left to retry: a rotated or not yet issued
+			// token refuses every payload until it is fixed
+			return &rejectedError{status: resp.StatusCode, err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// rejectedError is a response the master gives again however often the same
+// payload is resent, so retrying it would only hold up everything behind it
+type rejectedError struct {
+	status int // HTTP status, 0 for a rejection acked over the websocket
+	err    error
 }
 
+func (e *rejectedError) Error() string { return e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dockscope/protocol"
+)
+
+const (
+	rejectedDir          = "rejected" // under the spool dir, for payloads the master refuses
+	rejectedMaxFiles     = 100        // oldest rejected payloads beyond this are dropped
+	defaultSpoolDir      = "spool"
+	defaultSpoolMaxFiles = 8640 // 24h of payloads at the 10s interval
+	minReplayBackoff     = 1 * time.Second
+	maxReplayBackoff     = 5 * time.Minute
+)
+
+// spool is a bounded on-disk outbox. Every payload is written to its own
+// segment file named after its sequence number and replayed to the master in
+// order, so metrics collected during a master outage are backfilled later.
+type spool struct {
+	dir      string
+	maxFiles int
+	send     func([]protocol.MetricsPayload) error
+
+	// Batching: up to maxBatch payloads and maxBatchBytes of JSON per send,
+	// waiting at most batchWait for a batch to fill
+	maxBatch      int
+	maxBatchBytes int
+	batchWait     time.Duration
+
+	mu      sync.Mutex
+	nextSeq uint64
+	wake    chan struct{}
+}
+
+func newSpool(dir string, maxFiles int, send func([]protocol.MetricsPayload) error) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create spool dir: %w", err)
+	}
+
+	s := &spool{
+		dir:      dir,
+		maxFiles: maxFiles,
+		send:     send,
+		maxBatch: 1,
+		nextSeq:  1,
+		wake:     make(chan struct{}, 1),
+	}
+
+	// Leftovers from a crash mid-write are never complete payloads
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		s.nextSeq = segments[len(segments)-1] + 1
+		log.Printf("Spool: %d payloads pending from previous run", len(segments))
+	}
+	return s, nil
+}
+
+// SetBatch changes how many payloads are sent per request
+func (s *spool) SetBatch(maxPayloads, maxBytes int, wait time.Duration) {
+	s.mu.Lock()
+	s.maxBatch, s.maxBatchBytes, s.batchWait = maxPayloads, maxBytes, wait
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetMaxFiles changes the spool bound; the excess is dropped on the next enqueue
+func (s *spool) SetMaxFiles(n int) {
+	s.mu.Lock()
+	s.maxFiles = n
+	s.mu.Unlock()
+}
+
+// Enqueue persists a payload and wakes the replay loop
+func (s *spool) Enqueue(payload protocol.MetricsPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	seq := s.nextSeq
+	s.nextSeq++
+	s.mu.Unlock()
+
+	// Write to a temp file first so a crash never leaves a half-written segment
+	tmp := filepath.Join(s.dir, fmt.Sprintf("%020d.tmp", seq))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path(seq)); err != nil {
+		return err
+	}
+
+	s.trim()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Depth returns the number of payloads waiting to be delivered
+func (s *spool) Depth() int {
+	segments, _ := s.segments()
+	return len(segments)
+}
+
+// Run replays spooled payloads in order, backing off exponentially while the master is unreachable
+func (s *spool) Run() {
+	backoff := minReplayBackoff
+	for {
+		wait, err := s.drain()
+		if err != nil {
+			log.Printf("Spool: master unreachable (%v), retrying in %s (%d pending)", err, backoff, s.Depth())
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxReplayBackoff {
+				backoff = maxReplayBackoff
+			}
+			continue
+		}
+		backoff = minReplayBackoff
+		if wait <= 0 {
+			<-s.wake
+			continue
+		}
+		select {
+		case <-s.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// drain sends spooled payloads in batches of up to maxBatch payloads and
+// maxBatchBytes of JSON. A partial batch is held back until its oldest
+// payload is batchWait old; drain then returns how long is left to wait.
+func (s *spool) drain() (time.Duration, error) {
+	for {
+		segments, err := s.segments()
+		if err != nil {
+			return 0, err
+		}
+		if len(segments) == 0 {
+			return 0, nil
+		}
+
+		s.mu.Lock()
+		maxBatch, maxBytes, wait := s.maxBatch, s.maxBatchBytes, s.batchWait
+		s.mu.Unlock()
+
+		if len(segments) < maxBatch {
+			if info, err := os.Stat(s.path(segments[0])); err == nil {
+				if age := time.Since(info.ModTime()); age < wait {
+					return wait - age, nil
+				}
+			}
+		}
+
+		var batch []protocol.MetricsPayload
+		var sent []uint64
+		size := 0
+		for _, seq := range segments {
+			if len(batch) == maxBatch {
+				break
+			}
+			data, err := os.ReadFile(s.path(seq))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue // trimmed while we were sending
+				}
+				return 0, err
+			}
+			if len(batch) > 0 && size+len(data) > maxBytes {
+				break
+			}
+
+			var payload protocol.MetricsPayload
+			if err := json.Unmarshal(data, &payload); err != nil {
+				log.Printf("Spool: dropping corrupt segment %d: %v", seq, err)
+				os.Remove(s.path(seq))
+				continue
+			}
+			batch = append(batch, payload)
+			sent = append(sent, seq)
+			size += len(data)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		err = s.send(batch)
+		var rejected *rejectedError
+		if errors.As(err, &rejected) && len(batch) > 1 {
+			// Resend one by one so only the payloads at fault are set aside
+			for i, payload := range batch {
+				err := s.send([]protocol.MetricsPayload{payload})
+				if errors.As(err, &rejected) {
+					s.reject(sent[i], err)
+					continue
+				}
+				if err != nil {
+					return 0, err
+				}
+				os.Remove(s.path(sent[i]))
+			}
+			continue
+		}
+		if rejected != nil {
+			s.reject(sent[0], err)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, seq := range sent {
+			os.Remove(s.path(seq))
+		}
+	}
+}
+
+// reject moves a segment the master refused into the rejected directory,
+// where the latest rejectedMaxFiles are kept for inspection but never resent
+func (s *spool) reject(seq uint64, err error) {
+	dir := filepath.Join(s.dir, rejectedDir)
+	if mkErr := os.MkdirAll(dir, 0755); mkErr != nil {
+		log.Printf("Spool: dropping rejected segment %d (%v): %v", seq, err, mkErr)
+		os.Remove(s.path(seq))
+		return
+	}
+	log.Printf("Spool: master rejected segment %d (%v), moving it to %s", seq, err, dir)
+	if mvErr := os.Rename(s.path(seq), filepath.Join(dir, filepath.Base(s.path(seq)))); mvErr != nil {
+		os.Remove(s.path(seq))
+	}
+
+	// Names sort by sequence, so the oldest come first
+	kept, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if over := len(kept) - rejectedMaxFiles; over > 0 {
+		sort.Strings(kept)
+		for _, old := range kept[:over] {
+			os.Remove(old)
+		}
+	}
+}
+
+// trim drops the oldest segments once the spool exceeds its bound
+func (s *spool) trim() {
+	segments, err := s.segments()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	over := len(segments) - s.maxFiles
+	s.mu.Unlock()
+	if over <= 0 {
+		return
+	}
+	log.Printf("Spool full, dropping %d oldest payloads", over)
+	for _, seq := range segments[:over] {
+		os.Remove(s.path(seq))
+	}
+}
+
+func (s *spool) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.json", seq))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dockscope/protocol"
+)
+
+// recordingSpool returns a spool whose sends are recorded as batches of
+// timestamps
+func recordingSpool(t *testing.T, send func([]protocol.MetricsPayload) error) (*spool, *[][]string) {
+	t.Helper()
+	var sent [][]string
+	s, err := newSpool(t.TempDir(), 100, func(batch []protocol.MetricsPayload) error {
+		if send != nil {
+			if err := send(batch); err != nil {
+				return err
+			}
+		}
+		var ts []string
+		for _, p := range batch {
+			ts = append(ts, p.Timestamp)
+		}
+		sent = append(sent, ts)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, &sent
+}
+
+func enqueue(t *testing.T, s *spool, n int) int {
+	t.Helper()
+	size := 0
+	for i := 0; i < n; i++ {
+		p := protocol.MetricsPayload{Version: protocol.Version, HostID: "h1", Timestamp: fmt.Sprintf("t%d", i)}
+		if err := s.Enqueue(p); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(p)
+		size = len(data)
+	}
+	return size
+}
+
+func TestSpoolDrainMaxBatch(t *testing.T) {
+	s, sent := recordingSpool(t, nil)
+	s.SetBatch(3, 1<<20, 0)
+	enqueue(t, s, 7)
+
+	if _, err := s.drain(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"t0", "t1", "t2"}, {"t3", "t4", "t5"}, {"t6"}}
+	if fmt.Sprint(*sent) != fmt.Sprint(want) {
+		t.Errorf("batches = %v, want %v", *sent, want)
+	}
+	if d := s.Depth(); d != 0 {
+		t.Errorf("depth = %d after drain, want 0", d)
+	}
+}
+
+func TestSpoolDrainMaxBatchBytes(t *testing.T) {
+	s, sent := recordingSpool(t, nil)
+	size := enqueue(t, s, 5)
+	s.SetBatch(10, 2*size, 0) // room for two payloads per batch
+
+	if _, err := s.drain(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"t0", "t1"}, {"t2", "t3"}, {"t4"}}
+	if fmt.Sprint(*sent) != fmt.Sprint(want) {
+		t.Errorf("batches = %v, want %v", *sent, want)
+	}
+}
+
+func TestSpoolDrainSendsOversizedPayloadAlone(t *testing.T) {
+	s, sent := recordingSpool(t, nil)
+	enqueue(t, s, 2)
+	s.SetBatch(10, 1, 0) // every payload is over the limit
+
+	if _, err := s.drain(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"t0"}, {"t1"}}
+	if fmt.Sprint(*sent) != fmt.Sprint(want) {
+		t.Errorf("batches = %v, want %v", *sent, want)
+	}
+}
+
+func TestSpoolDrainHoldsPartialBatch(t *testing.T) {
+	s, sent := recordingSpool(t, nil)
+	s.SetBatch(5, 1<<20, time.Hour)
+	enqueue(t, s, 2)
+
+	wait, err := s.drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 0 {
+		t.Errorf("sent %v before the batch filled or aged", *sent)
+	}
+	if wait <= 0 || wait > time.Hour {
+		t.Errorf("wait = %s, want up to an hour", wait)
+	}
+}
+
+func TestSpoolDrainKeepsPayloadsOnFailure(t *testing.T) {
+	down := errors.New("connection refused")
+	s, _ := recordingSpool(t, func([]protocol.MetricsPayload) error { return down })
+	s.SetBatch(3, 1<<20, 0)
+	enqueue(t, s, 4)
+
+	if _, err := s.drain(); !errors.Is(err, down) {
+		t.Fatalf("drain error = %v, want %v", err, down)
+	}
+	if d := s.Depth(); d != 4 {
+		t.Errorf("depth = %d, want 4", d)
+	}
+}
+
+func TestSpoolDrainSetsRejectedPayloadsAside(t *testing.T) {
+	s, sent := recordingSpool(t, func(batch []protocol.MetricsPayload) error {
+		for _, p := range batch {
+			if p.Timestamp == "t1" {
+				return &rejectedError{status: 400, err: errors.New("master returned 400")}
+			}
+		}
+		return nil
+	})
+	s.SetBatch(3, 1<<20, 0)
+	enqueue(t, s, 3)
+
+	if _, err := s.drain(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"t0"}, {"t2"}}
+	if fmt.Sprint(*sent) != fmt.Sprint(want) {
+		t.Errorf("batches = %v, want %v", *sent, want)
+	}
+	rejected, _ := os.ReadDir(filepath.Join(s.dir, rejectedDir))
+	if len(rejected) != 1 {
+		t.Errorf("%d rejected segments, want 1", len(rejected))
+	}
+	if d := s.Depth(); d != 0 {
+		t.Errorf("depth = %d after drain, want 0", d)
+	}
+}
+
+func TestSpoolDrainRetriesUnauthorized(t *testing.T) {
+	unauthorized := errors.New("master returned 401: invalid token")
+	s, _ := recordingSpool(t, func([]protocol.MetricsPayload) error { return unauthorized })
+	s.SetBatch(3, 1<<20, 0)
+	enqueue(t, s, 4)
+
+	if _, err := s.drain(); !errors.Is(err, unauthorized) {
+		t.Fatalf("drain error = %v, want %v", err, unauthorized)
+	}
+	if d := s.Depth(); d != 4 {
+		t.Errorf("depth = %d, want 4", d)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, rejectedDir)); !os.IsNotExist(err) {
+		t.Errorf("rejected dir exists (%v), want nothing set aside", err)
+	}
+}
+
+func TestSpoolRejectKeepsLatest(t *testing.T) {
+	s, _ := recordingSpool(t, func([]protocol.MetricsPayload) error {
+		return &rejectedError{status: 400, err: errors.New("master returned 400")}
+	})
+	for i := 0; i < 2; i++ {
+		enqueue(t, s, 60)
+		if _, err := s.drain(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rejected, _ := os.ReadDir(filepath.Join(s.dir, rejectedDir))
+	if len(rejected) != rejectedMaxFiles {
+		t.Fatalf("%d rejected segments, want %d", len(rejected), rejectedMaxFiles)
+	}
+	if first := rejected[0].Name(); first != filepath.Base(s.path(21)) {
+		t.Errorf("oldest kept = %s, want segment 21", first)
+	}
+}
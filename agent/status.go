@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"dockscope/protocol"
+)
+
+// agentStatus tracks the agent's own health for /healthz, /status and the
+// telemetry attached to each payload
+type agentStatus struct {
+	mu          sync.Mutex
+	started     time.Time
+	lastCollect time.Time
+	lastPush    time.Time
+	lastError   string
+	lastErrorAt time.Time
+	pushLatency time.Duration
+	containers  int
+
+	outbox  *spool
+	shipper *logShipper
+	alerts  *alertEvaluator
+}
+
+var status = &agentStatus{started: time.Now().UTC()}
+
+// watch sets the buffers whose depth is reported and the alert evaluator
+// whose rule revision is
+func (s *agentStatus) watch(outbox *spool, shipper *logShipper, alerts *alertEvaluator) {
+	s.mu.Lock()
+	s.outbox, s.shipper, s.alerts = outbox, shipper, alerts
+	s.mu.Unlock()
+}
+
+func (s *agentStatus) collected(containers int) {
+	s.mu.Lock()
+	s.lastCollect = time.Now().UTC()
+	s.containers = containers
+	s.mu.Unlock()
+}
+
+func (s *agentStatus) pushed(latency time.Duration) {
+	s.mu.Lock()
+	s.lastPush = time.Now().UTC()
+	s.pushLatency = latency
+	s.mu.Unlock()
+}
+
+// failed records the latest error; source says which part of the agent hit it
+func (s *agentStatus) failed(source string, err error) {
+	s.mu.Lock()
+	s.lastError = fmt.Sprintf("%s: %v", source, err)
+	s.lastErrorAt = time.Now().UTC()
+	s.mu.Unlock()
+}
+
+func (s *agentStatus) Snapshot() *protocol.AgentStatus {
+	s.mu.Lock()
+	snap := &protocol.AgentStatus{
+		AgentVersion:      agentVersion,
+		StartedAt:         s.started,
+		UptimeSeconds:     int64(time.Since(s.started).Seconds()),
+		LastCollect:       timePtr(s.lastCollect),
+		LastPush:          timePtr(s.lastPush),
+		LastError:         s.lastError,
+		LastErrorAt:       timePtr(s.lastErrorAt),
+		PushLatencyMs:     float64(s.pushLatency.Microseconds()) / 1000,
+		ContainersWatched: s.containers,
+	}
+	outbox, shipper, alerts := s.outbox, s.shipper, s.alerts
+	s.mu.Unlock()
+
+	if outbox != nil {
+		snap.SpoolDepth = outbox.Depth()
+	}
+	if shipper != nil {
+		snap.PendingLogs = shipper.lines.Pending()
+	}
+	if alerts != nil {
+		snap.AlertRulesRevision = alerts.Revision()
+	}
+	return snap
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// health reports "ok", "degraded" (collecting, but the master is not accepting
+// pushes) or "unhealthy" (no successful collection for three intervals)
+func (s *agentStatus) health() (string, []string) {
+	grace := 3 * time.Duration(collectInterval.Load())
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var problems []string
+	state := "ok"
+	if now.Sub(s.started) > grace {
+		if s.lastCollect.IsZero() || now.Sub(s.lastCollect) > grace {
+			state = "unhealthy"
+			problems = append(problems, "no successful collection in "+grace.String())
+		}
+		if s.lastPush.IsZero() || now.Sub(s.lastPush) > grace {
+			if state == "ok" {
+				state = "degraded"
+			}
+			problems = append(problems, "no payload accepted by the master in "+grace.String())
+		}
+	}
+	if len(problems) > 0 && s.lastError != "" {
+		problems = append(problems, "last error: "+s.lastError)
+	}
+	return state, problems
+}
+
+// healthzHandler is meant for liveness probes: 503 only when collection has
+// stopped, so an unreachable master does not get the agent restarted
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	state, problems := status.health()
+	w.Header().Set("Content-Type", "application/json")
+	if state == "unhealthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": state, "problems": problems})
+}
+
+// statusHandler returns the full self-telemetry
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status.Snapshot())
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"dockscope/protocol"
+)
+
+const (
+	wsAckTimeout   = 30 * time.Second
+	wsReadTimeout  = 90 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	wsMaxBackoff   = time.Minute
+)
+
+var (
+	errNotConnected = errors.New("not connected to master")
+
+	// errUnsupported is returned for a message type the master does not know
+	errUnsupported = errors.New("not supported by master")
+)
+
+// transport delivers a payload of the given protocol message type to the
+// master and returns only once the master has accepted it
+type transport interface {
+	Send(msgType string, payload any) error
+}
+
+// httpTransport POSTs each payload to its own master endpoint
+type httpTransport struct {
+	urls map[string]string
+}
+
+func newHTTPTransport(cfg *agentConfig) *httpTransport {
+	return &httpTransport{urls: map[string]string{
+		protocol.TypeMetrics: cfg.Master.URL,
+		protocol.TypeLogs:    cfg.Master.LogsURL,
+		protocol.TypeEvents:  cfg.Master.EventsURL,
+
+		protocol.TypeCommandResult: cfg.Master.CommandsURL + "/result",
+		protocol.TypeRegister:      cfg.Master.RegisterURL,
+		protocol.TypeMetricsBatch:  cfg.Master.BatchURL,
+		protocol.TypeAlerts:        cfg.Master.AlertsURL,
+	}}
+}
+
+func (t *httpTransport) Send(msgType string, payload any) error {
+	url, ok := t.urls[msgType]
+	if !ok {
+		return fmt.Errorf("no endpoint for %s", msgType)
+	}
+	return postJSON(url, payload)
+}
+
+// wsTransport keeps one WebSocket to the master with every message type
+// multiplexed over it. Each message waits for the master's ack; anything not
+// acked stays in the spool or batcher and is resent after reconnecting.
+type wsTransport struct {
+	url       string
+	hostID    string
+	dialer    *websocket.Dialer
+	onCommand func(protocol.Command)
+	onRules   func(protocol.AlertRuleSet)
+
+	seq     atomic.Uint64
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	waiters map[uint64]chan error
+}
+
+func newWSTransport(wsURL, hostID string, tlsConfig *tls.Config, onCommand func(protocol.Command), onRules func(protocol.AlertRuleSet)) *wsTransport {
+	wsURL = strings.Replace(wsURL, "https://", "wss://", 1)
+	wsURL = strings.Replace(wsURL, "http://", "ws://", 1)
+
+	t := &wsTransport{
+		url:       wsURL + "?host_id=" + url.QueryEscape(hostID),
+		hostID:    hostID,
+		dialer:    &websocket.Dialer{HandshakeTimeout: 10 * time.Second, TLSClientConfig: tlsConfig},
+		onCommand: onCommand,
+		onRules:   onRules,
+		waiters:   make(map[uint64]chan error),
+	}
+	go t.run()
+	return t
+}
+
+// run keeps the connection open, reconnecting with exponential backoff
+func (t *wsTransport) run() {
+	backoff := time.Second
+	for {
+		cfg := currentConfig()
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+cfg.Master.Token)
+		t.dialer.EnableCompression = cfg.Master.Compression == "gzip" // permessage-deflate
+
+		conn, resp, err := t.dialer.Dial(t.url, header)
+		if err != nil {
+			if resp != nil {
+				err = fmt.Errorf("%w (HTTP %d)", err, resp.StatusCode)
+			}
+			log.Printf("Master stream: connect failed: %v (retrying in %s)", err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > wsMaxBackoff {
+				backoff = wsMaxBackoff
+			}
+			continue
+		}
+
+		backoff = time.Second
+		log.Printf("Master stream: connected to %s", t.url)
+		t.serve(conn)
+		log.Printf("Master stream: disconnected, reconnecting")
+	}
+}
+
+func (t *wsTransport) serve(conn *websocket.Conn) {
+	defer conn.Close()
+
+	hello, _ := protocol.NewEnvelope(protocol.TypeHello, 0, protocol.Hello{
+		Version: protocol.Version,
+		HostID:  t.hostID,
+	})
+	if err := t.write(conn, hello); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		t.conn = nil
+		for seq, ch := range t.waiters {
+			ch <- errNotConnected
+			delete(t.waiters, seq)
+		}
+		t.mu.Unlock()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		t.writeMu.Lock()
+		defer t.writeMu.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsWriteTimeout))
+	})
+
+	for {
+		var env protocol.Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+
+		switch env.Type {
+		case protocol.TypeAck:
+			var ack protocol.Ack
+			if err := json.Unmarshal(env.Payload, &ack); err != nil {
+				continue
+			}
+			t.mu.Lock()
+			if ch, ok := t.waiters[ack.Seq]; ok {
+				if strings.HasPrefix(ack.Error, "unknown message type") {
+					ch <- fmt.Errorf("%w: %s", errUnsupported, ack.Error)
+				} else if ack.Rejected {
+					ch <- &rejectedError{err: fmt.Errorf("master rejected message: %s", ack.Error)}
+				} else if ack.Error != "" {
+					ch <- errors.New(ack.Error)
+				} else {
+					ch <- nil
+				}
+				delete(t.waiters, ack.Seq)
+			}
+			t.mu.Unlock()
+
+		case protocol.TypeCommand:
+			var cmd protocol.Command
+			if err := json.Unmarshal(env.Payload, &cmd); err != nil {
+				log.Printf("Master stream: invalid command: %v", err)
+				continue
+			}
+			if t.onCommand != nil {
+				go t.onCommand(cmd)
+			}
+
+		case protocol.TypeAlertRules:
+			var set protocol.AlertRuleSet
+			if err := json.Unmarshal(env.Payload, &set); err != nil {
+				log.Printf("Master stream: invalid alert rules: %v", err)
+				continue
+			}
+			if t.onRules != nil {
+				go t.onRules(set)
+			}
+		}
+	}
+}
+
+func (t *wsTransport) write(conn *websocket.Conn, env protocol.Envelope) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(env)
+}
+
+func (t *wsTransport) Send(msgType string, payload any) error {
+	seq := t.seq.Add(1)
+	env, err := protocol.NewEnvelope(msgType, seq, payload)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan error, 1)
+	t.mu.Lock()
+	conn := t.conn
+	if conn == nil {
+		t.mu.Unlock()
+		return errNotConnected
+	}
+	t.waiters[seq] = ch
+	t.mu.Unlock()
+
+	if err := t.write(conn, env); err != nil {
+		t.mu.Lock()
+		delete(t.waiters, seq)
+		t.mu.Unlock()
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(wsAckTimeout):
+		t.mu.Lock()
+		delete(t.waiters, seq)
+		t.mu.Unlock()
+		return fmt.Errorf("no ack for %s message %d", msgType, seq)
+	}
+}
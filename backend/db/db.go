@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"log"
 	"os"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -39,5 +40,128 @@ func InitDB() {
 	if err != nil {
 		log.Fatalf("Failed to create table: %v", err)
 	}
-}
 
+	// Container lifecycle timeline (Docker events from master and agents)
+	eventsStmt := `
+	CREATE TABLE IF NOT EXISTS container_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		host_id TEXT NOT NULL,
+		container_id TEXT NOT NULL,
+		name TEXT,
+		image TEXT,
+		action TEXT NOT NULL,
+		status TEXT,
+		exit_code TEXT,
+		timestamp DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_container_events_host_container
+		ON container_events(host_id, container_id, timestamp);
+	`
+	_, err = DB.Exec(eventsStmt)
+	if err != nil {
+		log.Fatalf("Failed to create events table: %v", err)
+	}
+
+	// Remote container actions queued for agents, with their audit trail
+	commandsStmt := `
+	CREATE TABLE IF NOT EXISTS container_commands (
+		id TEXT PRIMARY KEY,
+		host_id TEXT NOT NULL,
+		container_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		status TEXT NOT NULL,
+		requested_by TEXT,
+		error TEXT,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_container_commands_host_status
+		ON container_commands(host_id, status);
+	CREATE TABLE IF NOT EXISTS container_command_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		command_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		message TEXT,
+		timestamp DATETIME NOT NULL
+	);
+	`
+	_, err = DB.Exec(commandsStmt)
+	if err != nil {
+		log.Fatalf("Failed to create commands tables: %v", err)
+	}
+
+	// Host inventory, keyed by the agent's stable host ID
+	hostsStmt := `
+	CREATE TABLE IF NOT EXISTS hosts (
+		host_id TEXT PRIMARY KEY,
+		hostname TEXT,
+		os TEXT,
+		kernel TEXT,
+		arch TEXT,
+		docker_version TEXT,
+		cpus INTEGER,
+		memory_bytes INTEGER,
+		agent_version TEXT,
+		remote_addr TEXT,
+		registered_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	`
+	_, err = DB.Exec(hostsStmt)
+	if err != nil {
+		log.Fatalf("Failed to create hosts table: %v", err)
+	}
+
+	// Alert history: firing and resolved transitions, from the master's
+	// engine and from agents (agent_alert_id deduplicates agent retries)
+	alertEventsStmt := `
+	CREATE TABLE IF NOT EXISTS alert_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		agent_alert_id TEXT,
+		rule_id TEXT NOT NULL,
+		host_id TEXT,
+		container_id TEXT,
+		type TEXT,
+		state TEXT,
+		message TEXT,
+		source TEXT,
+		agent_notified INTEGER NOT NULL DEFAULT 0,
+		timestamp DATETIME NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_alert_events_agent_alert_id
+		ON alert_events(agent_alert_id);
+	CREATE INDEX IF NOT EXISTS idx_alert_events_timestamp
+		ON alert_events(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_alert_events_host_container
+		ON alert_events(host_id, container_id, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_alert_events_rule
+		ON alert_events(rule_id, timestamp);
+	`
+	_, err = DB.Exec(alertEventsStmt)
+	if err != nil {
+		log.Fatalf("Failed to create alert events table: %v", err)
+	}
+
+	// Heartbeats: the last time each host's agent reported in
+	_, err = DB.Exec(`ALTER TABLE hosts ADD COLUMN last_seen DATETIME`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		log.Fatalf("Failed to migrate hosts table: %v", err)
+	}
+
+	// Agent API addresses, so the master can proxy to agents after a restart
+	_, err = DB.Exec(`ALTER TABLE hosts ADD COLUMN api_url TEXT`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		log.Fatalf("Failed to migrate hosts table: %v", err)
+	}
+
+	// Silences: alerts a silence muted are kept, marked suppressed
+	for _, stmt := range []string{
+		`ALTER TABLE alert_events ADD COLUMN suppressed INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE alert_events ADD COLUMN silence_id TEXT`,
+	} {
+		_, err = DB.Exec(stmt)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			log.Fatalf("Failed to migrate alert events table: %v", err)
+		}
+	}
+}
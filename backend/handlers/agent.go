@@ -1,44 +1,225 @@
 package handlers
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"fmt"
+	"strings"
 	"time"
+
+	"dockscope/backend/logstore"
+	"dockscope/protocol"
 )
 
 // ReceiveAgentMetricsHandler stores metrics data received from agents
 func ReceiveAgentMetricsHandler(w http.ResponseWriter, r *http.Request) {
-	var payload AgentPayload
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	payload, err := protocol.DecodeMetricsPayload(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := authenticateAgent(r, payload.HostID); err != nil {
+		rejectAgent(w, r, payload.HostID, err)
 		return
 	}
 
 	PrintAgentMetricsLog(r, payload.HostID, len(payload.Containers))
+	rememberAgentAPI(r, payload.HostID, payload.APIURL)
+	touchHost(payload.HostID, r.RemoteAddr)
+
+	// Ask the agent to keep the payload in its spool and retry later
+	if err := storeAgentMetrics(payload); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
-	// ✅ Keep for alerts to work
-	agentMetrics[payload.HostID] = payload.Containers
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// ReceiveAgentMetricsBatchHandler stores several collection cycles sent in one request
+func ReceiveAgentMetricsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	batch, skipped, err := protocol.DecodeMetricsBatch(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := authenticateAgent(r, batch.HostID); err != nil {
+		rejectAgent(w, r, batch.HostID, err)
+		return
+	}
+	logSkippedPayloads(batch.HostID, skipped)
 
+	// The agent resends the whole batch on failure; storing a payload twice is harmless
+	if err := storeAgentMetricsBatch(r, batch); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func storeAgentMetricsBatch(r *http.Request, batch protocol.MetricsBatch) error {
+	last := batch.Payloads[len(batch.Payloads)-1]
+	log.Printf("%s[Agent Metrics]%s Host %s sent a batch of %d payloads", ColorCyan, ColorReset, batch.HostID, len(batch.Payloads))
+	rememberAgentAPI(r, batch.HostID, last.APIURL)
+	touchHost(batch.HostID, r.RemoteAddr)
+
+	failed := 0
+	for _, payload := range batch.Payloads {
+		if err := storeAgentMetrics(payload); err != nil {
+			log.Printf("❌ %v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to store %d of %d payloads for host %s", failed, len(batch.Payloads), batch.HostID)
+	}
+	return nil
+}
+
+// logSkippedPayloads reports the payloads of a batch that failed to decode;
+// the rest of the batch is stored
+func logSkippedPayloads(hostID string, skipped []error) {
+	for _, err := range skipped {
+		log.Printf("%s[Agent Metrics]%s Host %s: skipping %v", ColorYellow, ColorReset, hostID, err)
+	}
+}
+
+// storeAgentMetrics updates the live snapshot and writes the samples to InfluxDB
+func storeAgentMetrics(payload AgentPayload) error {
+	// Agents replay spooled payloads after an outage, so keep the collection time
+	ts := payload.Time()
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+
+	// ✅ Keep for alerts to work; backfilled payloads must not replace a newer snapshot
+	alertsMutex.Lock()
+	latest := ts.After(agentMetricsUpdated[payload.HostID])
+	if latest {
+		containers := make([]ContainerMetrics, 0, len(payload.Containers))
+		for _, c := range payload.Containers {
+			containers = append(containers, ContainerMetrics{
+				ID:            c.ID,
+				Name:          c.Name,
+				Image:         c.Image,
+				CPUPercent:    c.CPUPercent,
+				MemoryMB:      c.MemoryMB,
+				MemoryPercent: c.MemoryPercent,
+				MemoryLimitMB: c.MemoryLimitMB,
+				Uptime:        (time.Duration(c.UptimeSeconds) * time.Second).String(),
+				RestartCount:  c.RestartCount,
+				NetRx:         c.NetRxBytes,
+				NetTx:         c.NetTxBytes,
+				DiskRead:      c.DiskReadBytes,
+				DiskWrite:     c.DiskWriteBytes,
+				PIDs:          c.PIDs,
+				Health:        c.Health,
+				Group:         c.Group,
+				Labels:        c.Labels,
+				HostID:        payload.HostID,
+			})
+		}
+		agentMetrics[payload.HostID] = containers
+		agentMetricsUpdated[payload.HostID] = ts
+	}
+	alertsMutex.Unlock()
+
+	if latest && payload.Agent != nil {
+		recordAgentStatus(payload.HostID, payload.Agent)
+	}
+
+	failed := 0
 	for _, c := range payload.Containers {
-		err := WriteMetricToInflux(
-			payload.HostID,
-			c.ID,
-			c.Name,
-			c.Image,
-			c.CPUPercent,
-			c.MemoryMB,
-			c.RestartCount,
-			time.Now(),
-		)
+		sampled := ts
+		if !c.Timestamp.IsZero() {
+			sampled = c.Timestamp
+		}
+		err := WriteAgentMetricToInflux(payload.HostID, c, sampled)
 		if err != nil {
 			log.Printf("❌ Failed to write to InfluxDB for container %s: %v", c.ID, err)
-			fmt.Fprintln(w, "Log handler not yet implemented")
+			failed++
 		}
 	}
 
+	if payload.Host != nil {
+		if err := WriteHostMetricsToInflux(payload.HostID, payload.Host, ts); err != nil {
+			failed++
+		}
+	}
+
+	if payload.CollectionMs > 0 {
+		log.Printf("%s[Agent Metrics]%s Host %s collected %d containers in %.0fms (%d skipped)",
+			ColorCyan, ColorReset, payload.HostID, len(payload.Containers), payload.CollectionMs, payload.Skipped)
+		WriteAgentCollectionToInflux(payload.HostID, payload.CollectionMs, len(payload.Containers), payload.Skipped, ts)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to store %d metric points for host %s", failed, payload.HostID)
+	}
+	return nil
+}
+
+// ReceiveAgentLogsHandler stores batched container log lines pushed by agents
+func ReceiveAgentLogsHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := protocol.DecodeLogPayload(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := authenticateAgent(r, payload.HostID); err != nil {
+		rejectAgent(w, r, payload.HostID, err)
+		return
+	}
+
+	storeAgentLogs(payload)
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
 
+// storeAgentLogs persists shipped log lines to the log store and InfluxDB
+func storeAgentLogs(payload AgentLogPayload) {
+	log.Printf("%s[Agent Logs]%s Host: %s | Lines: %d", ColorCyan, ColorReset, payload.HostID, len(payload.Lines))
+
+	failed := 0
+	for _, line := range payload.Lines {
+		ts := line.Timestamp
+		if ts.IsZero() {
+			ts = time.Now().UTC()
+		}
+		level := detectLogLevel(line.Stream, line.Message)
+
+		logstore.SaveAgentLog(payload.HostID, line.ContainerID, level, line.Message, ts)
+		if err := WriteLogToInflux(payload.HostID, line.ContainerID, level, line.Message, ts); err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("❌ Failed to write %d/%d log lines to InfluxDB for host %s", failed, len(payload.Lines), payload.HostID)
+	}
+
+	checkAgentLogRules(payload.HostID, payload.Lines)
+}
+
+// detectLogLevel guesses a log level from the line content, falling back to the stream
+func detectLogLevel(stream, message string) string {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "fatal"), strings.Contains(lower, "panic"), strings.Contains(lower, "error"):
+		return "error"
+	case strings.Contains(lower, "warn"):
+		return "warn"
+	case strings.Contains(lower, "debug"):
+		return "debug"
+	case stream == "stderr":
+		return "error"
+	}
+	return "info"
+}
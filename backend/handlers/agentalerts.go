@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"dockscope/protocol"
+)
+
+// Agent alerts older than this when they reach the master are recorded and
+// notified, but no longer trigger auto-recovery
+const agentRecoveryWindow = 2 * time.Minute
+
+// Rule types an agent can evaluate on its own samples, logs and events
+var agentRuleTypes = map[string]bool{
+	HighCPU: true, HighMemory: true, LogPattern: true,
+	ContainerOOM: true, ContainerDied: true, ContainerUnhealthy: true,
+}
+
+// agentAlertRules returns the enabled rules that apply to a host, and the
+// silences not yet over that could mute them; rules and silences without a
+// host apply to every host. Notification targets only go to agents that
+// evaluate rules locally, the only ones that notify by themselves.
+func agentAlertRules(hostID string) protocol.AlertRuleSet {
+	withTargets := hostEvaluatesAlerts(hostID)
+	alertsMutex.RLock()
+	var rules []protocol.AlertRule
+	for _, rule := range alertRules {
+		if !rule.Enabled || !agentRuleTypes[rule.Type] || (rule.HostID != "" && rule.HostID != hostID) {
+			continue
+		}
+		agentRule := protocol.AlertRule{
+			ID:          rule.ID,
+			ContainerID: rule.ContainerID,
+			Type:        rule.Type,
+			Threshold:   rule.Threshold,
+			Pattern:     rule.Pattern,
+
+			ForSeconds:       rule.forDuration().Seconds(),
+			ResolveThreshold: rule.resolveThreshold(),
+		}
+		if withTargets {
+			agentRule.Email, agentRule.SlackWebhook = rule.Email, rule.SlackWebhook
+		}
+		rules = append(rules, agentRule)
+	}
+	alertsMutex.RUnlock()
+
+	now := time.Now()
+	var hostSilences []protocol.Silence
+	silencesMutex.RLock()
+	for _, silence := range silences {
+		if (silence.HostID == "" || silence.HostID == hostID) && (silence.EndsAt.IsZero() || silence.EndsAt.After(now)) {
+			hostSilences = append(hostSilences, silence.Silence)
+		}
+	}
+	silencesMutex.RUnlock()
+	return protocol.NewAlertRuleSet(hostID, rules, hostSilences)
+}
+
+func findAlertRule(id string) (AlertRule, bool) {
+	alertsMutex.RLock()
+	defer alertsMutex.RUnlock()
+	for _, rule := range alertRules {
+		if rule.ID == id {
+			return rule, true
+		}
+	}
+	return AlertRule{}, false
+}
+
+// hostEvaluatesAlerts reports whether a host's agent evaluates its rules
+// locally, in which case the master does not evaluate them a second time
+func hostEvaluatesAlerts(hostID string) bool {
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	st := hostAgents[hostID]
+	return st != nil && st.AlertRulesRevision != ""
+}
+
+// PushAlertRules sends the current rule set to every connected agent;
+// agents on the HTTP transport pick changes up on their next poll
+func PushAlertRules() {
+	agentConnsMutex.Lock()
+	hostIDs := make([]string, 0, len(agentConns))
+	for hostID := range agentConns {
+		hostIDs = append(hostIDs, hostID)
+	}
+	agentConnsMutex.Unlock()
+
+	for _, hostID := range hostIDs {
+		pushAlertRules(hostID)
+	}
+}
+
+func pushAlertRules(hostID string) {
+	agentConnsMutex.Lock()
+	c := agentConns[hostID]
+	agentConnsMutex.Unlock()
+	if c == nil {
+		return
+	}
+
+	env, err := protocol.NewEnvelope(protocol.TypeAlertRules, 0, agentAlertRules(hostID))
+	if err != nil {
+		return
+	}
+	if err := c.write(env); err != nil {
+		log.Printf("Failed to push alert rules to %s: %v", hostID, err)
+	}
+}
+
+// AgentAlertRulesHandler returns the rules an agent should evaluate. The
+// revision doubles as ETag, so unchanged sets cost a 304.
+func AgentAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	hostID := r.URL.Query().Get("host_id")
+	if hostID == "" {
+		http.Error(w, "Missing host_id", http.StatusBadRequest)
+		return
+	}
+	if err := authenticateAgent(r, hostID); err != nil {
+		rejectAgent(w, r, hostID, err)
+		return
+	}
+
+	set := agentAlertRules(hostID)
+	etag := `"` + set.Revision + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
+
+// ReceiveAgentAlertsHandler records alerts fired by an agent
+func ReceiveAgentAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := protocol.DecodeAgentAlertPayload(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := authenticateAgent(r, payload.HostID); err != nil {
+		rejectAgent(w, r, payload.HostID, err)
+		return
+	}
+
+	storeAgentAlerts(payload)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// storeAgentAlerts records agent alerts once each. Alerts the agent could
+// not hand over live are notified here unless the agent already did.
+func storeAgentAlerts(payload protocol.AgentAlertPayload) {
+	for _, a := range payload.Alerts {
+		state := StateFiring
+		if a.Resolved {
+			state = StateResolved
+		}
+		target := AlertRule{ID: a.RuleID, HostID: payload.HostID, ContainerID: a.ContainerID, Type: a.Type}
+		silence, silenced := activeSilence(target, a.FiredAt, &containerMeta{Name: a.ContainerName})
+		stored, err := insertAlertEvent(AlertEvent{
+			AgentAlertID:  a.ID,
+			AlertID:       a.RuleID,
+			HostID:        payload.HostID,
+			ContainerID:   a.ContainerID,
+			Type:          a.Type,
+			Message:       a.Message,
+			Timestamp:     a.FiredAt,
+			State:         state,
+			Source:        "agent",
+			AgentNotified: a.Notified,
+			Suppressed:    silenced,
+			SilenceID:     silence.ID,
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to store agent alert %s from %s: %v", a.ID, payload.HostID, err)
+			continue
+		}
+		if !stored {
+			continue // already delivered once
+		}
+		log.Printf("%s[Agent Alert]%s Host %s: %s on %s (%s), fired %s",
+			ColorRed, ColorReset, payload.HostID, a.Type, a.ContainerName, a.Message, a.FiredAt.Format(time.RFC3339))
+		if !trackAgentAlert(payload.HostID, a, silence.ID) {
+			continue // already firing, so notified and recovered once
+		}
+		if silenced {
+			logSilencedAlert(target, silence.ID, a.Message)
+			continue
+		}
+
+		rule, ok := findAlertRule(a.RuleID)
+		if !ok {
+			continue
+		}
+		rule.HostID = payload.HostID
+		rule.ContainerID = a.ContainerID
+		if !a.Notified {
+			notifyAlert(rule, a.Message+" ("+a.ContainerName+")")
+		}
+		if !a.Resolved && time.Since(a.FiredAt) < agentRecoveryWindow {
+			go handleAutoRecovery(rule)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"dockscope/backend/db"
+)
+
+const agentAPIPort = "8880"
+
+// containerBackend is the subset of the Docker API used by the log and stats
+// handlers. The master's own containers are served by the local Docker client,
+// agent containers by the owning agent's API.
+type containerBackend interface {
+	ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ContainerStatsOneShot(ctx context.Context, containerID string) (types.ContainerStats, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	Close() error
+}
+
+var (
+	agentAPIURLs  = make(map[string]string)
+	agentAPIMutex = &sync.Mutex{}
+)
+
+// rememberAgentAPI records where an agent's API can be reached: the address
+// the authenticated agent connected from, over HTTPS when it presented a
+// client certificate. An advertised AGENT_API_URL only picks the scheme and
+// port, never the host. AGENT_API_URLS (host=url,...) overrides the address
+// for agents behind NAT or a proxy.
+func rememberAgentAPI(r *http.Request, hostID, advertised string) {
+	apiURL, ok := configuredAgentAPIURLs()[hostID]
+	if !ok {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return
+		}
+		scheme, port := "http", agentAPIPort
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			scheme = "https"
+		}
+		if u, err := url.Parse(advertised); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			scheme = u.Scheme
+			if u.Port() != "" {
+				port = u.Port()
+			}
+		}
+		apiURL = scheme + "://" + net.JoinHostPort(host, port)
+	}
+	if err := validateAgentAPIURL(apiURL); err != nil {
+		log.Printf("Ignoring API address of %s: %v", hostID, err)
+		return
+	}
+
+	agentAPIMutex.Lock()
+	changed := agentAPIURLs[hostID] != apiURL
+	agentAPIURLs[hostID] = apiURL
+	agentAPIMutex.Unlock()
+	if changed {
+		saveAgentAPIURL(hostID, apiURL)
+	}
+}
+
+// configuredAgentAPIURLs parses AGENT_API_URLS, e.g. "web-1=https://10.0.0.5:8880"
+func configuredAgentAPIURLs() map[string]string {
+	urls := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("AGENT_API_URLS"), ",") {
+		hostID, apiURL, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && hostID != "" {
+			urls[hostID] = strings.TrimSuffix(apiURL, "/")
+		}
+	}
+	return urls
+}
+
+// validateAgentAPIURL only lets the master call plain http(s) base URLs
+func validateAgentAPIURL(apiURL string) error {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not http(s)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("no host")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" || (u.Path != "" && u.Path != "/") {
+		return errors.New("only scheme, host and port are allowed")
+	}
+	return nil
+}
+
+// saveAgentAPIURL persists an agent's API address so proxying works right
+// after a master restart
+func saveAgentAPIURL(hostID, apiURL string) {
+	now := time.Now().UTC().Format(sqlTimeFormat)
+	_, err := db.DB.Exec(`
+		INSERT INTO hosts(host_id, api_url, registered_at, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(host_id) DO UPDATE SET api_url = excluded.api_url`,
+		hostID, apiURL, now, now,
+	)
+	if err != nil {
+		log.Printf("Failed to save API address of %s: %v", hostID, err)
+	}
+}
+
+// agentAPITokenFor derives the bearer token the master presents to one
+// agent's API from AGENT_API_TOKEN, so a leaked agent token is useless on
+// other hosts. Agents are configured with their own (api.token); it is
+// returned as api_token when a host's agent token is issued.
+func agentAPITokenFor(hostID string) string {
+	key := agentAPIToken()
+	if key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(hostID))
+	return "dsh_" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// containerBackendFor returns the backend owning containers of hostID
+func containerBackendFor(hostID string) (containerBackend, error) {
+	if hostID == "" || hostID == "master" {
+		return client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	}
+
+	agentAPIMutex.Lock()
+	apiURL, ok := agentAPIURLs[hostID]
+	agentAPIMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no API address known for host %s", hostID)
+	}
+	return &agentBackend{hostID: hostID, baseURL: apiURL}, nil
+}
+
+// agentBackend calls the container endpoints of an agent's API
+type agentBackend struct {
+	hostID  string
+	baseURL string
+}
+
+func (a *agentBackend) get(ctx context.Context, hc *http.Client, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := agentAPITokenFor(a.hostID); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("agent returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// ContainerLogs returns the raw Docker log stream, multiplexed exactly as the
+// local Docker client returns it
+func (a *agentBackend) ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("id", containerID)
+	query.Set("format", "raw")
+	query.Set("stdout", strconv.FormatBool(options.ShowStdout))
+	query.Set("stderr", strconv.FormatBool(options.ShowStderr))
+	query.Set("timestamps", strconv.FormatBool(options.Timestamps))
+	query.Set("follow", strconv.FormatBool(options.Follow))
+	if options.Tail != "" {
+		query.Set("tail", options.Tail)
+	}
+	if options.Since != "" {
+		query.Set("since", options.Since)
+	}
+	if options.Until != "" {
+		query.Set("until", options.Until)
+	}
+
+	// Followed streams stay open for as long as the caller's context
+	hc := agentClient
+	if options.Follow {
+		hc = agentStreamClient
+	}
+	resp, err := a.get(ctx, hc, "/logs", query)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (a *agentBackend) ContainerStatsOneShot(ctx context.Context, containerID string) (types.ContainerStats, error) {
+	resp, err := a.get(ctx, agentClient, "/containers/stats", url.Values{"id": {containerID}})
+	if err != nil {
+		return types.ContainerStats{}, err
+	}
+	return types.ContainerStats{Body: resp.Body, OSType: resp.Header.Get("Ostype")}, nil
+}
+
+func (a *agentBackend) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	var info types.ContainerJSON
+	resp, err := a.get(ctx, agentClient, "/containers/inspect", url.Values{"id": {containerID}})
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+func (a *agentBackend) Close() error {
+	return nil
+}
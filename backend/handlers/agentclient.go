@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"dockscope/pki"
+)
+
+// agentClient is used for every call the master makes to an agent's API;
+// agentStreamClient for long-lived streams such as followed logs
+var (
+	agentClient       = &http.Client{Timeout: 30 * time.Second}
+	agentStreamClient = &http.Client{}
+)
+
+// agentAPIToken returns the secret the per-host agent API tokens are derived
+// from (see agentAPITokenFor); it is never sent to an agent itself.
+func agentAPIToken() string {
+	return os.Getenv("AGENT_API_TOKEN")
+}
+
+// InitAgentClient configures TLS for master→agent calls. Agent certificates are
+// verified against AGENT_CA_FILE (falling back to TLS_CLIENT_CA_FILE) and the
+// master presents MASTER_CLIENT_CERT_FILE/KEY (falling back to its server cert).
+func InitAgentClient() error {
+	caFile := firstEnv("AGENT_CA_FILE", "TLS_CLIENT_CA_FILE")
+	certFile := firstEnv("MASTER_CLIENT_CERT_FILE", "TLS_CERT_FILE")
+	keyFile := firstEnv("MASTER_CLIENT_KEY_FILE", "TLS_KEY_FILE")
+	if caFile == "" && certFile == "" {
+		return nil
+	}
+
+	cfg, err := pki.ClientConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	transport := &http.Transport{TLSClientConfig: cfg}
+	agentClient = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	agentStreamClient = &http.Client{Transport: transport}
+	return nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"dockscope/protocol"
+)
+
+const (
+	agentPingInterval = 30 * time.Second
+	agentReadTimeout  = 90 * time.Second
+)
+
+var (
+	errAgentNotConnected = errors.New("agent is not connected")
+
+	// errAgentPayloadInvalid marks a message that failed to decode or validate
+	errAgentPayloadInvalid = errors.New("invalid payload")
+)
+
+// agentConn is a live WebSocket stream from one agent
+type agentConn struct {
+	hostID  string
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+var (
+	agentConns      = make(map[string]*agentConn)
+	agentConnsMutex = &sync.Mutex{}
+)
+
+func (c *agentConn) write(env protocol.Envelope) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteJSON(env)
+}
+
+// SendAgentCommand pushes a command to a connected agent
+func SendAgentCommand(hostID string, cmd protocol.Command) error {
+	agentConnsMutex.Lock()
+	c := agentConns[hostID]
+	agentConnsMutex.Unlock()
+	if c == nil {
+		return errAgentNotConnected
+	}
+
+	env, err := protocol.NewEnvelope(protocol.TypeCommand, 0, cmd)
+	if err != nil {
+		return err
+	}
+	return c.write(env)
+}
+
+// agentUpgrader negotiates permessage-deflate with agents that ask for it
+var agentUpgrader = websocket.Upgrader{
+	CheckOrigin:       func(r *http.Request) bool { return true },
+	EnableCompression: true,
+}
+
+// AgentConnected reports whether an agent currently holds a WebSocket stream
+func AgentConnected(hostID string) bool {
+	agentConnsMutex.Lock()
+	defer agentConnsMutex.Unlock()
+	return agentConns[hostID] != nil
+}
+
+// AgentStreamHandler accepts the persistent agent WebSocket. Metrics, logs and
+// events arrive multiplexed as envelopes and each one is acknowledged.
+func AgentStreamHandler(w http.ResponseWriter, r *http.Request) {
+	hostID := r.URL.Query().Get("host_id")
+	if hostID == "" {
+		http.Error(w, "Missing host_id", http.StatusBadRequest)
+		return
+	}
+	if err := authenticateAgent(r, hostID); err != nil {
+		rejectAgent(w, r, hostID, err)
+		return
+	}
+
+	conn, err := agentUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Agent WebSocket upgrade error: %v", err)
+		return
+	}
+
+	c := &agentConn{hostID: hostID, conn: conn}
+
+	agentConnsMutex.Lock()
+	if old := agentConns[hostID]; old != nil {
+		old.conn.Close()
+	}
+	agentConns[hostID] = c
+	agentConnsMutex.Unlock()
+
+	log.Printf("%s[Agent Stream]%s Host %s connected from %s", ColorGreen, ColorReset, hostID, r.RemoteAddr)
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+		agentConnsMutex.Lock()
+		if agentConns[hostID] == c {
+			delete(agentConns, hostID)
+		}
+		agentConnsMutex.Unlock()
+		log.Printf("%s[Agent Stream]%s Host %s disconnected", ColorYellow, ColorReset, hostID)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(agentReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(agentReadTimeout))
+	})
+	go func() {
+		ticker := time.NewTicker(agentPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.writeMu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+				c.writeMu.Unlock()
+				if err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		var env protocol.Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(agentReadTimeout))
+
+		if env.Type == protocol.TypeHello {
+			var hello protocol.Hello
+			if err := json.Unmarshal(env.Payload, &hello); err != nil || hello.HostID != hostID {
+				log.Printf("Agent %s sent an invalid hello", hostID)
+				return
+			}
+			go dispatchPendingCommands(hostID)
+			go pushAlertRules(hostID)
+			continue
+		}
+
+		// A message is only dropped by the agent once acked without error, so
+		// anything unacked when the stream breaks is resent after reconnecting
+		ack := protocol.Ack{Seq: env.Seq}
+		if err := handleAgentEnvelope(hostID, r, env); err != nil {
+			ack.Error = err.Error()
+			// Resending these gets the same answer, so the agent sets them aside
+			ack.Rejected = errors.Is(err, errAgentPayloadInvalid) || errors.Is(err, errAgentHostMismatch) ||
+				errors.Is(err, sql.ErrNoRows)
+		}
+
+		reply, _ := protocol.NewEnvelope(protocol.TypeAck, 0, ack)
+		if err := c.write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// handleAgentEnvelope decodes and stores one multiplexed message
+func handleAgentEnvelope(hostID string, r *http.Request, env protocol.Envelope) error {
+	switch env.Type {
+	case protocol.TypeMetrics:
+		payload, err := protocol.DecodeMetricsPayload(bytes.NewReader(env.Payload))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if payload.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		PrintAgentMetricsLog(r, payload.HostID, len(payload.Containers))
+		rememberAgentAPI(r, payload.HostID, payload.APIURL)
+		touchHost(payload.HostID, r.RemoteAddr)
+		return storeAgentMetrics(payload)
+
+	case protocol.TypeMetricsBatch:
+		batch, skipped, err := protocol.DecodeMetricsBatch(bytes.NewReader(env.Payload))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if batch.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		logSkippedPayloads(hostID, skipped)
+		return storeAgentMetricsBatch(r, batch)
+
+	case protocol.TypeLogs:
+		payload, err := protocol.DecodeLogPayload(bytes.NewReader(env.Payload))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if payload.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		storeAgentLogs(payload)
+		return nil
+
+	case protocol.TypeEvents:
+		payload, err := protocol.DecodeEventPayload(bytes.NewReader(env.Payload))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if payload.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		for _, ev := range payload.Events {
+			RecordContainerEvent(hostID, ev)
+		}
+		return nil
+
+	case protocol.TypeRegister:
+		reg, err := protocol.DecodeRegistration(bytes.NewReader(env.Payload))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if reg.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		return registerHost(reg, r.RemoteAddr)
+
+	case protocol.TypeAlerts:
+		payload, err := protocol.DecodeAgentAlertPayload(bytes.NewReader(env.Payload))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if payload.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		storeAgentAlerts(payload)
+		return nil
+
+	case protocol.TypeCommandResult:
+		var result protocol.CommandResult
+		if err := json.Unmarshal(env.Payload, &result); err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if err := result.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", errAgentPayloadInvalid, err)
+		}
+		if result.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		return applyCommandResult(result)
+	}
+	return fmt.Errorf("unknown message type %q", env.Type)
+}
+
+// AgentControlHandler pushes a control command (set_interval, send_logs) to a connected agent
+func AgentControlHandler(w http.ResponseWriter, r *http.Request) {
+	hostID := r.URL.Query().Get("host_id")
+	if hostID == "" {
+		http.Error(w, "Missing host_id", http.StatusBadRequest)
+		return
+	}
+
+	var cmd protocol.Command
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	switch cmd.Action {
+	case protocol.CommandSetInterval:
+		if cmd.IntervalSeconds < 1 {
+			http.Error(w, "interval_seconds must be at least 1", http.StatusBadRequest)
+			return
+		}
+	case protocol.CommandSendLogs:
+		if cmd.ContainerID == "" {
+			http.Error(w, "Missing container_id", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	if err := SendAgentCommand(hostID, cmd); err != nil {
+		if errors.Is(err, errAgentNotConnected) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to send command", http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Command sent"))
+}
@@ -1,35 +1,57 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
-
-	"dockscope/backend/logger"
 )
 
-// CreateAlertRuleHandler handles creation of new alert rules
+// CreateAlertRuleHandler handles creation of new alert rules. The ID is
+// generated unless given; rules are enabled unless the request says otherwise.
 func CreateAlertRuleHandler(w http.ResponseWriter, r *http.Request) {
-	var rule AlertDefinition
+	rule := AlertRule{Enabled: true}
 	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-
-	if rule.ID == "" || rule.ContainerID == "" || rule.Type == "" {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
+	if rule.ID == "" {
+		id, err := randomHex(8)
+		if err != nil {
+			http.Error(w, "Failed to generate rule ID", http.StatusInternalServerError)
+			return
+		}
+		rule.ID = "rule-" + id
+	}
+	if err := validateAlertRule(rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	alertsMutex.Lock()
-	alertDefinitions = append(alertDefinitions, rule)
+	if alertRuleIndex(rule.ID) >= 0 {
+		alertsMutex.Unlock()
+		http.Error(w, "Alert rule "+rule.ID+" already exists", http.StatusConflict)
+		return
+	}
+	alertRules = append(alertRules, rule)
+	SaveAlertRulesToFile(alertRulesFile, alertRules)
 	alertsMutex.Unlock()
 
-	SaveAlertRulesToFile("data/alert_rules.json", alertRules)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Alert rule created"))
+	go PushAlertRules()
+	w.Header().Set("Location", "/alerts/"+rule.ID)
+	writeAlertRule(w, rule, http.StatusCreated)
 }
 
 // ListAlertRulesHandler returns current alert rules
@@ -38,9 +60,252 @@ func ListAlertRulesHandler(w http.ResponseWriter, r *http.Request) {
 	defer alertsMutex.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
+	if alertRules == nil {
+		json.NewEncoder(w).Encode([]AlertRule{})
+		return
+	}
 	json.NewEncoder(w).Encode(alertRules)
 }
 
+// GetAlertRuleHandler returns one rule with its ETag
+func GetAlertRuleHandler(w http.ResponseWriter, r *http.Request, id string) {
+	alertsMutex.RLock()
+	i := alertRuleIndex(id)
+	var rule AlertRule
+	if i >= 0 {
+		rule = alertRules[i]
+	}
+	alertsMutex.RUnlock()
+
+	if i < 0 {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	writeAlertRule(w, rule, http.StatusOK)
+}
+
+// UpdateAlertRuleHandler replaces a rule (PUT) or merges the given fields
+// into it (PATCH). With If-Match, the update only applies if nobody changed
+// the rule since the client read it.
+func UpdateAlertRuleHandler(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	i := alertRuleIndex(id)
+	if i < 0 {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if !alertRuleMatches(r, alertRules[i]) {
+		http.Error(w, "Alert rule was modified, reload it and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	rule := AlertRule{Enabled: true}
+	if r.Method == http.MethodPatch {
+		rule = alertRules[i]
+	}
+	if err := json.Unmarshal(body, &rule); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if rule.ID == "" {
+		rule.ID = id
+	}
+	if rule.ID != id {
+		http.Error(w, "Alert rule ID cannot be changed", http.StatusConflict)
+		return
+	}
+	if err := validateAlertRule(rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	old := alertRules[i]
+	alertRules[i] = rule
+	SaveAlertRulesToFile(alertRulesFile, alertRules)
+	go PushAlertRules()
+	if !rule.Enabled || !sameEvaluation(old, rule) {
+		// States of the old target or condition would otherwise linger
+		// until the sweep closes them
+		forgetAlertStates(id)
+	}
+	writeAlertRule(w, rule, http.StatusOK)
+}
+
+// sameEvaluation reports whether two versions of a rule watch the same
+// containers for the same condition, so their alert states carry over.
+// Notification settings do not matter.
+func sameEvaluation(a, b AlertRule) bool {
+	return a.HostID == b.HostID && a.ContainerID == b.ContainerID && a.Type == b.Type &&
+		a.Threshold == b.Threshold && a.ResolveThreshold == b.ResolveThreshold &&
+		a.Pattern == b.Pattern && a.For == b.For && a.Enabled == b.Enabled
+}
+
+// SetAlertRuleEnabledHandler enables or disables a rule
+func SetAlertRuleEnabledHandler(w http.ResponseWriter, r *http.Request, id string, enabled bool) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	i := alertRuleIndex(id)
+	if i < 0 {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if !alertRuleMatches(r, alertRules[i]) {
+		http.Error(w, "Alert rule was modified, reload it and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	if alertRules[i].Enabled != enabled {
+		alertRules[i].Enabled = enabled
+		SaveAlertRulesToFile(alertRulesFile, alertRules)
+		go PushAlertRules()
+		if !enabled {
+			forgetAlertStates(id)
+		}
+	}
+	writeAlertRule(w, alertRules[i], http.StatusOK)
+}
+
+// DeleteAlertRuleHandler removes a rule
+func DeleteAlertRuleHandler(w http.ResponseWriter, r *http.Request, id string) {
+	alertsMutex.Lock()
+	defer alertsMutex.Unlock()
+
+	i := alertRuleIndex(id)
+	if i < 0 {
+		http.Error(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	if !alertRuleMatches(r, alertRules[i]) {
+		http.Error(w, "Alert rule was modified, reload it and retry", http.StatusPreconditionFailed)
+		return
+	}
+
+	alertRules = append(alertRules[:i], alertRules[i+1:]...)
+	SaveAlertRulesToFile(alertRulesFile, alertRules)
+	go PushAlertRules()
+	forgetAlertStates(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// alertRuleIndex returns the position of a rule, or -1; callers hold alertsMutex
+func alertRuleIndex(id string) int {
+	for i, rule := range alertRules {
+		if rule.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// alertRuleETag changes whenever any field of the rule does
+func alertRuleETag(rule AlertRule) string {
+	data, _ := json.Marshal(rule)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// alertRuleMatches checks an If-Match precondition; requests without one always match
+func alertRuleMatches(r *http.Request, rule AlertRule) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	etag := alertRuleETag(rule)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(tag) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeAlertRule(w http.ResponseWriter, rule AlertRule, status int) {
+	w.Header().Set("ETag", alertRuleETag(rule))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// validateAlertRule checks the fields every rule needs and those its type needs
+func validateAlertRule(rule AlertRule) error {
+	if strings.ContainsAny(rule.ID, "/?#") {
+		return errors.New("id must not contain '/', '?' or '#'")
+	}
+	if rule.ID == "state" || rule.ID == "events" {
+		return fmt.Errorf("id %q is reserved", rule.ID)
+	}
+	if rule.ContainerID == "" {
+		return errors.New("container_id is required")
+	}
+
+	switch rule.Type {
+	case HighCPU, HighMemory:
+		if rule.Threshold <= 0 {
+			return fmt.Errorf("threshold is required for %s and must be positive", rule.Type)
+		}
+	case LogPattern:
+		if rule.Pattern == "" {
+			return errors.New("pattern is required for log_pattern")
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("pattern does not compile: %v", err)
+		}
+	case ContainerOOM, ContainerDied, ContainerUnhealthy:
+	case "":
+		return errors.New("type is required")
+	default:
+		return fmt.Errorf("unknown type %q", rule.Type)
+	}
+	if rule.ResolveThreshold != 0 {
+		if rule.Type != HighCPU && rule.Type != HighMemory {
+			return errors.New("resolve_threshold only applies to high_cpu and high_memory rules")
+		}
+		if rule.ResolveThreshold < 0 || rule.ResolveThreshold > rule.Threshold {
+			return errors.New("resolve_threshold must be between 0 and threshold")
+		}
+	}
+	if rule.For != "" {
+		d, err := time.ParseDuration(rule.For)
+		if err != nil || d < 0 {
+			return fmt.Errorf("for must be a duration such as \"2m\", got %q", rule.For)
+		}
+	}
+	if rule.Pattern != "" && rule.Type != LogPattern {
+		return errors.New("pattern only applies to log_pattern rules")
+	}
+	if rule.Threshold != 0 && rule.Type != HighCPU && rule.Type != HighMemory {
+		return errors.New("threshold only applies to high_cpu and high_memory rules")
+	}
+
+	if rule.Email != "" {
+		if _, err := mail.ParseAddress(rule.Email); err != nil {
+			return fmt.Errorf("email: %v", err)
+		}
+	}
+	if rule.SlackWebhook != "" {
+		u, err := url.Parse(rule.SlackWebhook)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("slack_webhook must be an http(s) URL")
+		}
+	}
+	if rule.AutoRestart && rule.AutoStop {
+		return errors.New("auto_restart and auto_stop cannot both be set")
+	}
+	return nil
+}
+
+const alertRulesFile = "data/alert_rules.json"
+
+// SaveAlertRulesToFile writes the alert rules to disk; callers hold alertsMutex
 func SaveAlertRulesToFile(filename string, rules []AlertRule) {
 	data, err := json.MarshalIndent(rules, "", "  ")
 	if err != nil {
@@ -48,64 +313,35 @@ func SaveAlertRulesToFile(filename string, rules []AlertRule) {
 		return
 	}
 
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		log.Printf("[ERROR] Failed to create data directory: %v\n", err)
+		return
+	}
+
 	err = os.WriteFile(filename, data, 0644)
 	if err != nil {
 		log.Printf("[ERROR] Failed to write alert rules to file: %v\n", err)
 	}
 }
 
-// EvaluateAlerts checks if any alert rules are triggered by the incoming metrics
-func EvaluateAlerts(payload AgentPayload) {
-	for _, container := range payload.Containers {
-		for _, alert := range alertDefinitions {
-			if !alert.Enabled || alert.HostID != payload.HostID || alert.ContainerID != container.ID {
-				continue
-			}
-
-			triggered := false
-			message := ""
-
-			avg, err := QueryAverageMetric(alert.Type, container.ID, payload.HostID, 5*time.Minute)
-			if err != nil {
-				logger.Error("Failed to fetch metric from InfluxDB: %v", err)
-				continue
-			}
-
-			switch alert.Type {
-			case "high_cpu":
-				if avg > alert.Threshold {
-					triggered = true
-					message = "CPU usage exceeded threshold"
-				}
-			case "high_memory":
-				if avg > alert.Threshold {
-					triggered = true
-					message = "Memory usage exceeded threshold"
-				}
-			}
-
-			if triggered {
-				logger.Warn("[ALERT] %s (%s) triggered on container %s: %s", alert.Type, alert.ID, container.ID, message)
-
-				event := AlertEvent{
-					AlertID:     alert.ID,
-					HostID:      payload.HostID,
-					ContainerID: container.ID,
-					Type:        alert.Type,
-					Message:     message,
-					Timestamp:   time.Now(),
-				}
-
-				alertEvents = append(alertEvents, event)
-				SaveAlertEventsToFile()
-
-				if alert.Email != "" {
-					subject := "[DockScope Alert] " + alert.Type + " on " + container.Name
-					body := "Alert ID: " + alert.ID + "\nContainer: " + container.Name + "\nType: " + alert.Type + "\n\nMessage:\n" + message
-					go SendEmailNotification(alert.Email, subject, body)
-				}
-			}
+// LoadAlertRulesFromFile restores the alert rules saved by SaveAlertRulesToFile
+func LoadAlertRulesFromFile() {
+	data, err := os.ReadFile(alertRulesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Failed to read alert rules: %v\n", err)
 		}
+		return
 	}
-}
 
+	var rules []AlertRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		log.Printf("[ERROR] Failed to unmarshal alert rules: %v\n", err)
+		return
+	}
+
+	alertsMutex.Lock()
+	alertRules = rules
+	alertsMutex.Unlock()
+	log.Printf("Loaded %d alert rules from %s", len(rules), alertRulesFile)
+}
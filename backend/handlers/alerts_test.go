@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"dockscope/backend/db"
+	"dockscope/protocol"
+)
+
+// useTempData runs the test in an empty directory with a fresh database and
+// no rules, samples or alert states
+func useTempData(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	db.InitDB()
+
+	reset := func() {
+		alertsMutex.Lock()
+		alertRules = nil
+		agentMetrics = make(map[string][]ContainerMetrics)
+		agentMetricsUpdated = make(map[string]time.Time)
+		alertsMutex.Unlock()
+		alertStatesMutex.Lock()
+		alertStates = make(map[string]*AlertState)
+		alertStatesMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		reset()
+		db.DB.Close()
+		os.Chdir(wd)
+	})
+}
+
+func TestHighCPURuleFiresOnAgentSample(t *testing.T) {
+	useTempData(t)
+
+	rec := httptest.NewRecorder()
+	CreateAlertRuleHandler(rec, httptest.NewRequest(http.MethodPost, "/alerts",
+		strings.NewReader(`{"id":"cpu-web","host_id":"h1","container_id":"abc123","type":"high_cpu","threshold":80}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create rule: status = %d (%s)", rec.Code, rec.Body.String())
+	}
+
+	alertsMutex.Lock()
+	agentMetrics["h1"] = []ContainerMetrics{{ID: "abc123def456", Name: "web", CPUPercent: 95}}
+	agentMetricsUpdated["h1"] = time.Now()
+	alertsMutex.Unlock()
+
+	checkAllAlerts()
+
+	rec = httptest.NewRecorder()
+	ListAlertStatesHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/state?rule_id=cpu-web", nil))
+	var states []AlertState
+	if err := json.NewDecoder(rec.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].State != StateFiring || states[0].HostID != "h1" || states[0].ContainerID != "abc123def456" {
+		t.Fatalf("alert states = %+v, want one firing on h1/abc123def456", states)
+	}
+
+	rec = httptest.NewRecorder()
+	ListAlertEventsHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/events?rule_id=cpu-web", nil))
+	var events []AlertEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].State != StateFiring || events[0].Type != HighCPU {
+		t.Fatalf("alert events = %+v, want one firing high_cpu event", events)
+	}
+	if events[0].Timestamp.IsZero() {
+		t.Error("alert event has no timestamp")
+	}
+}
+
+func TestHighCPURuleStaysQuietBelowThreshold(t *testing.T) {
+	useTempData(t)
+
+	rec := httptest.NewRecorder()
+	CreateAlertRuleHandler(rec, httptest.NewRequest(http.MethodPost, "/alerts",
+		strings.NewReader(`{"id":"cpu-web","container_id":"abc123","type":"high_cpu","threshold":80}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create rule: status = %d (%s)", rec.Code, rec.Body.String())
+	}
+
+	alertsMutex.Lock()
+	agentMetrics["h1"] = []ContainerMetrics{{ID: "abc123def456", Name: "web", CPUPercent: 40}}
+	agentMetricsUpdated["h1"] = time.Now()
+	alertsMutex.Unlock()
+
+	checkAllAlerts()
+
+	alertStatesMutex.Lock()
+	n := len(alertStates)
+	alertStatesMutex.Unlock()
+	if n != 0 {
+		t.Errorf("%d alert states, want none", n)
+	}
+}
+
+func TestHighCPURuleSkipsStaleSnapshot(t *testing.T) {
+	useTempData(t)
+	t.Setenv("HOST_STALE_AFTER", "30s")
+
+	rec := httptest.NewRecorder()
+	CreateAlertRuleHandler(rec, httptest.NewRequest(http.MethodPost, "/alerts",
+		strings.NewReader(`{"id":"cpu-web","host_id":"h1","container_id":"abc123","type":"high_cpu","threshold":80}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create rule: status = %d (%s)", rec.Code, rec.Body.String())
+	}
+
+	alertsMutex.Lock()
+	agentMetrics["h1"] = []ContainerMetrics{{ID: "abc123def456", Name: "web", CPUPercent: 95}}
+	agentMetricsUpdated["h1"] = time.Now().Add(-time.Minute)
+	alertsMutex.Unlock()
+
+	checkAllAlerts()
+
+	alertStatesMutex.Lock()
+	n := len(alertStates)
+	alertStatesMutex.Unlock()
+	if n != 0 {
+		t.Errorf("%d alert states from a stale snapshot, want none", n)
+	}
+}
+
+func TestAgentAlertsListedInState(t *testing.T) {
+	useTempData(t)
+
+	fired := time.Now().Add(-time.Minute).UTC()
+	storeAgentAlerts(protocol.NewAgentAlertPayload("h1", []protocol.AgentAlert{
+		{ID: "a1", RuleID: "cpu-web", ContainerID: "abc123def456", ContainerName: "web", Type: HighCPU, Message: "High CPU usage: 95.00%", Value: 95, FiredAt: fired},
+		{ID: "a2", RuleID: "oom-web", ContainerID: "abc123def456", ContainerName: "web", Type: ContainerOOM, Message: "OOM", FiredAt: fired},
+	}))
+
+	listStates := func() []AlertState {
+		rec := httptest.NewRecorder()
+		ListAlertStatesHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/state?host_id=h1", nil))
+		var states []AlertState
+		if err := json.NewDecoder(rec.Body).Decode(&states); err != nil {
+			t.Fatal(err)
+		}
+		return states
+	}
+
+	states := listStates()
+	if len(states) != 1 || states[0].RuleID != "cpu-web" || states[0].State != StateFiring || states[0].Source != "agent" || !states[0].FiredAt.Equal(fired) {
+		t.Fatalf("alert states = %+v, want cpu-web firing from the agent", states)
+	}
+
+	// The master does not close it for lack of its own evaluations
+	alertStatesMutex.Lock()
+	for _, st := range alertStates {
+		st.LastEval = time.Now().Add(-time.Hour)
+	}
+	alertStatesMutex.Unlock()
+	sweepAlertStates()
+	if states := listStates(); len(states) != 1 || states[0].State != StateFiring {
+		t.Fatalf("alert states after sweep = %+v, want still firing", states)
+	}
+
+	storeAgentAlerts(protocol.NewAgentAlertPayload("h1", []protocol.AgentAlert{
+		{ID: "a3", RuleID: "cpu-web", ContainerID: "abc123def456", ContainerName: "web", Type: HighCPU, Message: "Resolved: High CPU usage: 95.00%", FiredAt: fired.Add(30 * time.Second), Resolved: true},
+	}))
+	if states := listStates(); len(states) != 1 || states[0].State != StateResolved {
+		t.Errorf("alert states = %+v, want resolved", states)
+	}
+}
+
+func TestAgentAlertTransitionsOnly(t *testing.T) {
+	useTempData(t)
+
+	fired := time.Now().Add(-time.Minute).UTC()
+	alert := func(id string, at time.Time, resolved bool) protocol.AgentAlert {
+		return protocol.AgentAlert{ID: id, RuleID: "errors", ContainerID: "abc123", Type: LogPattern, FiredAt: at, Resolved: resolved}
+	}
+
+	if !trackAgentAlert("h1", alert("a1", fired, false), "") {
+		t.Error("first firing alert is not a transition")
+	}
+	if trackAgentAlert("h1", alert("a2", fired.Add(10*time.Second), false), "") {
+		t.Error("alert for a state already firing is a transition")
+	}
+	if trackAgentAlert("h1", alert("a0", fired.Add(-time.Second), true), "") {
+		t.Error("older alert delivered late is a transition")
+	}
+	if !trackAgentAlert("h1", alert("a3", fired.Add(20*time.Second), true), "") {
+		t.Error("resolving a firing alert is not a transition")
+	}
+	if trackAgentAlert("h1", alert("a4", fired.Add(30*time.Second), true), "") {
+		t.Error("resolving again is a transition")
+	}
+}
+
+func TestRuleMatchesContainer(t *testing.T) {
+	rule := AlertRule{HostID: "h1", ContainerID: "abc123"}
+	for _, tc := range []struct {
+		hostID, containerID string
+		want                bool
+	}{
+		{"h1", "abc123def456", true},
+		{"h1", "abc123", true},
+		{"h1", "abc", false}, // shorter than the rule's ID
+		{"h1", "a", false},
+		{"h1", "", false},
+		{"h1", "def456abc123", false},
+		{"h2", "abc123def456", false},
+	} {
+		if got := ruleMatchesContainer(rule, tc.hostID, tc.containerID); got != tc.want {
+			t.Errorf("ruleMatchesContainer(%s, %q) = %v, want %v", tc.hostID, tc.containerID, got, tc.want)
+		}
+	}
+}
+
+func createRule(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	CreateAlertRuleHandler(rec, httptest.NewRequest(http.MethodPost, "/alerts", strings.NewReader(body)))
+	return rec
+}
+
+func TestCreateAlertRuleDuplicateID(t *testing.T) {
+	useTempData(t)
+
+	body := `{"id":"cpu-web","container_id":"abc123","type":"high_cpu","threshold":80}`
+	if rec := createRule(t, body); rec.Code != http.StatusCreated {
+		t.Fatalf("create rule: status = %d (%s)", rec.Code, rec.Body.String())
+	}
+	if rec := createRule(t, body); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate rule: status = %d, want 409", rec.Code)
+	}
+}
+
+func TestCreateAlertRuleValidation(t *testing.T) {
+	useTempData(t)
+
+	for body, want := range map[string]string{
+		`{"container_id":"abc","type":"high_cpu"}`:                                 "threshold is required",
+		`{"container_id":"abc","type":"high_memory","threshold":-1}`:               "threshold is required",
+		`{"container_id":"abc","type":"log_pattern"}`:                              "pattern is required",
+		`{"container_id":"abc","type":"log_pattern","pattern":"("}`:                "pattern does not compile",
+		`{"container_id":"abc","type":"container_oom","threshold":5}`:              "threshold only applies",
+		`{"container_id":"abc","type":"high_cpu","threshold":80,"pattern":"x"}`:    "pattern only applies",
+		`{"container_id":"abc","type":"container_died","resolve_threshold":1}`:     "resolve_threshold only applies",
+		`{"container_id":"abc","type":"high_cpu","threshold":80,"for":"soon"}`:     "for must be a duration",
+		`{"container_id":"abc","type":"disk_full"}`:                                "unknown type",
+		`{"type":"high_cpu","threshold":80}`:                                       "container_id is required",
+		`{"id":"state","container_id":"abc","type":"container_oom"}`:               "reserved",
+		`{"container_id":"abc","type":"high_cpu","threshold":80,"email":"nobody"}`: "email",
+	} {
+		rec := createRule(t, body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s: status = %d (%s), want 400 mentioning %q", body, rec.Code, strings.TrimSpace(rec.Body.String()), want)
+		}
+	}
+	for _, body := range []string{
+		`{"container_id":"abc","type":"high_cpu","threshold":80,"resolve_threshold":60,"for":"2m"}`,
+		`{"container_id":"abc","type":"log_pattern","pattern":"ERROR|FATAL"}`,
+		`{"container_id":"abc","type":"container_unhealthy"}`,
+	} {
+		if rec := createRule(t, body); rec.Code != http.StatusCreated {
+			t.Errorf("%s: status = %d (%s), want 201", body, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestUpdateAlertRuleIfMatch(t *testing.T) {
+	useTempData(t)
+
+	rec := createRule(t, `{"id":"cpu-web","container_id":"abc123","type":"high_cpu","threshold":80}`)
+	etag := rec.Header().Get("ETag")
+
+	update := func(ifMatch, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/alerts/cpu-web", strings.NewReader(body))
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		UpdateAlertRuleHandler(rec, req, "cpu-web")
+		return rec
+	}
+
+	rec = update(etag, `{"threshold":90}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Fatalf("update with current ETag: status = %d, ETag %s (was %s)", rec.Code, rec.Header().Get("ETag"), etag)
+	}
+	if rec := update(etag, `{"threshold":95}`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("update with stale ETag: status = %d, want 412", rec.Code)
+	}
+	if rule, _ := findAlertRule("cpu-web"); rule.Threshold != 90 {
+		t.Errorf("threshold = %v, want 90 kept", rule.Threshold)
+	}
+}
+
+func TestUpdateAlertRuleForgetsStatesOfOldTarget(t *testing.T) {
+	useTempData(t)
+	createRule(t, `{"id":"cpu-web","host_id":"h1","container_id":"abc123","type":"high_cpu","threshold":80}`)
+
+	fire := func() {
+		alertsMutex.Lock()
+		agentMetrics["h1"] = []ContainerMetrics{{ID: "abc123def456", Name: "web", CPUPercent: 95}}
+		agentMetricsUpdated["h1"] = time.Now()
+		alertsMutex.Unlock()
+		checkAllAlerts()
+	}
+	states := func() int {
+		alertStatesMutex.Lock()
+		defer alertStatesMutex.Unlock()
+		return len(alertStates)
+	}
+	patch := func(body string) {
+		rec := httptest.NewRecorder()
+		UpdateAlertRuleHandler(rec, httptest.NewRequest(http.MethodPatch, "/alerts/cpu-web", strings.NewReader(body)), "cpu-web")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update %s: status = %d (%s)", body, rec.Code, rec.Body.String())
+		}
+	}
+
+	fire()
+	patch(`{"email":"ops@example.com"}`)
+	if n := states(); n != 1 {
+		t.Errorf("%d states after changing only notifications, want 1", n)
+	}
+	for _, body := range []string{`{"container_id":"def456"}`, `{"threshold":90}`, `{"host_id":"h2"}`, `{"type":"high_memory"}`} {
+		patch(`{"container_id":"abc123","host_id":"h1","type":"high_cpu","threshold":80}`)
+		fire()
+		patch(body)
+		if n := states(); n != 0 {
+			t.Errorf("%d states after %s, want the old ones dropped", n, body)
+		}
+	}
+}
+
+// sampleCPU feeds one agent sample for abc123def456 on h1 and evaluates
+func sampleCPU(cpu float64) {
+	alertsMutex.Lock()
+	agentMetrics["h1"] = []ContainerMetrics{{ID: "abc123def456", Name: "web", CPUPercent: cpu}}
+	agentMetricsUpdated["h1"] = time.Now()
+	alertsMutex.Unlock()
+	checkAllAlerts()
+}
+
+// ruleState returns the state of cpu-web on h1/abc123def456, "" if none
+func ruleState() string {
+	alertStatesMutex.Lock()
+	defer alertStatesMutex.Unlock()
+	if st := alertStates[alertStateKey("cpu-web", "h1", "abc123def456")]; st != nil {
+		return st.State
+	}
+	return ""
+}
+
+// ruleEvents returns the states in the alert history of a rule, oldest first
+func ruleEvents(t *testing.T, ruleID string) []string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ListAlertEventsHandler(rec, httptest.NewRequest(http.MethodGet, "/alerts/events?rule_id="+ruleID, nil))
+	var events []AlertEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	for i := len(events) - 1; i >= 0; i-- {
+		states = append(states, events[i].State)
+	}
+	return states
+}
+
+func TestAlertStatePendingUntilFor(t *testing.T) {
+	useTempData(t)
+	createRule(t, `{"id":"cpu-web","host_id":"h1","container_id":"abc123","type":"high_cpu","threshold":80,"for":"2m"}`)
+
+	sampleCPU(95)
+	sampleCPU(95)
+	if st := ruleState(); st != StatePending {
+		t.Fatalf("state = %q, want pending before for has passed", st)
+	}
+	if events := ruleEvents(t, "cpu-web"); len(events) != 0 {
+		t.Fatalf("events = %v while pending, want none", events)
+	}
+
+	// Dropping below the threshold while pending clears it silently
+	sampleCPU(40)
+	if st := ruleState(); st != "" {
+		t.Fatalf("state = %q, want none after clearing while pending", st)
+	}
+
+	sampleCPU(95)
+	alertStatesMutex.Lock()
+	alertStates[alertStateKey("cpu-web", "h1", "abc123def456")].ActiveAt = time.Now().Add(-3 * time.Minute)
+	alertStatesMutex.Unlock()
+	sampleCPU(95)
+	sampleCPU(95)
+	if st := ruleState(); st != StateFiring {
+		t.Fatalf("state = %q, want firing once for has passed", st)
+	}
+	if events := ruleEvents(t, "cpu-web"); len(events) != 1 || events[0] != StateFiring {
+		t.Errorf("events = %v, want a single firing", events)
+	}
+}
+
+func TestAlertStateResolveHysteresis(t *testing.T) {
+	useTempData(t)
+	createRule(t, `{"id":"cpu-web","host_id":"h1","container_id":"abc123","type":"high_cpu","threshold":80}`)
+
+	sampleCPU(95)
+	if st := ruleState(); st != StateFiring {
+		t.Fatalf("state = %q, want firing", st)
+	}
+	// Between the resolve threshold (90% of 80) and the threshold it stays firing
+	sampleCPU(75)
+	sampleCPU(85)
+	sampleCPU(73)
+	if st := ruleState(); st != StateFiring {
+		t.Fatalf("state = %q above the resolve threshold, want still firing", st)
+	}
+	sampleCPU(70)
+	if st := ruleState(); st != StateResolved {
+		t.Fatalf("state = %q at the resolve threshold, want resolved", st)
+	}
+	sampleCPU(70)
+
+	want := []string{StateFiring, StateResolved}
+	if events := ruleEvents(t, "cpu-web"); strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+
+	// Firing again is a new transition
+	sampleCPU(95)
+	if events := ruleEvents(t, "cpu-web"); len(events) != 3 || events[2] != StateFiring {
+		t.Errorf("events = %v, want a second firing", events)
+	}
+}
+
+func TestAlertStateSurvivesReload(t *testing.T) {
+	useTempData(t)
+	createRule(t, `{"id":"cpu-web","host_id":"h1","container_id":"abc123","type":"high_cpu","threshold":80}`)
+
+	sampleCPU(95)
+	if st := ruleState(); st != StateFiring {
+		t.Fatalf("state = %q, want firing", st)
+	}
+	if _, err := os.Stat(alertStateFile); err != nil {
+		t.Fatalf("alert states not saved: %v", err)
+	}
+
+	alertStatesMutex.Lock()
+	alertStates = make(map[string]*AlertState)
+	alertStatesMutex.Unlock()
+	LoadAlertStatesFromFile()
+
+	if st := ruleState(); st != StateFiring {
+		t.Fatalf("state after reload = %q, want firing", st)
+	}
+	// Still firing after the restart, so nothing is notified again
+	sampleCPU(95)
+	if events := ruleEvents(t, "cpu-web"); len(events) != 1 {
+		t.Errorf("events = %v, want only the firing from before the reload", events)
+	}
+}
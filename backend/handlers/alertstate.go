@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"dockscope/protocol"
+)
+
+// Alert states of one rule on one container. A condition goes pending when
+// it first holds, fires once it has held for the rule's `for` duration, and
+// resolves once it clears; only firing and resolving notify.
+const (
+	StateOK       = "ok"
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+const (
+	alertStateFile = "data/alert_state.json"
+
+	// States not evaluated for this long (container gone, host offline) are
+	// closed by sweepAlertStates; resolved ones are forgotten after an hour
+	alertStateStale     = 3 * monitorInterval
+	alertStateRetention = time.Hour
+)
+
+// AlertState tracks one rule on one container
+type AlertState struct {
+	RuleID      string    `json:"rule_id"`
+	HostID      string    `json:"host_id"`
+	ContainerID string    `json:"container_id"`
+	Type        string    `json:"type"`
+	State       string    `json:"state"`
+	Since       time.Time `json:"since"`                 // entered the current state
+	ActiveAt    time.Time `json:"active_at,omitempty"`   // condition started to hold
+	FiredAt     time.Time `json:"fired_at,omitempty"`    // last went firing
+	ResolvedAt  time.Time `json:"resolved_at,omitempty"` // last resolved
+	Value       float64   `json:"value"`
+	Message     string    `json:"message"`
+	LastEval    time.Time `json:"last_eval"`
+	SilenceID   string    `json:"silence_id,omitempty"` // silence that muted the firing
+	Source      string    `json:"source,omitempty"`     // "agent" when evaluated on the agent
+}
+
+var (
+	alertStates      = make(map[string]*AlertState)
+	alertStatesMutex = &sync.Mutex{}
+)
+
+func alertStateKey(ruleID, hostID, containerID string) string {
+	return ruleID + "|" + hostID + "|" + containerID
+}
+
+// observeAlert feeds one evaluation of a rule on a container into its state.
+// active means the condition holds; cleared means it is far enough back to
+// resolve a firing alert (hysteresis). A firing alert that is neither stays
+// firing.
+func observeAlert(rule AlertRule, hostID, containerID string, active, cleared bool, value float64, message string) {
+	now := time.Now()
+	key := alertStateKey(rule.ID, hostID, containerID)
+
+	alertStatesMutex.Lock()
+	st := alertStates[key]
+	if st == nil {
+		if !active {
+			alertStatesMutex.Unlock()
+			return
+		}
+		st = &AlertState{RuleID: rule.ID, HostID: hostID, ContainerID: containerID, Type: rule.Type, State: StateOK}
+		alertStates[key] = st
+	}
+	st.LastEval = now
+	st.Value = value
+
+	from := st.State
+	switch st.State {
+	case StateOK, StateResolved:
+		if active {
+			st.State, st.Since, st.ActiveAt = StatePending, now, now
+			st.Message = message
+			st.SilenceID = ""
+		}
+	case StateFiring:
+		if cleared {
+			st.State, st.Since, st.ResolvedAt = StateResolved, now, now
+		}
+	}
+	if st.State == StatePending {
+		switch {
+		case !active:
+			delete(alertStates, key) // cleared before it was due, nothing was sent
+		case now.Sub(st.ActiveAt) >= rule.forDuration():
+			st.State, st.Since, st.FiredAt = StateFiring, now, now
+			st.Message = message
+		}
+	}
+	to := st.State
+	if from == StatePending && alertStates[key] == nil {
+		to = StateOK
+	}
+	// A muted alert still firing when its silence ends is notified then
+	unsilenced := from == StateFiring && to == StateFiring && st.SilenceID != "" && !silenceOpen(st.SilenceID, now)
+	snapshot := *st
+	if from != to {
+		saveAlertStatesLocked()
+	}
+	alertStatesMutex.Unlock()
+
+	hostRule := rule
+	hostRule.HostID = hostID
+	hostRule.ContainerID = containerID
+	switch {
+	case from != to && to == StateFiring:
+		fireAlert(key, hostRule, message, snapshot.FiredAt)
+	case from != to && to == StateResolved:
+		resolveAlert(hostRule, snapshot.SilenceID, "Resolved: "+snapshot.Message, snapshot.ResolvedAt, true)
+	case unsilenced:
+		fireAlert(key, hostRule, snapshot.Message, now)
+	}
+}
+
+// fireAlert records a firing alert and notifies, unless a silence mutes it
+func fireAlert(key string, rule AlertRule, message string, at time.Time) {
+	silence, silenced := activeSilence(rule, at, nil)
+
+	alertStatesMutex.Lock()
+	if st := alertStates[key]; st != nil && st.State == StateFiring && st.SilenceID != silence.ID {
+		st.SilenceID = silence.ID
+		saveAlertStatesLocked()
+	}
+	alertStatesMutex.Unlock()
+
+	recordAlertEvent(rule, StateFiring, message, at, silence.ID)
+	if silenced {
+		logSilencedAlert(rule, silence.ID, message)
+		return
+	}
+	sendAlert(rule, message)
+}
+
+// resolveAlert records a resolved alert and, if asked to, notifies. Alerts
+// whose firing was muted, or that a silence covers now, resolve quietly.
+func resolveAlert(rule AlertRule, silenceID, message string, at time.Time, notify bool) {
+	if notify && silenceID == "" {
+		if silence, ok := activeSilence(rule, at, nil); ok {
+			silenceID = silence.ID
+		}
+	}
+	recordAlertEvent(rule, StateResolved, message, at, silenceID)
+	if !notify {
+		return
+	}
+	if silenceID != "" {
+		logSilencedAlert(rule, silenceID, message)
+		return
+	}
+	notifyAlert(rule, message)
+}
+
+// sweepAlertStates closes states no evaluation has touched lately. Log rules
+// on agents are only observed when a line matches, so for them a quiet period
+// means the condition cleared; anything else resolves without notifying,
+// since the container or host simply went away.
+func sweepAlertStates() {
+	now := time.Now()
+	offline := offlineHosts()
+	var closed []AlertState
+
+	alertStatesMutex.Lock()
+	changed := false
+	for key, st := range alertStates {
+		switch {
+		case st.Source == "agent":
+			// The agent reports its own transitions and history; firing
+			// alerts only close here once it is gone, or for log rules once
+			// matches stopped arriving
+			gone := offline[st.HostID] || (st.Type == LogPattern && now.Sub(st.LastEval) > alertStateStale)
+			if st.State == StateFiring && gone {
+				st.State, st.Since, st.ResolvedAt = StateResolved, now, now
+				changed = true
+			} else if st.State == StateResolved && now.Sub(st.Since) > alertStateRetention {
+				delete(alertStates, key)
+				changed = true
+			}
+		case st.State == StateResolved && now.Sub(st.Since) > alertStateRetention:
+			delete(alertStates, key)
+			changed = true
+		case st.State == StatePending && now.Sub(st.LastEval) > alertStateStale:
+			delete(alertStates, key)
+			changed = true
+		case st.State == StateFiring && now.Sub(st.LastEval) > alertStateStale:
+			st.State, st.Since, st.ResolvedAt = StateResolved, now, now
+			closed = append(closed, *st)
+			changed = true
+		}
+	}
+	if changed {
+		saveAlertStatesLocked()
+	}
+	alertStatesMutex.Unlock()
+
+	for _, st := range closed {
+		rule, ok := findAlertRule(st.RuleID)
+		if !ok {
+			continue
+		}
+		rule.HostID, rule.ContainerID = st.HostID, st.ContainerID
+		if st.Type == LogPattern {
+			resolveAlert(rule, st.SilenceID, "Resolved: "+st.Message, now, true)
+			continue
+		}
+		resolveAlert(rule, st.SilenceID, "No longer evaluated: "+st.Message, now, false)
+	}
+}
+
+// trackAgentAlert mirrors an alert evaluated on an agent into the alert
+// states, so /alerts/state lists it next to the master's own. The agent
+// decides the transitions; event rules fire one-off and have no state. It
+// reports whether the alert is a transition worth notifying: a state that
+// is already firing, or an older alert delivered late, is not.
+func trackAgentAlert(hostID string, a protocol.AgentAlert, silenceID string) bool {
+	if a.Type != HighCPU && a.Type != HighMemory && a.Type != LogPattern {
+		return true
+	}
+	key := alertStateKey(a.RuleID, hostID, a.ContainerID)
+
+	alertStatesMutex.Lock()
+	defer alertStatesMutex.Unlock()
+	st := alertStates[key]
+	if st != nil && a.FiredAt.Before(st.Since) {
+		return false
+	}
+	changed := false
+	if a.Resolved {
+		if st == nil || st.State != StateFiring {
+			return false
+		}
+		st.State, st.Since, st.ResolvedAt = StateResolved, a.FiredAt, a.FiredAt
+		changed = true
+	} else {
+		if st == nil {
+			st = &AlertState{RuleID: a.RuleID, HostID: hostID, ContainerID: a.ContainerID, Type: a.Type}
+			alertStates[key] = st
+		}
+		if st.State != StateFiring {
+			st.State, st.Since, st.ActiveAt, st.FiredAt = StateFiring, a.FiredAt, a.FiredAt, a.FiredAt
+			st.Message, st.SilenceID = a.Message, silenceID
+			changed = true
+		}
+		st.Value = a.Value
+	}
+	st.Source = "agent"
+	st.LastEval = time.Now()
+	saveAlertStatesLocked()
+	return changed
+}
+
+// forgetAlertStates drops the states of a deleted or disabled rule
+func forgetAlertStates(ruleID string) {
+	alertStatesMutex.Lock()
+	defer alertStatesMutex.Unlock()
+	changed := false
+	for key, st := range alertStates {
+		if st.RuleID == ruleID {
+			delete(alertStates, key)
+			changed = true
+		}
+	}
+	if changed {
+		saveAlertStatesLocked()
+	}
+}
+
+// recordAlertEvent adds a state transition to the alert history; silenceID
+// marks it suppressed
+func recordAlertEvent(rule AlertRule, state, message string, at time.Time, silenceID string) {
+	_, err := insertAlertEvent(AlertEvent{
+		AlertID:     rule.ID,
+		HostID:      rule.HostID,
+		ContainerID: rule.ContainerID,
+		Type:        rule.Type,
+		Message:     message,
+		Timestamp:   at,
+		State:       state,
+		Suppressed:  silenceID != "",
+		SilenceID:   silenceID,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to store alert event for rule %s: %v", rule.ID, err)
+	}
+}
+
+// saveAlertStatesLocked persists the states; callers hold alertStatesMutex
+func saveAlertStatesLocked() {
+	states := make([]*AlertState, 0, len(alertStates))
+	for _, st := range alertStates {
+		states = append(states, st)
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal alert states: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(alertStateFile), 0755); err != nil {
+		log.Printf("[ERROR] Failed to create data directory: %v", err)
+		return
+	}
+	if err := os.WriteFile(alertStateFile, data, 0644); err != nil {
+		log.Printf("[ERROR] Failed to write alert states: %v", err)
+	}
+}
+
+// LoadAlertStatesFromFile restores pending and firing alerts, so a restart
+// neither re-notifies firing alerts nor restarts `for` timers. Evaluation
+// times are reset so states get a full stale period to be re-evaluated.
+func LoadAlertStatesFromFile() {
+	data, err := os.ReadFile(alertStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Failed to read alert states: %v", err)
+		}
+		return
+	}
+	var states []*AlertState
+	if err := json.Unmarshal(data, &states); err != nil {
+		log.Printf("[ERROR] Failed to unmarshal alert states: %v", err)
+		return
+	}
+
+	now := time.Now()
+	alertStatesMutex.Lock()
+	for _, st := range states {
+		st.LastEval = now
+		alertStates[alertStateKey(st.RuleID, st.HostID, st.ContainerID)] = st
+	}
+	alertStatesMutex.Unlock()
+	log.Printf("Loaded %d alert states from %s", len(states), alertStateFile)
+}
+
+// ListAlertStatesHandler returns pending, firing and recently resolved alerts
+// (`?state=`, `?rule_id=`, `?host_id=`)
+func ListAlertStatesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	alertStatesMutex.Lock()
+	states := make([]AlertState, 0, len(alertStates))
+	for _, st := range alertStates {
+		if (q.Get("state") == "" || st.State == q.Get("state")) &&
+			(q.Get("rule_id") == "" || st.RuleID == q.Get("rule_id")) &&
+			(q.Get("host_id") == "" || st.HostID == q.Get("host_id")) {
+			states = append(states, *st)
+		}
+	}
+	alertStatesMutex.Unlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Since.After(states[j].Since) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"dockscope/actions"
+	"dockscope/backend/db"
+	"dockscope/protocol"
+)
+
+// Command lifecycle: queued → sent → succeeded | failed, or expired when the
+// agent never picks it up or never reports back.
+const (
+	CommandQueued  = "queued"
+	CommandSent    = "sent"
+	CommandExpired = "expired"
+
+	commandTTL = 10 * time.Minute
+)
+
+// ContainerCommand is a container action queued for a host
+type ContainerCommand struct {
+	ID          string              `json:"id"`
+	HostID      string              `json:"host_id"`
+	ContainerID string              `json:"container_id"`
+	Action      string              `json:"action"`
+	Status      string              `json:"status"`
+	RequestedBy string              `json:"requested_by,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+	Audit       []CommandAuditEntry `json:"audit,omitempty"`
+}
+
+// CommandAuditEntry records one status change of a command
+type CommandAuditEntry struct {
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// QueueContainerCommand stores a new command and dispatches it right away when
+// possible: locally for the master, over the stream for connected agents.
+func QueueContainerCommand(hostID, containerID, action, requestedBy string) (ContainerCommand, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return ContainerCommand{}, err
+	}
+
+	now := time.Now().UTC()
+	cmd := ContainerCommand{
+		ID:          id,
+		HostID:      hostID,
+		ContainerID: containerID,
+		Action:      action,
+		Status:      CommandQueued,
+		RequestedBy: requestedBy,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	_, err = db.DB.Exec(
+		`INSERT INTO container_commands(id, host_id, container_id, action, status, requested_by, error, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, '', ?, ?)`,
+		cmd.ID, cmd.HostID, cmd.ContainerID, cmd.Action, cmd.Status, cmd.RequestedBy,
+		now.Format(sqlTimeFormat), now.Format(sqlTimeFormat),
+	)
+	if err != nil {
+		return ContainerCommand{}, err
+	}
+	auditCommand(cmd.ID, CommandQueued, "requested by "+requestedBy)
+
+	log.Printf("%s[Command]%s %s queued: %s %s on host %s", ColorBlue, ColorReset, cmd.ID, cmd.Action, cmd.ContainerID, cmd.HostID)
+
+	if hostID == "master" {
+		setCommandStatus(cmd.ID, CommandSent, "", "executing on master")
+		go executeLocalCommand(cmd)
+	} else if AgentConnected(hostID) {
+		dispatchCommand(cmd)
+	}
+	return getCommand(cmd.ID)
+}
+
+// dispatchCommand pushes a queued command over the agent stream. The command
+// is claimed first, so a push racing a reconnect or poll sends it only once;
+// a failed push puts it back in the queue.
+func dispatchCommand(cmd ContainerCommand) {
+	if !claimCommand(cmd.ID, "pushed over agent stream") {
+		return
+	}
+	err := SendAgentCommand(cmd.HostID, protocol.Command{
+		ID:          cmd.ID,
+		Action:      cmd.Action,
+		ContainerID: cmd.ContainerID,
+	})
+	if err != nil {
+		log.Printf("Failed to push command %s to %s: %v", cmd.ID, cmd.HostID, err)
+		requeueCommand(cmd.ID, "push failed: "+err.Error())
+	}
+}
+
+// claimCommand moves a command from queued to sent; it reports false when
+// someone else already took it
+func claimCommand(id, message string) bool {
+	now := time.Now().UTC().Format(sqlTimeFormat)
+	res, err := db.DB.Exec(`UPDATE container_commands SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		CommandSent, now, id, CommandQueued)
+	if err != nil {
+		log.Printf("Failed to claim command %s: %v", id, err)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return false
+	}
+	auditCommand(id, CommandSent, message)
+	log.Printf("%s[Command]%s %s → %s %s", ColorBlue, ColorReset, id, CommandSent, message)
+	return true
+}
+
+// requeueCommand returns a claimed command that could not be delivered
+func requeueCommand(id, message string) {
+	now := time.Now().UTC().Format(sqlTimeFormat)
+	res, err := db.DB.Exec(`UPDATE container_commands SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		CommandQueued, now, id, CommandSent)
+	if err != nil {
+		log.Printf("Failed to requeue command %s: %v", id, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		auditCommand(id, CommandQueued, message)
+	}
+}
+
+// dispatchPendingCommands pushes every queued command once an agent (re)connects
+func dispatchPendingCommands(hostID string) {
+	expireStaleCommands()
+	pending, err := queryCommands("WHERE host_id = ? AND status = ? ORDER BY created_at", hostID, CommandQueued)
+	if err != nil {
+		log.Printf("Failed to load pending commands for %s: %v", hostID, err)
+		return
+	}
+	for _, cmd := range pending {
+		dispatchCommand(cmd)
+	}
+}
+
+func executeLocalCommand(cmd ContainerCommand) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		setCommandStatus(cmd.ID, protocol.CommandFailed, err.Error(), "Docker client error")
+		return
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if err := actions.Execute(ctx, cli, cmd.Action, cmd.ContainerID); err != nil {
+		setCommandStatus(cmd.ID, protocol.CommandFailed, err.Error(), "")
+		return
+	}
+	setCommandStatus(cmd.ID, protocol.CommandSucceeded, "", "")
+}
+
+// applyCommandResult records the outcome reported by an agent
+func applyCommandResult(result protocol.CommandResult) error {
+	cmd, err := getCommand(result.CommandID)
+	if err != nil {
+		return err
+	}
+	if cmd.HostID != result.HostID {
+		return errAgentHostMismatch
+	}
+	finishCommand(cmd.ID, result.Status, result.Error, "reported by agent")
+	return nil
+}
+
+// finishCommand records the outcome of a command still queued or sent. A
+// result arriving after the command expired or already finished, e.g. one
+// the agent resent, leaves it as it is.
+func finishCommand(id, status, errMsg, message string) {
+	now := time.Now().UTC().Format(sqlTimeFormat)
+	res, err := db.DB.Exec(`UPDATE container_commands SET status = ?, error = ?, updated_at = ? WHERE id = ? AND status IN (?, ?)`,
+		status, errMsg, now, id, CommandQueued, CommandSent)
+	if err != nil {
+		log.Printf("Failed to update command %s: %v", id, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		log.Printf("%s[Command]%s %s: already finished, ignoring %s", ColorBlue, ColorReset, id, status)
+		return
+	}
+	if errMsg != "" {
+		message = errMsg
+	}
+	auditCommand(id, status, message)
+	log.Printf("%s[Command]%s %s → %s %s", ColorBlue, ColorReset, id, status, message)
+}
+
+func setCommandStatus(id, status, errMsg, message string) {
+	now := time.Now().UTC().Format(sqlTimeFormat)
+	_, err := db.DB.Exec(`UPDATE container_commands SET status = ?, error = ?, updated_at = ? WHERE id = ?`, status, errMsg, now, id)
+	if err != nil {
+		log.Printf("Failed to update command %s: %v", id, err)
+		return
+	}
+	if errMsg != "" {
+		message = errMsg
+	}
+	auditCommand(id, status, message)
+	log.Printf("%s[Command]%s %s → %s %s", ColorBlue, ColorReset, id, status, message)
+}
+
+func auditCommand(id, status, message string) {
+	_, err := db.DB.Exec(
+		`INSERT INTO container_command_audit(command_id, status, message, timestamp) VALUES (?, ?, ?, ?)`,
+		id, status, message, time.Now().UTC().Format(sqlTimeFormat),
+	)
+	if err != nil {
+		log.Printf("Failed to audit command %s: %v", id, err)
+	}
+}
+
+// expireStaleCommands gives up on commands nobody picked up or reported back on
+func expireStaleCommands() {
+	cutoff := time.Now().Add(-commandTTL).UTC().Format(sqlTimeFormat)
+	stale, err := queryCommands("WHERE status IN (?, ?) AND updated_at < ?", CommandQueued, CommandSent, cutoff)
+	if err != nil {
+		return
+	}
+	for _, cmd := range stale {
+		finishCommand(cmd.ID, CommandExpired, "", "no result within "+commandTTL.String())
+	}
+}
+
+func queryCommands(where string, args ...any) ([]ContainerCommand, error) {
+	rows, err := db.DB.Query(`SELECT id, host_id, container_id, action, status, requested_by, error, created_at, updated_at
+		FROM container_commands `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []ContainerCommand{}
+	for rows.Next() {
+		var cmd ContainerCommand
+		var requestedBy, errMsg sql.NullString
+		var created, updated string
+		if err := rows.Scan(&cmd.ID, &cmd.HostID, &cmd.ContainerID, &cmd.Action, &cmd.Status, &requestedBy, &errMsg, &created, &updated); err != nil {
+			return nil, err
+		}
+		cmd.RequestedBy = requestedBy.String
+		cmd.Error = errMsg.String
+		cmd.CreatedAt, _ = time.Parse(time.RFC3339Nano, created) // the driver returns DATETIME columns as RFC 3339
+		cmd.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updated)
+		result = append(result, cmd)
+	}
+	return result, rows.Err()
+}
+
+func getCommand(id string) (ContainerCommand, error) {
+	cmds, err := queryCommands("WHERE id = ?", id)
+	if err != nil {
+		return ContainerCommand{}, err
+	}
+	if len(cmds) == 0 {
+		return ContainerCommand{}, sql.ErrNoRows
+	}
+	cmd := cmds[0]
+
+	rows, err := db.DB.Query(`SELECT status, message, timestamp FROM container_command_audit WHERE command_id = ? ORDER BY id`, id)
+	if err != nil {
+		return cmd, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry CommandAuditEntry
+		var message sql.NullString
+		var ts string
+		if err := rows.Scan(&entry.Status, &message, &ts); err != nil {
+			return cmd, err
+		}
+		entry.Message = message.String
+		entry.Timestamp, _ = time.Parse(time.RFC3339Nano, ts)
+		cmd.Audit = append(cmd.Audit, entry)
+	}
+	return cmd, rows.Err()
+}
+
+// CreateCommandHandler queues a container action for a host
+func CreateCommandHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		HostID      string `json:"host_id"`
+		ContainerID string `json:"container_id"`
+		Action      string `json:"action"`
+		RequestedBy string `json:"requested_by"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.HostID == "" || req.ContainerID == "" {
+		http.Error(w, "Missing host_id or container_id", http.StatusBadRequest)
+		return
+	}
+	if !protocol.IsContainerAction(req.Action) {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if req.RequestedBy == "" {
+		req.RequestedBy = r.RemoteAddr
+	}
+
+	cmd, err := QueueContainerCommand(req.HostID, req.ContainerID, req.Action, req.RequestedBy)
+	if err != nil {
+		log.Printf("Failed to queue command: %v", err)
+		http.Error(w, "Failed to queue command", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(cmd)
+}
+
+// ListCommandsHandler returns one command with its audit trail (?id=) or a
+// filtered list (host_id, container_id, status, limit), newest first
+func ListCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	expireStaleCommands()
+	q := r.URL.Query()
+
+	if id := q.Get("id"); id != "" {
+		cmd, err := getCommand(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Command not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load command", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cmd)
+		return
+	}
+
+	where := "WHERE 1=1"
+	var args []any
+	for _, f := range []string{"host_id", "container_id", "status"} {
+		if v := q.Get(f); v != "" {
+			where += " AND " + f + " = ?"
+			args = append(args, v)
+		}
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	where += " ORDER BY created_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	cmds, err := queryCommands(where, args...)
+	if err != nil {
+		log.Printf("Failed to list commands: %v", err)
+		http.Error(w, "Failed to list commands", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmds)
+}
+
+// AgentPollCommandsHandler hands queued commands to an agent using the HTTP transport
+func AgentPollCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	hostID := r.URL.Query().Get("host_id")
+	if hostID == "" {
+		http.Error(w, "Missing host_id", http.StatusBadRequest)
+		return
+	}
+	if err := authenticateAgent(r, hostID); err != nil {
+		rejectAgent(w, r, hostID, err)
+		return
+	}
+
+	expireStaleCommands()
+	pending, err := queryCommands("WHERE host_id = ? AND status = ? ORDER BY created_at", hostID, CommandQueued)
+	if err != nil {
+		http.Error(w, "Failed to load commands", http.StatusInternalServerError)
+		return
+	}
+
+	result := []protocol.Command{}
+	for _, cmd := range pending {
+		if claimCommand(cmd.ID, "picked up by agent poll") {
+			result = append(result, protocol.Command{ID: cmd.ID, Action: cmd.Action, ContainerID: cmd.ContainerID})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// ReceiveCommandResultHandler records a command outcome reported by an agent
+func ReceiveCommandResultHandler(w http.ResponseWriter, r *http.Request) {
+	var result protocol.CommandResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := result.Validate(); err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := authenticateAgent(r, result.HostID); err != nil {
+		rejectAgent(w, r, result.HostID, err)
+		return
+	}
+
+	if err := applyCommandResult(result); err != nil {
+		// A command of another host is not found for this one either; the
+		// agent drops results answered with 404 instead of resending them
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, errAgentHostMismatch) {
+			http.Error(w, "Command not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to record result of command %s: %v", result.CommandID, err)
+		http.Error(w, "Failed to record result", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dockscope/protocol"
+)
+
+func TestCommandResultOnlyFinishesOpenCommands(t *testing.T) {
+	useTempData(t)
+
+	cmd, err := QueueContainerCommand("h1", "abc123", protocol.CommandRestart, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finishCommand(cmd.ID, CommandExpired, "", "no result in time")
+
+	late := protocol.CommandResult{Version: protocol.Version, HostID: "h1", CommandID: cmd.ID, Status: protocol.CommandSucceeded}
+	if err := applyCommandResult(late); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := getCommand(cmd.ID); got.Status != CommandExpired {
+		t.Errorf("status = %s after a late result, want %s", got.Status, CommandExpired)
+	}
+
+	cmd, _ = QueueContainerCommand("h1", "abc123", protocol.CommandRestart, "test")
+	applyCommandResult(protocol.CommandResult{Version: protocol.Version, HostID: "h1", CommandID: cmd.ID, Status: protocol.CommandFailed, Error: "boom"})
+	applyCommandResult(protocol.CommandResult{Version: protocol.Version, HostID: "h1", CommandID: cmd.ID, Status: protocol.CommandSucceeded})
+	if got, _ := getCommand(cmd.ID); got.Status != protocol.CommandFailed || got.Error != "boom" {
+		t.Errorf("command = %s %q, want the first result kept", got.Status, got.Error)
+	}
+}
+
+func TestCommandResultOfOtherHostNotFound(t *testing.T) {
+	useTempData(t)
+	agentTokensMutex.Lock()
+	agentTokens = []AgentToken{{ID: "t1", HostID: "h1", Hash: hashAgentToken("secret")}}
+	agentTokensMutex.Unlock()
+	t.Cleanup(func() {
+		agentTokensMutex.Lock()
+		agentTokens = nil
+		agentTokensMutex.Unlock()
+	})
+
+	cmd, err := QueueContainerCommand("h2", "abc123", protocol.CommandRestart, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{cmd.ID, "unknown"} {
+		req := httptest.NewRequest(http.MethodPost, "/agent/commands/result",
+			strings.NewReader(`{"version":2,"host_id":"h1","command_id":"`+id+`","status":"succeeded"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		ReceiveCommandResultHandler(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("result for %s: status = %d (%s), want 404", id, rec.Code, rec.Body.String())
+		}
+	}
+	if got, _ := getCommand(cmd.ID); got.Status != CommandQueued {
+		t.Errorf("status = %s, want still %s", got.Status, CommandQueued)
+	}
+}
@@ -30,10 +30,11 @@ func ListContainersHandler(w http.ResponseWriter, r *http.Request) {
 	nameFilter := strings.ToLower(r.URL.Query().Get("name"))
 	imageFilter := strings.ToLower(r.URL.Query().Get("image"))
 	labelFilter := strings.ToLower(r.URL.Query().Get("label"))
+	groupFilter := r.URL.Query().Get("group") // dockscope.group, agent containers only
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
-	sortBy := r.URL.Query().Get("sort_by")   // name, cpu, memory
-	order := r.URL.Query().Get("order")      // asc or desc
+	sortBy := r.URL.Query().Get("sort_by") // name, cpu, memory
+	order := r.URL.Query().Get("order")    // asc or desc
 
 	var results []ContainerInfo
 
@@ -53,12 +54,16 @@ func ListContainersHandler(w http.ResponseWriter, r *http.Request) {
 			Image:  c.Image,
 			HostID: "master",
 		}
+		if groupFilter != "" {
+			continue
+		}
 		if matchesFilters(info, hostIDsFilter, nameFilter, imageFilter, labelFilter) {
 			results = append(results, info)
 		}
 	}
 
 	// --- Agent containers ---
+	stale := staleHosts()
 	alertsMutex.RLock()
 	for hostID, containers := range agentMetrics {
 		for _, c := range containers {
@@ -70,6 +75,11 @@ func ListContainersHandler(w http.ResponseWriter, r *http.Request) {
 				MemoryMB:   c.MemoryMB,
 				Logs:       c.Logs,
 				HostID:     hostID,
+				Group:      c.Group,
+				Stale:      stale[hostID],
+			}
+			if groupFilter != "" && !strings.EqualFold(info.Group, groupFilter) {
+				continue
 			}
 			if matchesFilters(info, hostIDsFilter, nameFilter, imageFilter, labelFilter) {
 				results = append(results, info)
@@ -144,4 +154,3 @@ func contains(list []string, item string) bool {
 	}
 	return false
 }
-
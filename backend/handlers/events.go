@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"dockscope/backend/db"
+	"dockscope/events"
+	"dockscope/protocol"
+)
+
+// Fixed-width UTC timestamps so SQLite can compare them as strings
+const sqlTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// ContainerEventRecord is a stored lifecycle event
+type ContainerEventRecord struct {
+	ID     int64  `json:"id"`
+	HostID string `json:"host_id"`
+	protocol.ContainerEvent
+}
+
+// StartEventWatcher follows the master's local Docker daemon events
+func StartEventWatcher() {
+	go func() {
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			log.Printf("Event watcher: Docker client error: %v", err)
+			return
+		}
+		defer cli.Close()
+
+		events.Watch(context.Background(), cli, func(ev protocol.ContainerEvent) {
+			RecordContainerEvent("master", ev)
+		})
+	}()
+}
+
+// RecordContainerEvent stores an event in the timeline and hands it to the alert engine
+func RecordContainerEvent(hostID string, ev protocol.ContainerEvent) {
+	_, err := db.DB.Exec(
+		`INSERT INTO container_events(host_id, container_id, name, image, action, status, exit_code, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		hostID, ev.ContainerID, ev.Name, ev.Image, ev.Action, ev.Status, ev.ExitCode,
+		ev.Timestamp.UTC().Format(sqlTimeFormat),
+	)
+	if err != nil {
+		log.Printf("❌ Failed to store container event for %s: %v", ev.ContainerID, err)
+	}
+
+	log.Printf("%s[Event]%s Host: %s | Container: %s | %s %s", ColorBlue, ColorReset, hostID, ev.Name, ev.Action, ev.Status)
+
+	checkEventRules(hostID, ev)
+}
+
+// ReceiveAgentEventsHandler stores container events pushed by agents
+func ReceiveAgentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	payload, err := protocol.DecodeEventPayload(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := authenticateAgent(r, payload.HostID); err != nil {
+		rejectAgent(w, r, payload.HostID, err)
+		return
+	}
+
+	for _, ev := range payload.Events {
+		RecordContainerEvent(payload.HostID, ev)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// ListContainerEventsHandler returns the event timeline, newest first.
+// Filters: host_id, container_id (prefix), action (comma-separated), since, until (RFC3339), limit.
+func ListContainerEventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	query := `SELECT id, host_id, container_id, name, image, action, status, exit_code, timestamp FROM container_events WHERE 1=1`
+	var args []any
+
+	if hostID := q.Get("host_id"); hostID != "" {
+		query += " AND host_id = ?"
+		args = append(args, hostID)
+	}
+	if containerID := q.Get("container_id"); containerID != "" {
+		query += " AND container_id LIKE ?"
+		args = append(args, containerID+"%")
+	}
+	if actions := q.Get("action"); actions != "" {
+		list := strings.Split(actions, ",")
+		query += " AND action IN (?" + strings.Repeat(", ?", len(list)-1) + ")"
+		for _, a := range list {
+			args = append(args, strings.TrimSpace(a))
+		}
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<="}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid '"+bound.param+"' time format", http.StatusBadRequest)
+			return
+		}
+		query += " AND timestamp " + bound.op + " ?"
+		args = append(args, t.UTC().Format(sqlTimeFormat))
+	}
+
+	limit := 200
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to query container events: %v", err)
+		http.Error(w, "Failed to query events", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := []ContainerEventRecord{}
+	for rows.Next() {
+		var rec ContainerEventRecord
+		var ts string
+		if err := rows.Scan(&rec.ID, &rec.HostID, &rec.ContainerID, &rec.Name, &rec.Image, &rec.Action, &rec.Status, &rec.ExitCode, &ts); err != nil {
+			log.Printf("Failed to scan container event: %v", err)
+			continue
+		}
+		rec.Timestamp, _ = time.Parse(time.RFC3339Nano, ts) // the driver returns DATETIME columns as RFC 3339
+		result = append(result, rec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"dockscope/backend/db"
+	"dockscope/protocol"
+)
+
+// HostInfo is one entry of the host inventory
+type HostInfo struct {
+	HostID        string    `json:"host_id"`
+	Hostname      string    `json:"hostname"`
+	OS            string    `json:"os"`
+	Kernel        string    `json:"kernel"`
+	Arch          string    `json:"arch"`
+	DockerVersion string    `json:"docker_version"`
+	CPUs          int       `json:"cpus"`
+	MemoryBytes   uint64    `json:"memory_bytes"`
+	AgentVersion  string    `json:"agent_version"`
+	RemoteAddr    string    `json:"remote_addr"`
+	RegisteredAt  time.Time `json:"registered_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	LastSeen   *time.Time `json:"last_seen"`
+	Status     string     `json:"status"` // online, stale or offline
+	Containers int        `json:"containers"`
+	Connected  bool       `json:"connected"` // holds a WebSocket stream
+
+	// Agent is the self-telemetry from the host's latest payload
+	Agent *protocol.AgentStatus `json:"agent,omitempty"`
+}
+
+// Host liveness, from the time of the last payload received from its agent
+const (
+	HostOnline  = "online"
+	HostStale   = "stale"
+	HostOffline = "offline"
+
+	defaultHostStaleAfter   = 30 * time.Second
+	defaultHostOfflineAfter = 5 * time.Minute
+)
+
+var (
+	hostLastSeen = make(map[string]time.Time)
+	hostsMutex   = &sync.Mutex{}
+	hostEvicted  = make(map[string]bool)
+	hostAgents   = make(map[string]*protocol.AgentStatus)
+)
+
+// hostThresholds returns HOST_STALE_AFTER and HOST_OFFLINE_AFTER
+func hostThresholds() (stale, offline time.Duration) {
+	stale, offline = defaultHostStaleAfter, defaultHostOfflineAfter
+	if d, err := time.ParseDuration(os.Getenv("HOST_STALE_AFTER")); err == nil && d > 0 {
+		stale = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("HOST_OFFLINE_AFTER")); err == nil && d > stale {
+		offline = d
+	}
+	return stale, offline
+}
+
+func hostStatus(lastSeen time.Time) string {
+	stale, offline := hostThresholds()
+	age := time.Since(lastSeen)
+	switch {
+	case lastSeen.IsZero() || age > offline:
+		return HostOffline
+	case age > stale:
+		return HostStale
+	}
+	return HostOnline
+}
+
+// staleHosts returns the hosts whose agent has missed recent heartbeats
+func staleHosts() map[string]bool {
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	stale := make(map[string]bool)
+	for hostID, lastSeen := range hostLastSeen {
+		if hostStatus(lastSeen) == HostStale {
+			stale[hostID] = true
+		}
+	}
+	return stale
+}
+
+// offlineHosts returns the hosts whose agent is considered gone
+func offlineHosts() map[string]bool {
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	offline := make(map[string]bool)
+	for hostID, lastSeen := range hostLastSeen {
+		if hostStatus(lastSeen) == HostOffline {
+			offline[hostID] = true
+		}
+	}
+	return offline
+}
+
+// touchHost records a heartbeat; hosts whose agent never registered are
+// added to the inventory on first contact
+func touchHost(hostID, remoteAddr string) {
+	now := time.Now().UTC()
+
+	hostsMutex.Lock()
+	hostLastSeen[hostID] = now
+	delete(hostEvicted, hostID)
+	hostsMutex.Unlock()
+
+	ts := now.Format(sqlTimeFormat)
+	_, err := db.DB.Exec(`
+		INSERT INTO hosts(host_id, remote_addr, registered_at, updated_at, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(host_id) DO UPDATE SET last_seen = excluded.last_seen, remote_addr = excluded.remote_addr`,
+		hostID, remoteAddr, ts, ts, ts,
+	)
+	if err != nil {
+		log.Printf("Failed to record heartbeat for %s: %v", hostID, err)
+	}
+}
+
+// recordAgentStatus keeps the self-telemetry an agent sent with its latest payload
+func recordAgentStatus(hostID string, st *protocol.AgentStatus) {
+	hostsMutex.Lock()
+	prev := hostAgents[hostID]
+	hostAgents[hostID] = st
+	hostsMutex.Unlock()
+
+	// An agent that just started evaluating rules locally now gets the
+	// notification targets; agents on the HTTP transport poll for them
+	if st.AlertRulesRevision != "" && (prev == nil || prev.AlertRulesRevision == "") {
+		go pushAlertRules(hostID)
+	}
+
+	// Only log errors the master has not seen yet
+	if st.LastErrorAt != nil && (prev == nil || prev.LastErrorAt == nil || st.LastErrorAt.After(*prev.LastErrorAt)) {
+		log.Printf("%s[Agent Status]%s Host %s last error: %s", ColorYellow, ColorReset, hostID, st.LastError)
+	}
+}
+
+// LoadHostsFromDB restores heartbeats so liveness survives a master restart
+func LoadHostsFromDB() {
+	rows, err := db.DB.Query(`SELECT host_id, last_seen, api_url FROM hosts`)
+	if err != nil {
+		log.Printf("Failed to load hosts: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	hostsMutex.Lock()
+	defer hostsMutex.Unlock()
+	agentAPIMutex.Lock()
+	defer agentAPIMutex.Unlock()
+	for rows.Next() {
+		var hostID string
+		var lastSeen, apiURL sql.NullString
+		if err := rows.Scan(&hostID, &lastSeen, &apiURL); err != nil {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, lastSeen.String); err == nil {
+			hostLastSeen[hostID] = t
+		}
+		if apiURL.Valid && validateAgentAPIURL(apiURL.String) == nil {
+			agentAPIURLs[hostID] = apiURL.String
+		}
+	}
+}
+
+// StartHostMonitor periodically evicts the container snapshot of offline
+// hosts so they drop out of /containers and resource alerts
+func StartHostMonitor() {
+	go func() {
+		for {
+			time.Sleep(15 * time.Second)
+			evictOfflineHosts()
+		}
+	}()
+}
+
+func evictOfflineHosts() {
+	hostsMutex.Lock()
+	var offline []string
+	for hostID, lastSeen := range hostLastSeen {
+		if !hostEvicted[hostID] && hostStatus(lastSeen) == HostOffline {
+			hostEvicted[hostID] = true
+			offline = append(offline, hostID)
+		}
+	}
+	hostsMutex.Unlock()
+
+	for _, hostID := range offline {
+		alertsMutex.Lock()
+		delete(agentMetrics, hostID)
+		alertsMutex.Unlock()
+		log.Printf("%s[Host]%s %s is offline, evicted its container snapshot", ColorYellow, ColorReset, hostID)
+	}
+}
+
+// registerHost adds a host to the inventory or refreshes its details. The
+// first registration time is kept.
+func registerHost(reg protocol.Registration, remoteAddr string) error {
+	now := time.Now().UTC().Format(sqlTimeFormat)
+	_, err := db.DB.Exec(`
+		INSERT INTO hosts(host_id, hostname, os, kernel, arch, docker_version, cpus, memory_bytes, agent_version, remote_addr, registered_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(host_id) DO UPDATE SET
+			hostname = excluded.hostname,
+			os = excluded.os,
+			kernel = excluded.kernel,
+			arch = excluded.arch,
+			docker_version = excluded.docker_version,
+			cpus = excluded.cpus,
+			memory_bytes = excluded.memory_bytes,
+			agent_version = excluded.agent_version,
+			remote_addr = excluded.remote_addr,
+			updated_at = excluded.updated_at`,
+		reg.HostID, reg.Hostname, reg.OS, reg.Kernel, reg.Arch, reg.DockerVersion,
+		reg.CPUs, reg.MemoryBytes, reg.AgentVersion, remoteAddr, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	touchHost(reg.HostID, remoteAddr)
+
+	log.Printf("%s[Host]%s Registered %s (%s, %s, kernel %s, Docker %s, %d CPUs, agent %s)",
+		ColorGreen, ColorReset, reg.HostID, reg.Hostname, reg.OS, reg.Kernel, reg.DockerVersion, reg.CPUs, reg.AgentVersion)
+	return nil
+}
+
+// RegisterAgentHandler records the details an agent sends on startup
+func RegisterAgentHandler(w http.ResponseWriter, r *http.Request) {
+	reg, err := protocol.DecodeRegistration(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := authenticateAgent(r, reg.HostID); err != nil {
+		rejectAgent(w, r, reg.HostID, err)
+		return
+	}
+
+	if err := registerHost(reg, r.RemoteAddr); err != nil {
+		log.Printf("Failed to register host %s: %v", reg.HostID, err)
+		http.Error(w, "Failed to register host", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func queryHosts(where string, args ...any) ([]HostInfo, error) {
+	rows, err := db.DB.Query(`SELECT host_id, hostname, os, kernel, arch, docker_version, cpus, memory_bytes,
+		agent_version, remote_addr, registered_at, updated_at FROM hosts `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hosts := []HostInfo{}
+	for rows.Next() {
+		var h HostInfo
+		var hostname, osName, kernel, arch, dockerVersion, agentVersion, remoteAddr sql.NullString
+		var cpus, memory sql.NullInt64
+		var registered, updated string
+		err := rows.Scan(&h.HostID, &hostname, &osName, &kernel, &arch, &dockerVersion, &cpus, &memory,
+			&agentVersion, &remoteAddr, &registered, &updated)
+		if err != nil {
+			return nil, err
+		}
+		h.Hostname, h.OS, h.Kernel, h.Arch = hostname.String, osName.String, kernel.String, arch.String
+		h.DockerVersion, h.AgentVersion, h.RemoteAddr = dockerVersion.String, agentVersion.String, remoteAddr.String
+		h.CPUs, h.MemoryBytes = int(cpus.Int64), uint64(memory.Int64)
+		h.RegisteredAt, _ = time.Parse(time.RFC3339Nano, registered) // the driver returns DATETIME columns as RFC 3339
+		h.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updated)
+		hosts = append(hosts, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Liveness and container counts live in memory
+	hostsMutex.Lock()
+	alertsMutex.RLock()
+	for i := range hosts {
+		h := &hosts[i]
+		if t, ok := hostLastSeen[h.HostID]; ok {
+			t := t
+			h.LastSeen = &t
+			h.Status = hostStatus(t)
+		} else {
+			h.Status = HostOffline
+		}
+		h.Containers = len(agentMetrics[h.HostID])
+		h.Agent = hostAgents[h.HostID]
+	}
+	alertsMutex.RUnlock()
+	hostsMutex.Unlock()
+
+	for i := range hosts {
+		hosts[i].Connected = AgentConnected(hosts[i].HostID)
+	}
+	return hosts, nil
+}
+
+// ListHostsHandler returns the host inventory with liveness (?id= for one
+// host, ?status= to filter)
+func ListHostsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	if id := q.Get("id"); id != "" {
+		hosts, err := queryHosts("WHERE host_id = ?", id)
+		if err != nil {
+			http.Error(w, "Failed to load host", http.StatusInternalServerError)
+			return
+		}
+		if len(hosts) == 0 {
+			http.Error(w, "Host not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hosts[0])
+		return
+	}
+
+	hosts, err := queryHosts("ORDER BY host_id")
+	if err != nil {
+		log.Printf("Failed to list hosts: %v", err)
+		http.Error(w, "Failed to list hosts", http.StatusInternalServerError)
+		return
+	}
+	if status := q.Get("status"); status != "" {
+		filtered := []HostInfo{}
+		for _, h := range hosts {
+			if h.Status == status {
+				filtered = append(filtered, h)
+			}
+		}
+		hosts = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
+
+// DeleteHostHandler removes a host from the inventory along with its live
+// data and stream. Its tokens stay valid; revoke them through /admin/tokens.
+func DeleteHostHandler(w http.ResponseWriter, r *http.Request) {
+	hostID := r.URL.Query().Get("id")
+	if hostID == "" {
+		http.Error(w, "Missing host ID", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.DB.Exec(`DELETE FROM hosts WHERE host_id = ?`, hostID)
+	if err != nil {
+		http.Error(w, "Failed to delete host", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Host not found", http.StatusNotFound)
+		return
+	}
+
+	hostsMutex.Lock()
+	delete(hostLastSeen, hostID)
+	delete(hostEvicted, hostID)
+	delete(hostAgents, hostID)
+	hostsMutex.Unlock()
+
+	alertsMutex.Lock()
+	delete(agentMetrics, hostID)
+	delete(agentMetricsUpdated, hostID)
+	alertsMutex.Unlock()
+
+	agentAPIMutex.Lock()
+	delete(agentAPIURLs, hostID)
+	agentAPIMutex.Unlock()
+
+	agentConnsMutex.Lock()
+	if c := agentConns[hostID]; c != nil {
+		c.conn.Close()
+	}
+	agentConnsMutex.Unlock()
+
+	log.Printf("%s[Host]%s Removed %s", ColorYellow, ColorReset, hostID)
+	w.WriteHeader(http.StatusNoContent)
+}
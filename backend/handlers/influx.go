@@ -7,6 +7,9 @@ import (
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+
+	"dockscope/protocol"
 )
 
 var influxClient influxdb2.Client
@@ -45,6 +48,108 @@ func WriteMetricToInflux(hostID, containerID, name, image string, cpu float64, m
 	return err
 }
 
+// WriteAgentMetricToInflux writes the full agent sample into the same
+// container_metrics measurement as WriteMetricToInflux
+func WriteAgentMetricToInflux(hostID string, c protocol.ContainerMetrics, ts time.Time) error {
+	point := influxdb2.NewPointWithMeasurement("container_metrics").
+		AddTag("host_id", hostID).
+		AddTag("container_id", c.ID).
+		AddTag("name", c.Name).
+		AddTag("image", c.Image).
+		AddField("cpu", c.CPUPercent).
+		AddField("memory", c.MemoryMB).
+		AddField("restart_count", c.RestartCount).
+		AddField("memory_limit", c.MemoryLimitMB).
+		AddField("memory_percent", c.MemoryPercent).
+		AddField("network_rx", c.NetRxBytes).
+		AddField("network_tx", c.NetTxBytes).
+		AddField("disk_read", c.DiskReadBytes).
+		AddField("disk_write", c.DiskWriteBytes).
+		AddField("pids", c.PIDs).
+		AddField("uptime_seconds", c.UptimeSeconds).
+		SetTime(ts)
+	if c.Health != "" {
+		point.AddField("health", c.Health)
+	}
+	if c.Group != "" {
+		point.AddTag("group", c.Group)
+	}
+
+	err := writeAPI.WritePoint(context.Background(), point)
+	if err != nil {
+		fmt.Printf("❌ Failed to write metric to InfluxDB (container %s): %v\n", c.ID, err)
+	}
+	return err
+}
+
+// WriteAgentCollectionToInflux records how long an agent's collection cycle took
+func WriteAgentCollectionToInflux(hostID string, durationMs float64, containers, skipped int, ts time.Time) error {
+	point := influxdb2.NewPointWithMeasurement("agent_collection").
+		AddTag("host_id", hostID).
+		AddField("duration_ms", durationMs).
+		AddField("containers", containers).
+		AddField("skipped", skipped).
+		SetTime(ts)
+
+	err := writeAPI.WritePoint(context.Background(), point)
+	if err != nil {
+		fmt.Printf("❌ Failed to write collection stats to InfluxDB (host %s): %v\n", hostID, err)
+	}
+	return err
+}
+
+// WriteHostMetricsToInflux writes node metrics reported by an agent to the
+// host_metrics measurement: one point for the node, one per filesystem
+// (tagged mount) and one per network interface (tagged interface)
+func WriteHostMetricsToInflux(hostID string, h *protocol.HostMetrics, ts time.Time) error {
+	points := []*write.Point{
+		influxdb2.NewPointWithMeasurement("host_metrics").
+			AddTag("host_id", hostID).
+			AddField("cpu", h.CPUPercent).
+			AddField("cpus", h.CPUs).
+			AddField("load1", h.Load1).
+			AddField("load5", h.Load5).
+			AddField("load15", h.Load15).
+			AddField("memory_total", h.MemoryTotalBytes).
+			AddField("memory_available", h.MemoryAvailableBytes).
+			AddField("swap_total", h.SwapTotalBytes).
+			AddField("swap_used", h.SwapTotalBytes-h.SwapFreeBytes).
+			SetTime(ts),
+	}
+	for _, fs := range h.Filesystems {
+		points = append(points, influxdb2.NewPointWithMeasurement("host_metrics").
+			AddTag("host_id", hostID).
+			AddTag("mount", fs.Mount).
+			AddTag("device", fs.Device).
+			AddTag("fstype", fs.Type).
+			AddField("fs_total", fs.TotalBytes).
+			AddField("fs_used", fs.UsedBytes).
+			AddField("fs_free", fs.FreeBytes).
+			AddField("fs_used_percent", fs.UsedPercent).
+			SetTime(ts))
+	}
+	for _, iface := range h.Interfaces {
+		points = append(points, influxdb2.NewPointWithMeasurement("host_metrics").
+			AddTag("host_id", hostID).
+			AddTag("interface", iface.Name).
+			AddField("net_rx_bytes", iface.RxBytes).
+			AddField("net_tx_bytes", iface.TxBytes).
+			AddField("net_rx_packets", iface.RxPackets).
+			AddField("net_tx_packets", iface.TxPackets).
+			AddField("net_rx_errors", iface.RxErrors).
+			AddField("net_tx_errors", iface.TxErrors).
+			AddField("net_rx_dropped", iface.RxDropped).
+			AddField("net_tx_dropped", iface.TxDropped).
+			SetTime(ts))
+	}
+
+	err := writeAPI.WritePoint(context.Background(), points...)
+	if err != nil {
+		fmt.Printf("❌ Failed to write host metrics to InfluxDB (host %s): %v\n", hostID, err)
+	}
+	return err
+}
+
 func WriteLogToInflux(hostID, containerID, level, logLine string, ts time.Time) error {
 	point := influxdb2.NewPointWithMeasurement("container_logs").
 		AddTag("host_id", hostID).
@@ -62,8 +167,6 @@ func WriteLogToInflux(hostID, containerID, level, logLine string, ts time.Time)
 	return err
 }
 
-
-
 func QueryAverageMetric(metricType, containerID, hostID string, duration time.Duration) (float64, error) {
 	queryAPI := influxClient.QueryAPI(influxOrg)
 
@@ -100,4 +203,3 @@ func QueryAverageMetric(metricType, containerID, hostID string, duration time.Du
 
 	return 0, fmt.Errorf("no data found for container %s", containerID)
 }
-
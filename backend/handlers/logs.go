@@ -1,19 +1,17 @@
 package handlers
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"time"
-	"bufio"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	"github.com/gorilla/websocket"
-
 )
 
 // GetContainerLogsHandler returns recent logs for a container (last 500 lines).
@@ -64,12 +62,14 @@ func GetContainerLogsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	ctx := r.Context()
+	cli, err := containerBackendFor(r.URL.Query().Get("host_id"))
 	if err != nil {
+		log.Printf("Logs: %v", err)
 		http.Error(w, "Could not connect to Docker daemon", http.StatusInternalServerError)
 		return
 	}
+	defer cli.Close()
 
 	options := types.ContainerLogsOptions{
 		ShowStdout: true,
@@ -136,7 +136,6 @@ func GetContainerLogsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-
 // Upgrader for WebSocket connections
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
@@ -159,11 +158,13 @@ func WSLogsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := containerBackendFor(r.URL.Query().Get("host_id"))
 	if err != nil {
+		log.Printf("WS logs: %v", err)
 		conn.WriteMessage(websocket.TextMessage, []byte("Docker client error"))
 		return
 	}
+	defer cli.Close()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -257,7 +258,7 @@ func SearchLogsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(logs)
 }
-	*/
+*/
 
 func sanitizeLog(raw string) string {
 	if len(raw) >= 8 && (raw[0] < 32) {
@@ -265,4 +266,3 @@ func sanitizeLog(raw string) string {
 	}
 	return raw
 }
-
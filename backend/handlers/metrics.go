@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	"github.com/gorilla/websocket"
 )
 
@@ -64,12 +63,13 @@ func GetContainerMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		hostID = "master"
 	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := containerBackendFor(hostID)
 	if err != nil {
 		log.Println(ColorRed, "[ERROR] Docker client error:", err, ColorReset)
 		http.Error(w, "Docker client error", http.StatusInternalServerError)
 		return
 	}
+	defer cli.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -119,22 +119,24 @@ func GetContainerMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s[Metrics]%s Host: %s | Container: %s | CPU: %.2f%% | MEM: %.2fMB | Uptime: %s",
 		ColorBlue, ColorReset, hostID, info.Name, cpuPercent, memUsage, uptime)
 
-	// Push to InfluxDB
-	go func() {
-		err := WriteMetricToInflux(
-			hostID,
-			containerID,
-			info.Name,
-			info.Config.Image,
-			cpuPercent,
-			memUsage,
-			info.RestartCount,
-			time.Now().UTC(),
-		)
-		if err != nil {
-			log.Println(ColorRed, "[Influx ERROR] Failed to write metrics:", err, ColorReset)
-		}
-	}()
+	// Push to InfluxDB; agents already pushed their own samples
+	if hostID == "master" {
+		go func() {
+			err := WriteMetricToInflux(
+				hostID,
+				containerID,
+				info.Name,
+				info.Config.Image,
+				cpuPercent,
+				memUsage,
+				info.RestartCount,
+				time.Now().UTC(),
+			)
+			if err != nil {
+				log.Println(ColorRed, "[Influx ERROR] Failed to write metrics:", err, ColorReset)
+			}
+		}()
+	}
 
 	resp := ContainerMetrics{
 		ID:            containerID,
@@ -189,11 +191,12 @@ func WSContainerMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	defer conn.Close()
 
 	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	cli, err := containerBackendFor(hostID)
 	if err != nil {
 		log.Println(ColorRed, "[ERROR] Docker client error:", err, ColorReset)
 		return
 	}
+	defer cli.Close()
 
 	info, err := cli.ContainerInspect(ctx, containerID)
 	if err != nil {
@@ -284,4 +287,3 @@ func WSContainerMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(2 * time.Second)
 	}
 }
-
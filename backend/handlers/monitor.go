@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
 )
 
 // StartMonitoring starts background monitoring
@@ -20,13 +23,21 @@ func StartMonitoring() {
 	go monitorLoop()
 }
 
+// monitorInterval is how often resource and master log rules are evaluated
+const monitorInterval = 10 * time.Second
+
 func monitorLoop() {
 	for {
 		checkAllAlerts()
-		time.Sleep(10 * time.Second) // Polling interval
+		sweepAlertStates()
+		pruneSilences()
+		time.Sleep(monitorInterval)
 	}
 }
 
+// checkAllAlerts runs the scheduled rules. Event rules fire from the events
+// stream and agent log rules as logs arrive, so only resource and master log
+// rules are polled here.
 func checkAllAlerts() {
 	alertsMutex.RLock()
 	rulesCopy := make([]AlertRule, len(alertRules))
@@ -42,12 +53,27 @@ func checkAllAlerts() {
 		case HighCPU, HighMemory:
 			checkContainerResource(rule)
 		case LogPattern:
-			checkLogPattern(rule)
+			if rule.HostID == "" || rule.HostID == "master" {
+				checkLogPattern(rule)
+			}
 		}
 	}
 }
 
+// checkContainerResource evaluates a resource rule on agent containers
+// against their latest pushed sample, and on the master's own containers
+// through Docker. A rule without a host is looked up on the agents first.
 func checkContainerResource(rule AlertRule) {
+	if rule.HostID == "master" {
+		checkMasterContainerResource(rule)
+		return
+	}
+	if found := checkAgentContainerResource(rule); !found && rule.HostID == "" {
+		checkMasterContainerResource(rule)
+	}
+}
+
+func checkMasterContainerResource(rule AlertRule) {
 	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
@@ -72,11 +98,89 @@ func checkContainerResource(rule AlertRule) {
 	cpuPercent := calculateCPUPercent(containerStats)
 	memUsage := float64(containerStats.MemoryStats.Usage) / (1024 * 1024) // in MB
 
-	if rule.Type == HighCPU && cpuPercent > rule.Threshold {
-		sendAlert(rule, "High CPU usage: "+strconv.FormatFloat(cpuPercent, 'f', 2, 64)+"%")
+	observeResource(rule, "master", rule.ContainerID, cpuPercent, memUsage)
+}
+
+// observeResource feeds one CPU/memory sample into the rule's alert state
+func observeResource(rule AlertRule, hostID, containerID string, cpuPercent, memoryMB float64) {
+	value, message := cpuPercent, "High CPU usage: "+strconv.FormatFloat(cpuPercent, 'f', 2, 64)+"%"
+	if rule.Type == HighMemory {
+		value, message = memoryMB, "High Memory usage: "+strconv.FormatFloat(memoryMB, 'f', 2, 64)+" MB"
 	}
-	if rule.Type == HighMemory && memUsage > rule.Threshold {
-		sendAlert(rule, "High Memory usage: "+strconv.FormatFloat(memUsage, 'f', 2, 64)+" MB")
+	observeAlert(rule, hostID, containerID, value > rule.Threshold, value <= rule.resolveThreshold(), value, message)
+}
+
+// checkAgentContainerResource reports whether the rule's container was
+// found on any agent. Agents that evaluate their rules locally report the
+// alerts themselves and are skipped here, as are snapshots of hosts that
+// have not reported within HOST_STALE_AFTER: their alerts are left to close
+// once no longer evaluated.
+func checkAgentContainerResource(rule AlertRule) bool {
+	type hit struct {
+		hostID string
+		sample ContainerMetrics
+	}
+	staleAfter, _ := hostThresholds()
+	found := false
+	var hits []hit
+	alertsMutex.RLock()
+	for hostID, containers := range agentMetrics {
+		for _, c := range containers {
+			if ruleMatchesContainer(rule, hostID, c.ID) {
+				found = true
+				if time.Since(agentMetricsUpdated[hostID]) <= staleAfter {
+					hits = append(hits, hit{hostID, c})
+				}
+				break
+			}
+		}
+	}
+	alertsMutex.RUnlock()
+
+	for _, h := range hits {
+		if hostEvaluatesAlerts(h.hostID) {
+			continue
+		}
+		observeResource(rule, h.hostID, h.sample.ID, h.sample.CPUPercent, h.sample.MemoryMB)
+	}
+	return found
+}
+
+// checkAgentLogRules matches log_pattern rules against log lines shipped by
+// an agent. Only matches are observed; sweepAlertStates resolves the alert
+// once the pattern has stopped showing up.
+func checkAgentLogRules(hostID string, lines []protocol.LogLine) {
+	if hostEvaluatesAlerts(hostID) {
+		return
+	}
+
+	alertsMutex.RLock()
+	var rules []AlertRule
+	var patterns []*regexp.Regexp
+	for _, rule := range alertRules {
+		if !rule.Enabled || rule.Type != LogPattern || rule.Pattern == "" {
+			continue
+		}
+		if pattern, err := regexp.Compile(rule.Pattern); err == nil {
+			rules = append(rules, rule)
+			patterns = append(patterns, pattern)
+		}
+	}
+	alertsMutex.RUnlock()
+	if len(rules) == 0 {
+		return
+	}
+
+	fired := make(map[string]bool)
+	for _, line := range lines {
+		for i, rule := range rules {
+			key := rule.ID + "/" + line.ContainerID
+			if fired[key] || !ruleMatchesContainer(rule, hostID, line.ContainerID) || !patterns[i].MatchString(line.Message) {
+				continue
+			}
+			fired[key] = true
+			observeAlert(rule, hostID, line.ContainerID, true, false, 1, "Log pattern matched: '"+rule.Pattern+"' found")
+		}
 	}
 }
 
@@ -118,12 +222,77 @@ func checkLogPattern(rule AlertRule) {
 	}
 	logs := string(logBytes)
 
-	if strings.Contains(logs, rule.Pattern) {
-		sendAlert(rule, "Log pattern matched: '"+rule.Pattern+"' found")
+	pattern, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		log.Printf("Invalid log pattern in rule %s: %v", rule.ID, err)
+		return
+	}
+	matched := pattern.MatchString(logs)
+	observeAlert(rule, "master", rule.ContainerID, matched, !matched, 0, "Log pattern matched: '"+rule.Pattern+"' found")
+}
+
+// checkEventRules fires event-based rules (oom, die, unhealthy) for a container event
+func checkEventRules(hostID string, ev protocol.ContainerEvent) {
+	ruleType := ""
+	message := ""
+	switch {
+	case ev.Action == "oom":
+		ruleType, message = ContainerOOM, "Container was killed by the OOM killer"
+	case ev.Action == "die" && ev.ExitCode != "0":
+		ruleType, message = ContainerDied, "Container exited with code "+ev.ExitCode
+	case ev.Action == "health_status" && ev.Status == "unhealthy":
+		ruleType, message = ContainerUnhealthy, "Container health check is failing"
+	default:
+		return
+	}
+	if hostID != "master" && hostEvaluatesAlerts(hostID) {
+		return
+	}
+
+	alertsMutex.RLock()
+	rulesCopy := make([]AlertRule, len(alertRules))
+	copy(rulesCopy, alertRules)
+	alertsMutex.RUnlock()
+
+	for _, rule := range rulesCopy {
+		if !rule.Enabled || rule.Type != ruleType || !ruleMatchesContainer(rule, hostID, ev.ContainerID) {
+			continue
+		}
+		// Events are one-off: each one fires, and there is nothing to resolve
+		rule.HostID = hostID
+		rule.ContainerID = ev.ContainerID
+		text := message + " (" + ev.Name + ")"
+		now := time.Now()
+		silence, silenced := activeSilence(rule, now, &containerMeta{Name: ev.Name, Image: ev.Image, Labels: ev.Labels})
+		recordAlertEvent(rule, StateFiring, text, now, silence.ID)
+		if silenced {
+			logSilencedAlert(rule, silence.ID, text)
+			continue
+		}
+		sendAlert(rule, text)
 	}
 }
 
+// ruleMatchesContainer matches the rule's container ID, short or full, as a
+// prefix of the full ID the sample, event or log line carries; an empty rule
+// host matches any host
+func ruleMatchesContainer(rule AlertRule, hostID, containerID string) bool {
+	if rule.HostID != "" && rule.HostID != hostID {
+		return false
+	}
+	if rule.ContainerID == "" || containerID == "" {
+		return false
+	}
+	return strings.HasPrefix(containerID, rule.ContainerID)
+}
+
 func sendAlert(rule AlertRule, message string) {
+	notifyAlert(rule, message)
+	go handleAutoRecovery(rule)
+}
+
+// notifyAlert logs an alert and sends the rule's notifications
+func notifyAlert(rule AlertRule, message string) {
 	log.Printf("[ALERT] %s => %s", rule.ContainerID, message)
 
 	if rule.SlackWebhook != "" {
@@ -141,11 +310,25 @@ func sendAlert(rule AlertRule, message string) {
 			log.Printf("Failed to send email alert: %v", err)
 		}
 	}
-
-	go handleAutoRecovery(rule)
 }
 
 func handleAutoRecovery(rule AlertRule) {
+	// Containers on agent hosts are handled through the command queue
+	if rule.HostID != "" && rule.HostID != "master" {
+		for _, action := range []struct {
+			enabled bool
+			name    string
+		}{{rule.AutoRestart, protocol.CommandRestart}, {rule.AutoStop, protocol.CommandStop}} {
+			if !action.enabled {
+				continue
+			}
+			if _, err := QueueContainerCommand(rule.HostID, rule.ContainerID, action.name, "auto-recovery:"+rule.ID); err != nil {
+				log.Printf("[AutoRecovery] Failed to queue %s for %s on %s: %v", action.name, rule.ContainerID, rule.HostID, err)
+			}
+		}
+		return
+	}
+
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
 		log.Printf("AutoRecovery: Failed to create Docker client: %v", err)
@@ -170,9 +353,6 @@ func handleAutoRecovery(rule AlertRule) {
 	}
 }
 
-
-
-
 // Placeholder for Slack alert
 func sendSlackNotification(webhookURL string, message string) {
 	log.Printf("[Slack Alert] Webhook: %s | Message: %s", webhookURL, message)
@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
+)
+
+// Silence statuses, derived from the window and the current time
+const (
+	SilenceActive  = "active"
+	SilencePending = "pending"
+	SilenceExpired = "expired"
+)
+
+const (
+	silencesFile = "data/silences.json"
+
+	// Longest recurring window, and how long expired silences stay listed
+	maxSilenceWindow = 7 * 24 * time.Hour
+	silenceRetention = 7 * 24 * time.Hour
+)
+
+// Silence mutes the alerts it matches while its window is open. Matched
+// alerts are still recorded in the history, marked suppressed, but neither
+// notify nor trigger auto-recovery. A silence is either a one-off window
+// (starts_at to ends_at) or, with a schedule, a recurring maintenance window
+// of the given duration opening each time the cron-like schedule fires.
+// The window and the container matchers are shared with the agents.
+type Silence struct {
+	protocol.Silence
+
+	// Host matcher; with the matchers of protocol.Silence every one given
+	// must match, and at least one is required
+	HostID string `json:"host_id,omitempty"`
+
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// silenceStatus is a silence as listed, with its current window
+type silenceStatus struct {
+	Silence
+	Status      string     `json:"status"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"` // end of the open window
+	NextStart   *time.Time `json:"next_start,omitempty"`   // next recurring window
+}
+
+// containerMeta is what image and label matchers look at
+type containerMeta struct {
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+var (
+	silences      []Silence
+	silencesMutex = &sync.RWMutex{}
+)
+
+func (s Silence) status(now time.Time) silenceStatus {
+	st := silenceStatus{Silence: s, Status: SilencePending}
+	if active, until := s.Window(now); active {
+		st.Status = SilenceActive
+		st.ActiveUntil = &until
+	} else if !s.EndsAt.IsZero() && !now.Before(s.EndsAt) {
+		st.Status = SilenceExpired
+		return st
+	}
+	if next, ok := s.NextStart(now); ok {
+		st.NextStart = &next
+	}
+	return st
+}
+
+// matchesTarget checks the matchers that need no container details
+func (s Silence) matchesTarget(rule AlertRule) bool {
+	return (s.HostID == "" || s.HostID == rule.HostID) && s.MatchesRule(rule.ID)
+}
+
+// matchesContainer checks the container, image and label matchers
+func (s Silence) matchesContainer(containerID string, meta containerMeta) bool {
+	return s.MatchesContainer(containerID, meta.Name, meta.Image, meta.Labels)
+}
+
+// activeSilence returns the silence muting an alert of the rule (with the
+// alert's host and container filled in) at the given time. Container details
+// are looked up only if a candidate silence needs them; meta, if given,
+// supplies those already known.
+func activeSilence(rule AlertRule, at time.Time, meta *containerMeta) (Silence, bool) {
+	silencesMutex.RLock()
+	var candidates []Silence
+	for _, s := range silences {
+		if active, _ := s.Window(at); active && s.matchesTarget(rule) {
+			candidates = append(candidates, s)
+		}
+	}
+	silencesMutex.RUnlock()
+
+	looked := false
+	for _, s := range candidates {
+		if !s.NeedsContainer() {
+			return s, true
+		}
+		if !looked && (meta == nil || meta.Image == "" || meta.Labels == nil) {
+			found := lookupContainerMeta(rule.HostID, rule.ContainerID)
+			if meta != nil {
+				found = mergeContainerMeta(*meta, found)
+			}
+			meta, looked = &found, true
+		}
+		if s.matchesContainer(rule.ContainerID, *meta) {
+			return s, true
+		}
+	}
+	return Silence{}, false
+}
+
+// logSilencedAlert stands in for notifyAlert on muted alerts
+func logSilencedAlert(rule AlertRule, silenceID, message string) {
+	log.Printf("[ALERT] %s => %s (silenced by %s)", rule.ContainerID, message, silenceID)
+}
+
+// silenceOpen reports whether a silence still exists and is open
+func silenceOpen(id string, at time.Time) bool {
+	silencesMutex.RLock()
+	defer silencesMutex.RUnlock()
+	i := silenceIndex(id)
+	if i < 0 {
+		return false
+	}
+	active, _ := silences[i].Window(at)
+	return active
+}
+
+func mergeContainerMeta(known, found containerMeta) containerMeta {
+	if known.Name == "" {
+		known.Name = found.Name
+	}
+	if known.Image == "" {
+		known.Image = found.Image
+	}
+	if known.Labels == nil {
+		known.Labels = found.Labels
+	}
+	return known
+}
+
+// lookupContainerMeta finds a container's name, image and labels: from the
+// latest sample for agent hosts, from Docker for the master
+func lookupContainerMeta(hostID, containerID string) containerMeta {
+	if hostID != "" && hostID != "master" {
+		alertsMutex.RLock()
+		defer alertsMutex.RUnlock()
+		for _, c := range agentMetrics[hostID] {
+			if c.Name == containerID || strings.HasPrefix(c.ID, containerID) || strings.HasPrefix(containerID, c.ID) {
+				return containerMeta{Name: c.Name, Image: c.Image, Labels: c.Labels}
+			}
+		}
+		return containerMeta{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return containerMeta{}
+	}
+	defer cli.Close()
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil || info.Config == nil {
+		return containerMeta{}
+	}
+	return containerMeta{Name: strings.TrimPrefix(info.Name, "/"), Image: info.Config.Image, Labels: info.Config.Labels}
+}
+
+// CreateSilenceHandler adds a silence; starts_at defaults to now
+func CreateSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	var s Silence
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	if s.ID == "" {
+		id, err := randomHex(8)
+		if err != nil {
+			http.Error(w, "Failed to generate silence ID", http.StatusInternalServerError)
+			return
+		}
+		s.ID = "silence-" + id
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if s.Schedule == "" && s.EndsAt.IsZero() && s.Duration != "" {
+		if d, err := time.ParseDuration(s.Duration); err == nil {
+			s.EndsAt = s.StartsAt.Add(d)
+		}
+	}
+	s.CreatedAt = now
+	if err := validateSilence(s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Compile()
+
+	silencesMutex.Lock()
+	if silenceIndex(s.ID) >= 0 {
+		silencesMutex.Unlock()
+		http.Error(w, "Silence "+s.ID+" already exists", http.StatusConflict)
+		return
+	}
+	silences = append(silences, s)
+	saveSilencesLocked()
+	silencesMutex.Unlock()
+
+	log.Printf("Silence %s created (%s)", s.ID, s.Comment)
+	go PushAlertRules()
+	w.Header().Set("Location", "/silences/"+s.ID)
+	writeSilence(w, s.status(now), http.StatusCreated)
+}
+
+// ListSilencesHandler returns the silences with their status (`?status=`,
+// comma-separated), soonest ending first
+func ListSilencesHandler(w http.ResponseWriter, r *http.Request) {
+	var want map[string]bool
+	if v := r.URL.Query().Get("status"); v != "" {
+		want = make(map[string]bool)
+		for _, status := range strings.Split(v, ",") {
+			want[strings.TrimSpace(status)] = true
+		}
+	}
+
+	now := time.Now().UTC()
+	silencesMutex.RLock()
+	result := []silenceStatus{}
+	for _, s := range silences {
+		if st := s.status(now); want == nil || want[st.Status] {
+			result = append(result, st)
+		}
+	}
+	silencesMutex.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool { return silenceSortKey(result[i]).Before(silenceSortKey(result[j])) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func silenceSortKey(st silenceStatus) time.Time {
+	switch {
+	case st.ActiveUntil != nil:
+		return *st.ActiveUntil
+	case st.NextStart != nil:
+		return *st.NextStart
+	case !st.EndsAt.IsZero():
+		return st.EndsAt
+	}
+	return st.StartsAt
+}
+
+// GetSilenceHandler returns one silence
+func GetSilenceHandler(w http.ResponseWriter, r *http.Request, id string) {
+	silencesMutex.RLock()
+	defer silencesMutex.RUnlock()
+	i := silenceIndex(id)
+	if i < 0 {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	writeSilence(w, silences[i].status(time.Now().UTC()), http.StatusOK)
+}
+
+// ExpireSilenceHandler ends a silence now; it stays listed as expired
+func ExpireSilenceHandler(w http.ResponseWriter, r *http.Request, id string) {
+	now := time.Now().UTC()
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	i := silenceIndex(id)
+	if i < 0 {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	if silences[i].EndsAt.IsZero() || silences[i].EndsAt.After(now) {
+		silences[i].EndsAt = now
+		saveSilencesLocked()
+		log.Printf("Silence %s expired", id)
+		go PushAlertRules()
+	}
+	writeSilence(w, silences[i].status(now), http.StatusOK)
+}
+
+// DeleteSilenceHandler removes a silence
+func DeleteSilenceHandler(w http.ResponseWriter, r *http.Request, id string) {
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	i := silenceIndex(id)
+	if i < 0 {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	silences = append(silences[:i], silences[i+1:]...)
+	saveSilencesLocked()
+	go PushAlertRules()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// silenceIndex returns the position of a silence, or -1; callers hold silencesMutex
+func silenceIndex(id string) int {
+	for i, s := range silences {
+		if s.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func writeSilence(w http.ResponseWriter, st silenceStatus, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(st)
+}
+
+func validateSilence(s Silence) error {
+	if strings.ContainsAny(s.ID, "/?#") {
+		return errors.New("id must not contain '/', '?' or '#'")
+	}
+	if s.HostID == "" && s.ContainerID == "" && s.Image == "" && len(s.Labels) == 0 && s.RuleID == "" {
+		return errors.New("at least one matcher is required (host_id, container_id, image, labels, rule_id)")
+	}
+	if s.Image != "" {
+		if _, err := path.Match(s.Image, ""); err != nil {
+			return fmt.Errorf("image pattern: %v", err)
+		}
+	}
+	for key := range s.Labels {
+		if key == "" {
+			return errors.New("label names must not be empty")
+		}
+	}
+
+	if s.Duration != "" {
+		if d, err := time.ParseDuration(s.Duration); err != nil || d < time.Minute {
+			return fmt.Errorf("duration must be a duration of at least 1m, got %q", s.Duration)
+		}
+	}
+	if s.Schedule == "" {
+		if s.EndsAt.IsZero() {
+			return errors.New("ends_at or duration is required, or a schedule for recurring windows")
+		}
+		if !s.EndsAt.After(s.StartsAt) {
+			return errors.New("ends_at must be after starts_at")
+		}
+		if s.Timezone != "" {
+			return errors.New("timezone only applies to scheduled silences")
+		}
+		return nil
+	}
+
+	if _, err := protocol.ParseCronSchedule(s.Schedule); err != nil {
+		return fmt.Errorf("schedule: %v", err)
+	}
+	if d, _ := time.ParseDuration(s.Duration); d == 0 || d > maxSilenceWindow {
+		return fmt.Errorf("scheduled silences need a duration of up to %s", maxSilenceWindow)
+	}
+	if !s.EndsAt.IsZero() && !s.EndsAt.After(s.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", s.Timezone)
+		}
+	}
+	return nil
+}
+
+// pruneSilences forgets silences that expired more than silenceRetention ago
+func pruneSilences() {
+	cutoff := time.Now().Add(-silenceRetention)
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	kept := silences[:0]
+	for _, s := range silences {
+		if s.EndsAt.IsZero() || s.EndsAt.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) != len(silences) {
+		silences = kept
+		saveSilencesLocked()
+	}
+}
+
+// saveSilencesLocked persists the silences; callers hold silencesMutex
+func saveSilencesLocked() {
+	data, err := json.MarshalIndent(silences, "", "  ")
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal silences: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(silencesFile), 0755); err != nil {
+		log.Printf("[ERROR] Failed to create data directory: %v", err)
+		return
+	}
+	if err := os.WriteFile(silencesFile, data, 0644); err != nil {
+		log.Printf("[ERROR] Failed to write silences: %v", err)
+	}
+}
+
+// LoadSilencesFromFile restores the silences saved by saveSilencesLocked
+func LoadSilencesFromFile() {
+	data, err := os.ReadFile(silencesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Failed to read silences: %v", err)
+		}
+		return
+	}
+	var loaded []Silence
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("[ERROR] Failed to unmarshal silences: %v", err)
+		return
+	}
+
+	for i := range loaded {
+		loaded[i].Compile()
+	}
+	silencesMutex.Lock()
+	silences = loaded
+	silencesMutex.Unlock()
+	log.Printf("Loaded %d silences from %s", len(loaded), silencesFile)
+}
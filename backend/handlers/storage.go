@@ -1,54 +1,257 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"dockscope/backend/db"
 )
 
+// Alert history used to be rewritten to this file on every event; it is
+// imported into the alert_events table once and then renamed
 const alertEventsFile = "data/alert_events.json"
 
-// SaveAlertEventsToFile saves alert events to disk
-func SaveAlertEventsToFile() {
-	data, err := json.MarshalIndent(alertEvents, "", "  ")
+// Alert history retention, overridable with ALERT_EVENTS_MAX_AGE (duration)
+// and ALERT_EVENTS_MAX_COUNT
+const (
+	defaultAlertEventsMaxAge   = 30 * 24 * time.Hour
+	defaultAlertEventsMaxCount = 100000
+)
+
+func alertEventsRetention() (time.Duration, int) {
+	maxAge, maxCount := defaultAlertEventsMaxAge, defaultAlertEventsMaxCount
+	if d, err := time.ParseDuration(os.Getenv("ALERT_EVENTS_MAX_AGE")); err == nil && d > 0 {
+		maxAge = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("ALERT_EVENTS_MAX_COUNT")); err == nil && n > 0 {
+		maxCount = n
+	}
+	return maxAge, maxCount
+}
+
+// insertAlertEvent stores an event in the alert history. It reports false
+// when the event is an agent alert that was already stored.
+func insertAlertEvent(ev AlertEvent) (bool, error) {
+	var agentAlertID, silenceID sql.NullString
+	if ev.AgentAlertID != "" {
+		agentAlertID = sql.NullString{String: ev.AgentAlertID, Valid: true}
+	}
+	if ev.SilenceID != "" {
+		silenceID = sql.NullString{String: ev.SilenceID, Valid: true}
+	}
+	res, err := db.DB.Exec(
+		`INSERT OR IGNORE INTO alert_events(agent_alert_id, rule_id, host_id, container_id, type, state, message, source, agent_notified, suppressed, silence_id, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		agentAlertID, ev.AlertID, ev.HostID, ev.ContainerID, ev.Type, ev.State, ev.Message, ev.Source, ev.AgentNotified,
+		ev.Suppressed, silenceID, ev.Timestamp.UTC().Format(sqlTimeFormat),
+	)
 	if err != nil {
-		log.Println("[ERROR] Failed to marshal alert events:", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ImportAlertEventsFile moves the history of the old JSON file into the
+// database and renames the file so it is imported only once
+func ImportAlertEventsFile() {
+	data, err := os.ReadFile(alertEventsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("[ERROR] Failed to read alert events file:", err)
+		}
 		return
 	}
 
-	// Ensure data/ directory exists
-	if err := os.MkdirAll(filepath.Dir(alertEventsFile), 0755); err != nil {
-		log.Println("[ERROR] Failed to create data directory:", err)
+	// The file stored agent alert IDs under "id"
+	var legacy []struct {
+		AlertEvent
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		log.Println("[ERROR] Failed to unmarshal alert events:", err)
 		return
 	}
 
-	if err := ioutil.WriteFile(alertEventsFile, data, 0644); err != nil {
-		log.Println("[ERROR] Failed to write alert events:", err)
+	imported := 0
+	for _, l := range legacy {
+		ev := l.AlertEvent
+		if ev.AlertID == "" || ev.Timestamp.IsZero() {
+			continue
+		}
+		ev.AgentAlertID = l.ID
+		if ev.State == "" {
+			ev.State = StateFiring
+		}
+		if _, err := insertAlertEvent(ev); err != nil {
+			log.Println("[ERROR] Failed to import alert event:", err)
+			return
+		}
+		imported++
+	}
+
+	if err := os.Rename(alertEventsFile, alertEventsFile+".imported"); err != nil {
+		log.Println("[ERROR] Failed to rename alert events file:", err)
 	}
+	log.Printf("Imported %d alert events from %s", imported, alertEventsFile)
 }
 
-// LoadAlertEventsFromFile loads alert events from disk
-func LoadAlertEventsFromFile() {
-	file, err := os.Open(alertEventsFile)
+// StartAlertEventRetention prunes the alert history at startup and hourly
+func StartAlertEventRetention() {
+	go func() {
+		for {
+			pruneAlertEvents()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// pruneAlertEvents drops events older than the retention age and, past the
+// count limit, the oldest stored ones
+func pruneAlertEvents() {
+	maxAge, maxCount := alertEventsRetention()
+	cutoff := time.Now().Add(-maxAge).UTC().Format(sqlTimeFormat)
+	res, err := db.DB.Exec(`DELETE FROM alert_events WHERE timestamp < ?`, cutoff)
 	if err != nil {
-		if os.IsNotExist(err) {
-			alertEvents = []AlertEvent{}
+		log.Printf("Failed to prune alert events: %v", err)
+		return
+	}
+	expired, _ := res.RowsAffected()
+
+	res, err = db.DB.Exec(`DELETE FROM alert_events WHERE id <= (SELECT id FROM alert_events ORDER BY id DESC LIMIT 1 OFFSET ?)`, maxCount)
+	if err != nil {
+		log.Printf("Failed to prune alert events: %v", err)
+		return
+	}
+	trimmed, _ := res.RowsAffected()
+
+	if expired+trimmed > 0 {
+		log.Printf("Pruned %d alert events (%d older than %s, %d over the limit of %d)", expired+trimmed, expired, maxAge, trimmed, maxCount)
+	}
+}
+
+// ListAlertEventsHandler returns the alert history, newest first unless
+// order=asc. Filters: host_id, container_id (prefix), rule_id, type and state
+// (comma-separated), source, suppressed (true or false), since, until
+// (RFC3339). Paged with limit and
+// offset; X-Total-Count carries the number of matching events.
+func ListAlertEventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	where := " WHERE 1=1"
+	var args []any
+	for _, column := range []string{"host_id", "rule_id", "source"} {
+		if v := q.Get(column); v != "" {
+			where += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	if containerID := q.Get("container_id"); containerID != "" {
+		where += " AND container_id LIKE ?"
+		args = append(args, containerID+"%")
+	}
+	for _, column := range []string{"type", "state"} {
+		v := q.Get(column)
+		if v == "" {
+			continue
+		}
+		list := strings.Split(v, ",")
+		where += " AND " + column + " IN (?" + strings.Repeat(", ?", len(list)-1) + ")"
+		for _, item := range list {
+			args = append(args, strings.TrimSpace(item))
+		}
+	}
+	if v := q.Get("suppressed"); v != "" {
+		suppressed, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid suppressed (true or false)", http.StatusBadRequest)
+			return
+		}
+		where += " AND suppressed = ?"
+		args = append(args, suppressed)
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<="}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid '"+bound.param+"' time format", http.StatusBadRequest)
+			return
+		}
+		where += " AND timestamp " + bound.op + " ?"
+		args = append(args, t.UTC().Format(sqlTimeFormat))
+	}
+
+	limit, offset := 100, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "Invalid limit (1-1000)", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
 			return
 		}
-		log.Println("[ERROR] Failed to open alert events file:", err)
+		offset = n
+	}
+	order := "DESC"
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		order = "ASC"
+	default:
+		http.Error(w, "Invalid order (asc or desc)", http.StatusBadRequest)
+		return
+	}
+
+	var total int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM alert_events`+where, args...).Scan(&total); err != nil {
+		log.Printf("Failed to count alert events: %v", err)
+		http.Error(w, "Failed to query alert events", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	data, err := ioutil.ReadAll(file)
+	rows, err := db.DB.Query(`SELECT id, agent_alert_id, rule_id, host_id, container_id, type, state, message, source, agent_notified, suppressed, silence_id, timestamp
+		FROM alert_events`+where+` ORDER BY timestamp `+order+`, id `+order+` LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
 	if err != nil {
-		log.Println("[ERROR] Failed to read alert events file:", err)
+		log.Printf("Failed to query alert events: %v", err)
+		http.Error(w, "Failed to query alert events", http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
-	if err := json.Unmarshal(data, &alertEvents); err != nil {
-		log.Println("[ERROR] Failed to unmarshal alert events:", err)
+	result := []AlertEvent{}
+	for rows.Next() {
+		var ev AlertEvent
+		var agentAlertID, hostID, containerID, typ, state, message, source, silenceID sql.NullString
+		var ts string
+		if err := rows.Scan(&ev.ID, &agentAlertID, &ev.AlertID, &hostID, &containerID, &typ, &state, &message, &source, &ev.AgentNotified,
+			&ev.Suppressed, &silenceID, &ts); err != nil {
+			log.Printf("Failed to scan alert event: %v", err)
+			continue
+		}
+		ev.AgentAlertID, ev.HostID, ev.ContainerID = agentAlertID.String, hostID.String, containerID.String
+		ev.Type, ev.State, ev.Message, ev.Source = typ.String, state.String, message.String, source.String
+		ev.SilenceID = silenceID.String
+		ev.Timestamp, _ = time.Parse(time.RFC3339Nano, ts) // the driver returns DATETIME columns as RFC 3339
+		result = append(result, ev)
 	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
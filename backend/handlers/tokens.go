@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dockscope/pki"
+)
+
+const agentTokensFile = "data/agent_tokens.json"
+
+// AgentToken binds a bearer token to a single host. Only the SHA-256 hash of
+// the token is stored; the plain token is returned once, when it is issued.
+type AgentToken struct {
+	ID        string     `json:"id"`
+	HostID    string     `json:"host_id"`
+	Hash      string     `json:"hash,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Response for a newly issued token
+type IssuedAgentToken struct {
+	AgentToken
+	Token    string `json:"token"`
+	APIToken string `json:"api_token,omitempty"` // the agent's api.token, when AGENT_API_TOKEN is set
+}
+
+var (
+	agentTokens      []AgentToken
+	agentTokensMutex = &sync.RWMutex{}
+
+	errAgentUnauthorized = errors.New("unknown or revoked agent token")
+	errAgentHostMismatch = errors.New("agent token is not bound to this host")
+	errAgentCertRequired = errors.New("agent client certificate required")
+)
+
+// LoadAgentTokensFromFile loads the token registry from disk
+func LoadAgentTokensFromFile() {
+	agentTokensMutex.Lock()
+	defer agentTokensMutex.Unlock()
+
+	data, err := os.ReadFile(agentTokensFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("[ERROR] Failed to read agent tokens file:", err)
+		}
+		agentTokens = []AgentToken{}
+		return
+	}
+
+	if err := json.Unmarshal(data, &agentTokens); err != nil {
+		log.Println("[ERROR] Failed to unmarshal agent tokens:", err)
+	}
+}
+
+// saveAgentTokens writes the registry to disk; callers must hold agentTokensMutex
+func saveAgentTokens() error {
+	data, err := json.MarshalIndent(agentTokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(agentTokensFile), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(agentTokensFile, data, 0600)
+}
+
+// authenticateAgent identifies the agent by its verified client certificate
+// (CN is the host ID) or, failing that, by its bearer token in the registry,
+// and makes sure the identity matches hostID.
+func authenticateAgent(r *http.Request, hostID string) error {
+	if cn := pki.PeerCommonName(r.TLS); cn != "" {
+		if cn != hostID {
+			return errAgentHostMismatch
+		}
+		return nil
+	}
+	if os.Getenv("AGENT_REQUIRE_MTLS") == "true" {
+		return errAgentCertRequired
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return errAgentUnauthorized
+	}
+	hash := hashAgentToken(token)
+
+	agentTokensMutex.RLock()
+	defer agentTokensMutex.RUnlock()
+
+	for _, t := range agentTokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if t.RevokedAt != nil {
+			return errAgentUnauthorized
+		}
+		if t.HostID != hostID {
+			return errAgentHostMismatch
+		}
+		return nil
+	}
+	return errAgentUnauthorized
+}
+
+// rejectAgent writes the HTTP error matching an authenticateAgent failure
+func rejectAgent(w http.ResponseWriter, r *http.Request, hostID string, err error) {
+	log.Printf("%s[Agent Auth]%s Rejected %s for host %s from %s: %v", ColorRed, ColorReset, r.URL.Path, hostID, r.RemoteAddr, err)
+	if errors.Is(err, errAgentHostMismatch) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+func hashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IssueAgentTokenHandler creates a new token for a host. Any previous tokens
+// for that host stay valid until revoked, so agents can be rotated without downtime.
+func IssueAgentTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		HostID string `json:"host_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.HostID == "" {
+		http.Error(w, "Missing host_id", http.StatusBadRequest)
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	plain := "dsa_" + secret
+
+	token := AgentToken{
+		ID:        id,
+		HostID:    req.HostID,
+		Hash:      hashAgentToken(plain),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	agentTokensMutex.Lock()
+	agentTokens = append(agentTokens, token)
+	err = saveAgentTokens()
+	agentTokensMutex.Unlock()
+	if err != nil {
+		log.Println("[ERROR] Failed to save agent tokens:", err)
+		http.Error(w, "Failed to save token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s[Agent Auth]%s Issued token %s for host %s", ColorGreen, ColorReset, id, req.HostID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	resp := IssuedAgentToken{AgentToken: token, Token: plain, APIToken: agentAPITokenFor(req.HostID)}
+	resp.Hash = ""
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ListAgentTokensHandler lists issued tokens, optionally filtered by host_id
+func ListAgentTokensHandler(w http.ResponseWriter, r *http.Request) {
+	hostID := r.URL.Query().Get("host_id")
+
+	agentTokensMutex.RLock()
+	result := []AgentToken{}
+	for _, t := range agentTokens {
+		if hostID != "" && t.HostID != hostID {
+			continue
+		}
+		t.Hash = ""
+		result = append(result, t)
+	}
+	agentTokensMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// RevokeAgentTokenHandler revokes a token by its id
+func RevokeAgentTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Token ID is required", http.StatusBadRequest)
+		return
+	}
+
+	agentTokensMutex.Lock()
+	defer agentTokensMutex.Unlock()
+
+	for i := range agentTokens {
+		if agentTokens[i].ID != id {
+			continue
+		}
+		if agentTokens[i].RevokedAt == nil {
+			now := time.Now().UTC()
+			agentTokens[i].RevokedAt = &now
+			if err := saveAgentTokens(); err != nil {
+				log.Println("[ERROR] Failed to save agent tokens:", err)
+				http.Error(w, "Failed to save token", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("%s[Agent Auth]%s Revoked token %s for host %s", ColorYellow, ColorReset, id, agentTokens[i].HostID)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Token revoked"))
+		return
+	}
+
+	http.Error(w, "Token not found", http.StatusNotFound)
+}
@@ -3,79 +3,93 @@ package handlers
 import (
 	"sync"
 	"time"
+
+	"dockscope/protocol"
 )
 
 // Core container metrics (used in dashboard, alerts, and agents)
 type ContainerMetrics struct {
-	ID            string    `json:"id"`
-	Name          string    `json:"name"`
-	Image         string    `json:"image"`
-	CPUPercent    float64   `json:"cpu_percent"`
-	MemoryMB      float64   `json:"memory_mb"`
-	MemoryPercent float64   `json:"memory_percent"`
-	Uptime        string    `json:"uptime"`
-	Restart       string    `json:"restart"`
-	RestartCount  int     `json:"restart_count"`
-	CPUHistory    []float64 `json:"cpu_history"`
-	MemoryHistory []float64 `json:"memory_history"`
-	Logs          []string  `json:"logs,omitempty"`
-	HostID        string    `json:"host_id"`
-}
-
-// Alert definition structure (defined by user)
-type AlertDefinition struct {
-	ID           string  `json:"id"`
-	HostID       string  `json:"host_id"`
-	Type         string  `json:"type"` // e.g., high_cpu, high_memory, log_pattern
-	Threshold    float64 `json:"threshold"`
-	Pattern      string  `json:"pattern"`
-	ContainerID  string  `json:"container_id"`
-	Enabled      bool    `json:"enabled"`
-	SlackWebhook string  `json:"slack_webhook"`
-	Email        string  `json:"email"`
-	AutoRestart  bool    `json:"auto_restart"` // Not used anymore
-	AutoStop     bool    `json:"auto_stop"`    // Not used anymore
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Image         string            `json:"image"`
+	CPUPercent    float64           `json:"cpu_percent"`
+	MemoryMB      float64           `json:"memory_mb"`
+	MemoryPercent float64           `json:"memory_percent"`
+	Uptime        string            `json:"uptime"`
+	Restart       string            `json:"restart"`
+	RestartCount  int               `json:"restart_count"`
+	MemoryLimitMB float64           `json:"memory_limit_mb,omitempty"`
+	NetRx         uint64            `json:"network_rx,omitempty"`
+	NetTx         uint64            `json:"network_tx,omitempty"`
+	DiskRead      uint64            `json:"disk_read,omitempty"`
+	DiskWrite     uint64            `json:"disk_write,omitempty"`
+	PIDs          uint64            `json:"pids,omitempty"`
+	Health        string            `json:"health,omitempty"`
+	Group         string            `json:"group,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	CPUHistory    []float64         `json:"cpu_history"`
+	MemoryHistory []float64         `json:"memory_history"`
+	Logs          []string          `json:"logs,omitempty"`
+	HostID        string            `json:"host_id"`
 }
 
-// Triggered alert event (recorded in memory + file)
+// Triggered alert event (stored in the alert_events table)
 type AlertEvent struct {
+	ID          int64     `json:"id"`
 	AlertID     string    `json:"alert_id"`
 	HostID      string    `json:"host_id"`
 	ContainerID string    `json:"container_id"`
 	Type        string    `json:"type"`
 	Message     string    `json:"message"`
 	Timestamp   time.Time `json:"timestamp"`
-	Restarted   bool      `json:"restarted"` // Now always false (optional)
+	Restarted   bool      `json:"restarted"`       // Now always false (optional)
+	State       string    `json:"state,omitempty"` // firing or resolved
+
+	// Set for alerts fired by an agent's local evaluation
+	AgentAlertID  string `json:"agent_alert_id,omitempty"`
+	Source        string `json:"source,omitempty"`
+	AgentNotified bool   `json:"agent_notified,omitempty"`
+
+	// Set when a silence muted the alert: recorded, but not notified
+	Suppressed bool   `json:"suppressed,omitempty"`
+	SilenceID  string `json:"silence_id,omitempty"`
 }
 
-// Agent push payloads (metrics)
-type AgentPayload struct {
-	HostID     string             `json:"host_id"`
-	Timestamp  string             `json:"timestamp"`
-	Containers []ContainerMetrics `json:"containers"`
+// Agent push payloads, shared with the agent binary
+type AgentPayload = protocol.MetricsPayload
+type AgentLogPayload = protocol.LogPayload
+
+// Alert rule (defined by user). An empty HostID matches the container on any host.
+type AlertRule struct {
+	ID           string  `json:"id"`
+	HostID       string  `json:"host_id"`
+	ContainerID  string  `json:"container_id"`
+	Type         string  `json:"type"` // e.g., high_cpu, high_memory, log_pattern, container_oom
+	Threshold    float64 `json:"threshold"`
+	Pattern      string  `json:"pattern"`
+	Email        string  `json:"email"`
+	SlackWebhook string  `json:"slack_webhook"`
+	AutoRestart  bool    `json:"auto_restart"`
+	AutoStop     bool    `json:"auto_stop"`
+	Enabled      bool    `json:"enabled"`
+
+	// For is how long the condition must hold before firing, e.g. "2m".
+	// A firing resource alert resolves at or below ResolveThreshold, which
+	// defaults to 90% of Threshold.
+	For              string  `json:"for,omitempty"`
+	ResolveThreshold float64 `json:"resolve_threshold,omitempty"`
 }
 
-// Agent push payloads (logs)
-type AgentLogPayload struct {
-	HostID      string    `json:"host_id"`
-	ContainerID string    `json:"container_id"`
-	Logs        string    `json:"logs"`
-	Timestamp   time.Time `json:"timestamp"`
+func (r AlertRule) forDuration() time.Duration {
+	d, _ := time.ParseDuration(r.For)
+	return d
 }
 
-// Simple alert rule format for local checks (used in monitor.go)
-type AlertRule struct {
-	ID           string
-	HostID       string
-	ContainerID  string
-	Type         string  // "high_cpu", "high_memory", "log_pattern"
-	Threshold    float64
-	Pattern      string
-	Email        string
-	SlackWebhook string
-	AutoRestart  bool // deprecated
-	AutoStop     bool // deprecated
-	Enabled      bool
+func (r AlertRule) resolveThreshold() float64 {
+	if r.ResolveThreshold > 0 {
+		return r.ResolveThreshold
+	}
+	return r.Threshold * 0.9
 }
 
 // For raw listing or UI
@@ -87,21 +101,25 @@ type ContainerInfo struct {
 	Logs       []string `json:"logs,omitempty"`
 	Image      string   `json:"image"`
 	HostID     string   `json:"host_id,omitempty"`
+	Group      string   `json:"group,omitempty"`
+	Stale      bool     `json:"stale,omitempty"` // the agent has missed recent heartbeats
 }
 
 // 🔁 Shared in-memory variables
 var (
-	alertRules      []AlertRule
-	alertsMutex     = &sync.RWMutex{}
-	alertEvents     []AlertEvent
-	alertDefinitions []AlertDefinition
-	agentMetrics    = make(map[string][]ContainerMetrics)
+	alertRules          []AlertRule
+	alertsMutex         = &sync.RWMutex{}
+	agentMetrics        = make(map[string][]ContainerMetrics)
+	agentMetricsUpdated = make(map[string]time.Time)
 )
 
 const (
 	HighCPU    = "high_cpu"
 	HighMemory = "high_memory"
 	LogPattern = "log_pattern"
-)
-
 
+	// Event-based rules, fired from the Docker events stream
+	ContainerOOM       = "container_oom"
+	ContainerDied      = "container_died"
+	ContainerUnhealthy = "container_unhealthy"
+)
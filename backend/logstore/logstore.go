@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"log"
 	"os"
+	"strings"
+	"time"
+
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -32,6 +35,12 @@ func InitDB() {
 	if err != nil {
 		log.Fatal("Failed to create table:", err)
 	}
+
+	// Older databases were created before agents shipped logs
+	_, err = db.Exec(`ALTER TABLE container_logs ADD COLUMN host_id TEXT DEFAULT 'master'`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		log.Fatal("Failed to migrate table:", err)
+	}
 }
 
 func SaveLog(containerID, level, message string) {
@@ -47,6 +56,17 @@ func SaveLog(containerID, level, message string) {
 	}
 }
 
+// SaveAgentLog stores a log line received from an agent with its original timestamp
+func SaveAgentLog(hostID, containerID, level, message string, ts time.Time) {
+	_, err := db.Exec(
+		"INSERT INTO container_logs(host_id, container_id, level, message, timestamp) VALUES (?, ?, ?, ?, ?)",
+		hostID, containerID, level, message, ts.UTC().Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
+		log.Println("Exec failed:", err)
+	}
+}
+
 func QueryLogsByDate(start, end string) ([]map[string]string, error) {
 	rows, err := db.Query(`SELECT container_id, level, message, timestamp FROM container_logs WHERE timestamp BETWEEN ? AND ? ORDER BY timestamp`, start, end)
 	if err != nil {
@@ -3,12 +3,16 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	//"time"
 
+	"dockscope/backend/db"
 	"dockscope/backend/handlers"
-	"dockscope/backend/middleware"
 	"dockscope/backend/logger"
-	"dockscope/backend/db"
+	"dockscope/backend/logstore"
+	"dockscope/backend/middleware"
+	"dockscope/pki"
 )
 
 func main() {
@@ -25,7 +29,7 @@ func main() {
 		case http.MethodGet:
 			handlers.GetContainerMetricsHandler(w, r)
 		case http.MethodPost:
-			handlers.ReceiveAgentMetricsHandler(w, r)
+			middleware.Decompress(http.HandlerFunc(handlers.ReceiveAgentMetricsHandler)).ServeHTTP(w, r)
 
 			// ✅ Enhanced agent metrics log
 			host := r.Header.Get("X-Host-ID")
@@ -39,6 +43,106 @@ func main() {
 		}
 	})))
 
+	// Batched metrics from agents (several collection cycles per request)
+	mux.Handle("/agent/metrics/batch", middleware.CORS(middleware.Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.ReceiveAgentMetricsBatchHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+
+	// Container lifecycle events: agents push (POST), UI reads the timeline (GET)
+	mux.Handle("/agent/events", middleware.CORS(middleware.Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.ReceiveAgentEventsHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+	mux.Handle("/events", middleware.CORS(http.HandlerFunc(handlers.ListContainerEventsHandler)))
+
+	// Alert rules evaluated on the agents, and the alerts they fire
+	mux.Handle("/agent/alerts", middleware.CORS(middleware.Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.ReceiveAgentAlertsHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+	mux.Handle("/agent/alerts/rules", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handlers.AgentAlertRulesHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+
+	// Persistent agent stream (metrics, logs and events multiplexed over one WebSocket)
+	mux.Handle("/agent/ws", http.HandlerFunc(handlers.AgentStreamHandler))
+	mux.Handle("/admin/agents/control", middleware.CORS(middleware.AdminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.AgentControlHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+
+	// Agent registration (host inventory)
+	mux.Handle("/agent/register", middleware.CORS(middleware.Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.RegisterAgentHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+
+	// Host inventory and liveness; removing a host is admin only
+	mux.Handle("/hosts", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handlers.ListHostsHandler(w, r)
+		case http.MethodDelete:
+			middleware.AdminAuth(http.HandlerFunc(handlers.DeleteHostHandler)).ServeHTTP(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+
+	// Remote container actions
+	mux.Handle("/commands", middleware.CORS(middleware.AdminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.CreateCommandHandler(w, r)
+		case http.MethodGet:
+			handlers.ListCommandsHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+	mux.Handle("/agent/commands", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handlers.AgentPollCommandsHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	mux.Handle("/agent/commands/result", middleware.CORS(middleware.Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.ReceiveCommandResultHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
+
 	// Metrics WebSocket
 	mux.Handle("/wsmetrics", middleware.CORS(http.HandlerFunc(handlers.WSContainerMetricsHandler)))
 
@@ -60,18 +164,95 @@ func main() {
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		}
 	})))
+	mux.Handle("/alerts/state", middleware.CORS(http.HandlerFunc(handlers.ListAlertStatesHandler)))
+	mux.Handle("/alerts/events", middleware.CORS(http.HandlerFunc(handlers.ListAlertEventsHandler)))
+	mux.Handle("/silences", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			middleware.AdminAuth(http.HandlerFunc(handlers.CreateSilenceHandler)).ServeHTTP(w, r)
+		case http.MethodGet:
+			handlers.ListSilencesHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	// Single silences: /silences/{id}, /silences/{id}/expire; like creating
+	// one, changing a silence is admin only
+	mux.Handle("/silences/", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/silences/"), "/")
+		switch {
+		case id == "" || (action != "" && action != "expire"):
+			http.NotFound(w, r)
+		case action == "expire" && r.Method == http.MethodPost:
+			middleware.AdminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlers.ExpireSilenceHandler(w, r, id)
+			})).ServeHTTP(w, r)
+		case action == "" && r.Method == http.MethodGet:
+			handlers.GetSilenceHandler(w, r, id)
+		case action == "" && r.Method == http.MethodDelete:
+			middleware.AdminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlers.DeleteSilenceHandler(w, r, id)
+			})).ServeHTTP(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})))
+	// Single rules: /alerts/{id}, /alerts/{id}/enable, /alerts/{id}/disable
+	mux.Handle("/alerts/", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/alerts/"), "/")
+		if id == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch action {
+		case "":
+		case "enable", "disable":
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			handlers.SetAlertRuleEnabledHandler(w, r, id, action == "enable")
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
 
-	// New: Receive logs from agents
+		switch r.Method {
+		case http.MethodGet:
+			handlers.GetAlertRuleHandler(w, r, id)
+		case http.MethodPut, http.MethodPatch:
+			handlers.UpdateAlertRuleHandler(w, r, id)
+		case http.MethodDelete:
+			handlers.DeleteAlertRuleHandler(w, r, id)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})))
 
-	/*
-	mux.Handle("/agent/logs", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Receive logs from agents
+	mux.Handle("/agent/logs", middleware.CORS(middleware.Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			handlers.ReceiveAgentLogsHandler(w, r)
 		default:
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		}
-	}))) */
+	}))))
+
+	// Agent token registry (admin only)
+	mux.Handle("/admin/tokens", middleware.CORS(middleware.AdminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlers.IssueAgentTokenHandler(w, r)
+		case http.MethodGet:
+			handlers.ListAgentTokensHandler(w, r)
+		case http.MethodDelete:
+			handlers.RevokeAgentTokenHandler(w, r)
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	}))))
 
 	// UI static fallback
 	mux.Handle("/ui/", middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -79,15 +260,39 @@ func main() {
 	})))
 
 	// Start background tasks
-	handlers.StartMonitoring()
-	// handlers.LoadAlertsFromFile()
 	db.InitDB()
+	handlers.ImportAlertEventsFile()
+	handlers.StartAlertEventRetention()
+	handlers.LoadAlertRulesFromFile()
+	handlers.LoadAlertStatesFromFile()
+	handlers.LoadSilencesFromFile()
+	handlers.StartMonitoring()
+	logstore.InitDB()
 	handlers.InitInflux()
-	handlers.LoadAlertEventsFromFile()
+	handlers.StartEventWatcher()
+	handlers.LoadAgentTokensFromFile()
+	handlers.LoadHostsFromDB()
+	handlers.StartHostMonitor()
 	logger.InitLogger("whalewatch.log")
 
+	if err := handlers.InitAgentClient(); err != nil {
+		log.Fatalf("Failed to configure agent TLS client: %v", err)
+	}
+
 	port := ":9448"
-	log.Printf("Server started on %s", port)
-	log.Fatal(http.ListenAndServe(port, mux))
-}
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" {
+		log.Printf("Server started on %s", port)
+		log.Fatal(http.ListenAndServe(port, mux))
+	}
 
+	// Browsers reach the same listener, so client certificates are only
+	// required on agent endpoints (see AGENT_REQUIRE_MTLS)
+	tlsConfig, err := pki.ServerConfig(certFile, keyFile, os.Getenv("TLS_CLIENT_CA_FILE"), false)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	server := &http.Server{Addr: port, Handler: mux, TLSConfig: tlsConfig}
+	log.Printf("Server started on %s (TLS)", port)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
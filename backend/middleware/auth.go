@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AdminAuth protects admin endpoints with the bearer token in DOCKSCOPE_ADMIN_TOKEN.
+// Admin endpoints are disabled entirely when the variable is not set.
+func AdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := os.Getenv("DOCKSCOPE_ADMIN_TOKEN")
+		if adminToken == "" {
+			http.Error(w, "Admin API disabled: DOCKSCOPE_ADMIN_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
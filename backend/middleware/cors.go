@@ -10,9 +10,11 @@ func CORS(next http.Handler) http.Handler {
 		// Allow all origins – adjust as needed
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		// Allow specific headers
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
 		// Allow specific methods
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		// Let browsers read the ETag used for If-Match
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Total-Count")
 
 		// Handle preflight requests
 		if r.Method == http.MethodOptions {
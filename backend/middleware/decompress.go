@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// maxDecodedBody caps a decompressed request body so a small gzip bomb
+// cannot exhaust memory
+const maxDecodedBody = 64 << 20
+
+// Decompress accepts gzip-encoded request bodies from agents. Every response
+// advertises Accept-Encoding: gzip so agents know they may compress; agents
+// that never see it keep sending plain JSON.
+func Decompress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Encoding", "gzip")
+
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+		case "gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			r.Body = http.MaxBytesReader(w, gz, maxDecodedBody)
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoBody writes back the request body it read, or 413 once the body is
+// over the decoded limit. A decoded body must no longer be marked as gzip.
+var echoBody = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip") {
+		http.Error(w, "Body still marked as gzip", http.StatusInternalServerError)
+		return
+	}
+	w.Write(body)
+})
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	payload := []byte(`{"host_id":"h1","containers":[]}`)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		want     []byte
+	}{
+		{"gzip", "gzip", gzipped(t, payload), http.StatusOK, payload},
+		{"gzip mixed case", " GZip ", gzipped(t, payload), http.StatusOK, payload},
+		{"no encoding", "", payload, http.StatusOK, payload},
+		{"identity", "identity", payload, http.StatusOK, payload},
+		{"bad gzip", "gzip", payload, http.StatusBadRequest, nil},
+		{"unknown encoding", "br", payload, http.StatusUnsupportedMediaType, nil},
+		{"over the decoded limit", "gzip", gzipped(t, make([]byte, maxDecodedBody+1)), http.StatusRequestEntityTooLarge, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/agent/metrics", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			Decompress(echoBody).ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.status, rec.Body.String())
+			}
+			if got := rec.Header().Get("Accept-Encoding"); got != "gzip" {
+				t.Errorf("Accept-Encoding = %q, want gzip", got)
+			}
+			if tt.want != nil && !bytes.Equal(rec.Body.Bytes(), tt.want) {
+				t.Errorf("body = %q, want %q", rec.Body.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompressAtLimit(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/agent/metrics", bytes.NewReader(gzipped(t, make([]byte, maxDecodedBody))))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	Decompress(echoBody).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Body.Len() != maxDecodedBody {
+		t.Errorf("read %d bytes, want %d", rec.Body.Len(), maxDecodedBody)
+	}
+}
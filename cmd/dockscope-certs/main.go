@@ -0,0 +1,106 @@
+// Command dockscope-certs mints a local CA and agent/master certificates for
+// trying out mutual TLS. Use a real PKI for production deployments.
+//
+//	dockscope-certs ca -out certs
+//	dockscope-certs issue -out certs -cn master -hosts master.example.com,10.0.0.1
+//	dockscope-certs issue -out certs -cn web-01 -hosts 10.0.0.5
+//	dockscope-certs issue -out certs -cn "web 01/eu" -name web-01-eu
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dockscope/pki"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "ca":
+		fs := flag.NewFlagSet("ca", flag.ExitOnError)
+		out := fs.String("out", "certs", "output directory")
+		cn := fs.String("cn", "DockScope Local CA", "CA common name")
+		days := fs.Int("days", 3650, "validity in days")
+		fs.Parse(os.Args[2:])
+
+		certPEM, keyPEM, err := pki.NewCA(*cn, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to create CA: %v", err)
+		}
+		writePair(*out, "ca", certPEM, keyPEM)
+
+	case "issue":
+		fs := flag.NewFlagSet("issue", flag.ExitOnError)
+		out := fs.String("out", "certs", "output directory (must contain ca.pem and ca-key.pem)")
+		cn := fs.String("cn", "", "common name; for agents this is the host ID")
+		name := fs.String("name", "", "file name for the pair, <name>.pem and <name>-key.pem (default: the common name)")
+		hosts := fs.String("hosts", "", "comma-separated DNS names or IPs to serve on")
+		days := fs.Int("days", 365, "validity in days")
+		fs.Parse(os.Args[2:])
+
+		if *cn == "" {
+			log.Fatal("-cn is required")
+		}
+		if *name == "" {
+			*name = *cn
+		}
+		// The name must stay inside -out and must not replace the CA
+		if *name != filepath.Base(*name) || strings.ContainsAny(*name, `/\`) || *name == "." || *name == ".." {
+			log.Fatalf("File name %q must be a plain name without path separators; pick another with -name", *name)
+		}
+		if *name == "ca" {
+			log.Fatal(`File name "ca" would overwrite the CA; pick another with -name`)
+		}
+
+		caCert, err := os.ReadFile(filepath.Join(*out, "ca.pem"))
+		if err != nil {
+			log.Fatalf("Failed to read CA certificate: %v", err)
+		}
+		caKey, err := os.ReadFile(filepath.Join(*out, "ca-key.pem"))
+		if err != nil {
+			log.Fatalf("Failed to read CA key: %v", err)
+		}
+
+		var hostList []string
+		if *hosts != "" {
+			hostList = strings.Split(*hosts, ",")
+		}
+		certPEM, keyPEM, err := pki.IssueCert(caCert, caKey, *cn, hostList, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to issue certificate: %v", err)
+		}
+		writePair(*out, *name, certPEM, keyPEM)
+
+	default:
+		usage()
+	}
+}
+
+func writePair(dir, name string, certPEM, keyPEM []byte) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Failed to create %s: %v", dir, err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		log.Fatalf("Failed to write %s: %v", certFile, err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		log.Fatalf("Failed to write %s: %v", keyFile, err)
+	}
+	fmt.Printf("Wrote %s and %s\n", certFile, keyFile)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dockscope-certs ca|issue [flags]")
+	os.Exit(2)
+}
@@ -0,0 +1,117 @@
+// Package events streams Docker container lifecycle events and normalizes
+// them into protocol.ContainerEvent. It is used by the agent and by the
+// master for its local daemon.
+package events
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	dockerevents "github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+
+	"dockscope/protocol"
+)
+
+// tracked lists the container actions worth forwarding; exec_*, attach,
+// resize and friends are noise for monitoring.
+var tracked = map[string]bool{
+	"create":        true,
+	"start":         true,
+	"stop":          true,
+	"die":           true,
+	"kill":          true,
+	"oom":           true,
+	"restart":       true,
+	"pause":         true,
+	"unpause":       true,
+	"destroy":       true,
+	"health_status": true,
+}
+
+// Watch streams container events from cli until ctx is cancelled, calling
+// handle for each normalized event. The stream is re-opened after errors,
+// resuming from the last event seen so nothing is lost across reconnects.
+func Watch(ctx context.Context, cli *client.Client, handle func(protocol.ContainerEvent)) {
+	since := time.Now()
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		opts := types.EventsOptions{
+			Since:   since.Format(time.RFC3339Nano),
+			Filters: filters.NewArgs(filters.Arg("type", dockerevents.ContainerEventType)),
+		}
+		msgs, errs := cli.Events(ctx, opts)
+
+	stream:
+		for {
+			select {
+			case msg := <-msgs:
+				backoff = time.Second
+				ev, ok := Normalize(msg)
+				if !ok {
+					continue
+				}
+				since = ev.Timestamp.Add(time.Nanosecond)
+				handle(ev)
+			case err := <-errs:
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Docker events stream error: %v (reconnecting in %s)", err, backoff)
+				break stream
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// Normalize converts a raw Docker event, reporting false for events that are not tracked
+func Normalize(msg dockerevents.Message) (protocol.ContainerEvent, bool) {
+	if msg.Type != dockerevents.ContainerEventType {
+		return protocol.ContainerEvent{}, false
+	}
+
+	// Health events arrive as "health_status: healthy"
+	action, status, _ := strings.Cut(msg.Action, ":")
+	action = strings.TrimSpace(action)
+	if !tracked[action] {
+		return protocol.ContainerEvent{}, false
+	}
+
+	// Docker puts the container labels next to its own attributes
+	labels := make(map[string]string, len(msg.Actor.Attributes))
+	for k, v := range msg.Actor.Attributes {
+		switch k {
+		case "name", "image", "exitCode", "signal", "execDuration":
+			continue
+		}
+		labels[k] = v
+	}
+
+	ts := time.Unix(0, msg.TimeNano).UTC()
+	if msg.TimeNano == 0 {
+		ts = time.Unix(msg.Time, 0).UTC()
+	}
+
+	return protocol.ContainerEvent{
+		ContainerID: msg.Actor.ID,
+		Name:        msg.Actor.Attributes["name"],
+		Image:       msg.Actor.Attributes["image"],
+		Action:      action,
+		Status:      strings.TrimSpace(status),
+		ExitCode:    msg.Actor.Attributes["exitCode"],
+		Timestamp:   ts,
+		Labels:      labels,
+	}, true
+}
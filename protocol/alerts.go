@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AlertRule is an alert rule as pushed to an agent for local evaluation
+type AlertRule struct {
+	ID           string  `json:"id"`
+	ContainerID  string  `json:"container_id"` // full or short ID
+	Type         string  `json:"type"`         // high_cpu, high_memory, log_pattern, container_oom, ...
+	Threshold    float64 `json:"threshold,omitempty"`
+	Pattern      string  `json:"pattern,omitempty"`
+	Email        string  `json:"email,omitempty"`
+	SlackWebhook string  `json:"slack_webhook,omitempty"`
+
+	// ForSeconds is how long a resource condition must hold before firing;
+	// a firing alert resolves at or below ResolveThreshold
+	ForSeconds       float64 `json:"for_seconds,omitempty"`
+	ResolveThreshold float64 `json:"resolve_threshold,omitempty"`
+}
+
+// AlertRuleSet is every rule and silence that applies to one host. Revision
+// changes whenever the set does, so agents can skip unchanged sets.
+type AlertRuleSet struct {
+	Version  int         `json:"version"`
+	HostID   string      `json:"host_id"`
+	Revision string      `json:"revision"`
+	Rules    []AlertRule `json:"rules"`
+	Silences []Silence   `json:"silences,omitempty"`
+}
+
+// NewAlertRuleSet returns a rule set stamped with its revision
+func NewAlertRuleSet(hostID string, rules []AlertRule, silences []Silence) AlertRuleSet {
+	if rules == nil {
+		rules = []AlertRule{}
+	}
+	data, _ := json.Marshal(struct {
+		Rules    []AlertRule
+		Silences []Silence
+	}{rules, silences})
+	sum := sha256.Sum256(data)
+	return AlertRuleSet{
+		Version:  Version,
+		HostID:   hostID,
+		Revision: hex.EncodeToString(sum[:8]),
+		Rules:    rules,
+		Silences: silences,
+	}
+}
+
+// AgentAlert is an alert fired by an agent's local evaluation
+type AgentAlert struct {
+	ID            string    `json:"id"` // generated by the agent, for deduplication
+	RuleID        string    `json:"rule_id"`
+	ContainerID   string    `json:"container_id"`
+	ContainerName string    `json:"container_name"`
+	Type          string    `json:"type"`
+	Message       string    `json:"message"`
+	Value         float64   `json:"value,omitempty"`
+	FiredAt       time.Time `json:"fired_at"`
+
+	// Resolved marks the alert's condition clearing rather than firing
+	Resolved bool `json:"resolved,omitempty"`
+
+	// Notified is set when the agent could not reach the master and sent
+	// the rule's notifications itself
+	Notified bool `json:"notified"`
+
+	// SilenceID is the silence that muted the alert on the agent, which
+	// then does not notify it; the master applies its own silences
+	SilenceID string `json:"silence_id,omitempty"`
+}
+
+// AgentAlertPayload carries alerts fired on an agent, live or reconciled
+// after an outage
+type AgentAlertPayload struct {
+	Version int          `json:"version"`
+	HostID  string       `json:"host_id"`
+	Alerts  []AgentAlert `json:"alerts"`
+}
+
+// NewAgentAlertPayload returns an alert batch stamped with the current protocol version
+func NewAgentAlertPayload(hostID string, alerts []AgentAlert) AgentAlertPayload {
+	return AgentAlertPayload{Version: Version, HostID: hostID, Alerts: alerts}
+}
+
+// DecodeAgentAlertPayload reads and validates an alert batch. Agent alerts
+// were introduced in version 2.
+func DecodeAgentAlertPayload(r io.Reader) (AgentAlertPayload, error) {
+	var payload AgentAlertPayload
+	if err := decodeSince(r, 2, &payload); err != nil {
+		return AgentAlertPayload{}, err
+	}
+	payload.Version = Version
+	return payload, payload.Validate()
+}
+
+// Validate checks an alert batch
+func (p AgentAlertPayload) Validate() error {
+	if p.Version != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, p.Version)
+	}
+	if p.HostID == "" {
+		return errors.New("missing host_id")
+	}
+	for i, a := range p.Alerts {
+		if a.ID == "" || a.RuleID == "" {
+			return fmt.Errorf("alert %d: missing id or rule_id", i)
+		}
+	}
+	return nil
+}
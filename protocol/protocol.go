@@ -0,0 +1,485 @@
+// Package protocol defines the payloads exchanged between DockScope agents
+// and the master. Both binaries import it so the wire schema cannot drift.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version is the protocol version spoken by this build. Bump it whenever a
+// payload changes shape and teach Decode* how to upgrade the previous one.
+const Version = 2
+
+// MinVersion is the oldest version the master still accepts. Version 1 is the
+// unversioned format sent by the first agents (cpu/memory field names).
+const MinVersion = 1
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// ContainerMetrics is a single container sample collected by an agent
+type ContainerMetrics struct {
+	ID           string  `json:"id"`
+	Name         string  `json:"name"`
+	Image        string  `json:"image"`
+	CPUPercent   float64 `json:"cpu_percent"`
+	MemoryMB     float64 `json:"memory_mb"` // usage without page cache
+	RestartCount int     `json:"restart_count"`
+
+	MemoryLimitMB  float64 `json:"memory_limit_mb,omitempty"`
+	MemoryPercent  float64 `json:"memory_percent,omitempty"`
+	NetRxBytes     uint64  `json:"network_rx,omitempty"`
+	NetTxBytes     uint64  `json:"network_tx,omitempty"`
+	DiskReadBytes  uint64  `json:"disk_read,omitempty"`
+	DiskWriteBytes uint64  `json:"disk_write,omitempty"`
+	PIDs           uint64  `json:"pids,omitempty"`
+	UptimeSeconds  int64   `json:"uptime_seconds,omitempty"`
+	Health         string  `json:"health,omitempty"` // healthy, unhealthy, starting; empty without a healthcheck
+	Group          string  `json:"group,omitempty"`  // dockscope.group label
+
+	// Labels of the container, for silences matching on them
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Timestamp is when this container was sampled; zero in payloads from older agents
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// HostMetrics describes the node an agent runs on, read from /proc and /sys
+type HostMetrics struct {
+	CPUPercent float64 `json:"cpu_percent"` // all cores, 0-100
+	CPUs       int     `json:"cpus"`
+	Load1      float64 `json:"load1"`
+	Load5      float64 `json:"load5"`
+	Load15     float64 `json:"load15"`
+
+	MemoryTotalBytes     uint64 `json:"memory_total"`
+	MemoryAvailableBytes uint64 `json:"memory_available"`
+	SwapTotalBytes       uint64 `json:"swap_total"`
+	SwapFreeBytes        uint64 `json:"swap_free"`
+
+	Filesystems []FilesystemUsage   `json:"filesystems,omitempty"`
+	Interfaces  []InterfaceCounters `json:"interfaces,omitempty"`
+}
+
+// FilesystemUsage is the usage of one mounted filesystem
+type FilesystemUsage struct {
+	Mount       string  `json:"mount"`
+	Device      string  `json:"device"`
+	Type        string  `json:"type"`
+	TotalBytes  uint64  `json:"total"`
+	UsedBytes   uint64  `json:"used"`
+	FreeBytes   uint64  `json:"free"` // available to unprivileged users
+	UsedPercent float64 `json:"used_percent"`
+}
+
+// InterfaceCounters are the cumulative counters of one network interface
+type InterfaceCounters struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxPackets uint64 `json:"tx_packets"`
+	RxErrors  uint64 `json:"rx_errors"`
+	TxErrors  uint64 `json:"tx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxDropped uint64 `json:"tx_dropped"`
+}
+
+// MetricsPayload is pushed by agents on every collection cycle
+type MetricsPayload struct {
+	Version    int                `json:"version"`
+	HostID     string             `json:"host_id"`
+	Timestamp  string             `json:"timestamp"` // RFC3339, collection time
+	Containers []ContainerMetrics `json:"containers"`
+
+	// Host carries node-level metrics; nil from agents that don't report them
+	Host *HostMetrics `json:"host,omitempty"`
+
+	// CollectionMs is how long the agent took to sample all containers and
+	// Skipped how many containers it gave up on (errors or timeouts)
+	CollectionMs float64 `json:"collection_ms,omitempty"`
+	Skipped      int     `json:"skipped,omitempty"`
+
+	// APIURL is the base URL of the agent's own API (:8880), used by the
+	// master to proxy logs and stats. Optional; the master otherwise derives it.
+	APIURL string `json:"api_url,omitempty"`
+
+	// Agent is the agent's self-telemetry at the time of collection
+	Agent *AgentStatus `json:"agent,omitempty"`
+}
+
+// AgentStatus is an agent's view of its own health, served on its /status
+// endpoint and attached to every metrics payload
+type AgentStatus struct {
+	AgentVersion      string     `json:"agent_version"`
+	StartedAt         time.Time  `json:"started_at"`
+	UptimeSeconds     int64      `json:"uptime_seconds"`
+	LastCollect       *time.Time `json:"last_collect,omitempty"` // last successful collection
+	LastPush          *time.Time `json:"last_push,omitempty"`    // last payload accepted by the master
+	LastError         string     `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time `json:"last_error_at,omitempty"`
+	PushLatencyMs     float64    `json:"push_latency_ms"`
+	SpoolDepth        int        `json:"spool_depth"`  // metrics payloads not yet delivered
+	PendingLogs       int        `json:"pending_logs"` // log lines not yet delivered
+	ContainersWatched int        `json:"containers_watched"`
+
+	// AlertRulesRevision is the rule set the agent evaluates locally; empty
+	// when it leaves alerting to the master
+	AlertRulesRevision string `json:"alert_rules_revision,omitempty"`
+}
+
+// LogLine is a single container log line shipped by an agent
+type LogLine struct {
+	ContainerID string    `json:"container_id"`
+	Name        string    `json:"name"`
+	Stream      string    `json:"stream"` // stdout or stderr
+	Message     string    `json:"message"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// LogPayload is a batch of log lines pushed by an agent
+type LogPayload struct {
+	Version int       `json:"version"`
+	HostID  string    `json:"host_id"`
+	Lines   []LogLine `json:"lines"`
+}
+
+// ContainerEvent is a normalized Docker container lifecycle event
+type ContainerEvent struct {
+	ContainerID string    `json:"container_id"`
+	Name        string    `json:"name"`
+	Image       string    `json:"image"`
+	Action      string    `json:"action"`           // create, start, stop, die, kill, oom, restart, pause, unpause, destroy, health_status
+	Status      string    `json:"status,omitempty"` // health status for health_status events
+	ExitCode    string    `json:"exit_code,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+
+	// Labels of the container, for filtering where the event is observed; not sent
+	Labels map[string]string `json:"-"`
+}
+
+// EventPayload is a batch of container events pushed by an agent
+type EventPayload struct {
+	Version int              `json:"version"`
+	HostID  string           `json:"host_id"`
+	Events  []ContainerEvent `json:"events"`
+}
+
+// legacyContainerMetrics is the version 1 container sample
+type legacyContainerMetrics struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Image  string  `json:"image"`
+	CPU    float64 `json:"cpu"`
+	Memory float64 `json:"memory"`
+}
+
+type legacyMetricsPayload struct {
+	HostID     string                   `json:"host_id"`
+	Timestamp  string                   `json:"timestamp"`
+	Containers []legacyContainerMetrics `json:"containers"`
+}
+
+// NewMetricsPayload returns a payload stamped with the current protocol version
+func NewMetricsPayload(hostID string, ts time.Time, containers []ContainerMetrics) MetricsPayload {
+	return MetricsPayload{
+		Version:    Version,
+		HostID:     hostID,
+		Timestamp:  ts.UTC().Format(time.RFC3339Nano),
+		Containers: containers,
+	}
+}
+
+// MetricsBatch carries several collection cycles in one request, oldest first
+type MetricsBatch struct {
+	Version  int              `json:"version"`
+	HostID   string           `json:"host_id"`
+	Payloads []MetricsPayload `json:"payloads"`
+}
+
+// NewMetricsBatch returns a batch stamped with the current protocol version
+func NewMetricsBatch(hostID string, payloads []MetricsPayload) MetricsBatch {
+	return MetricsBatch{Version: Version, HostID: hostID, Payloads: payloads}
+}
+
+// NewLogPayload returns a log batch stamped with the current protocol version
+func NewLogPayload(hostID string, lines []LogLine) LogPayload {
+	return LogPayload{Version: Version, HostID: hostID, Lines: lines}
+}
+
+// NewEventPayload returns an event batch stamped with the current protocol version
+func NewEventPayload(hostID string, events []ContainerEvent) EventPayload {
+	return EventPayload{Version: Version, HostID: hostID, Events: events}
+}
+
+// Registration is sent by an agent on startup so the master can keep an
+// inventory of its hosts
+type Registration struct {
+	Version       int    `json:"version"`
+	HostID        string `json:"host_id"`
+	Hostname      string `json:"hostname"`
+	OS            string `json:"os"`
+	Kernel        string `json:"kernel"`
+	Arch          string `json:"arch"`
+	DockerVersion string `json:"docker_version"`
+	CPUs          int    `json:"cpus"`
+	MemoryBytes   uint64 `json:"memory_bytes"`
+	AgentVersion  string `json:"agent_version"`
+}
+
+// DecodeRegistration reads and validates an agent registration.
+// Registrations were introduced in version 2.
+func DecodeRegistration(r io.Reader) (Registration, error) {
+	var reg Registration
+	if err := decodeSince(r, 2, &reg); err != nil {
+		return Registration{}, err
+	}
+	reg.Version = Version
+	return reg, reg.Validate()
+}
+
+// Validate checks a registration
+func (r Registration) Validate() error {
+	if r.Version != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, r.Version)
+	}
+	if r.HostID == "" {
+		return errors.New("missing host_id")
+	}
+	return nil
+}
+
+// DecodeMetricsPayload reads a metrics payload of any supported version,
+// upgrades it to the current version and validates it.
+func DecodeMetricsPayload(r io.Reader) (MetricsPayload, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return MetricsPayload{}, err
+	}
+
+	version, err := peekVersion(data)
+	if err != nil {
+		return MetricsPayload{}, err
+	}
+
+	var payload MetricsPayload
+	switch version {
+	case 1:
+		var legacy legacyMetricsPayload
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return MetricsPayload{}, err
+		}
+		payload = upgradeMetricsV1(legacy)
+	case Version:
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return MetricsPayload{}, err
+		}
+	default:
+		return MetricsPayload{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	return payload, payload.Validate()
+}
+
+// DecodeMetricsBatch reads a metrics batch and decodes every payload in it
+// like DecodeMetricsPayload, so a batch may carry payloads of any supported
+// version. Payloads that fail are left out of the batch and returned as
+// skipped; the batch itself is only rejected if nothing in it is usable.
+// Batches were introduced in version 2.
+func DecodeMetricsBatch(r io.Reader) (MetricsBatch, []error, error) {
+	var raw struct {
+		HostID   string            `json:"host_id"`
+		Payloads []json.RawMessage `json:"payloads"`
+	}
+	if err := decodeSince(r, 2, &raw); err != nil {
+		return MetricsBatch{}, nil, err
+	}
+
+	batch := MetricsBatch{Version: Version, HostID: raw.HostID}
+	var skipped []error
+	for i, p := range raw.Payloads {
+		payload, err := DecodeMetricsPayload(bytes.NewReader(p))
+		if err == nil && payload.HostID != raw.HostID {
+			err = fmt.Errorf("host_id %q does not match batch", payload.HostID)
+		}
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("payload %d: %w", i, err))
+			continue
+		}
+		batch.Payloads = append(batch.Payloads, payload)
+	}
+	if len(batch.Payloads) == 0 && len(skipped) > 0 {
+		return MetricsBatch{}, skipped, fmt.Errorf("no valid payloads: %w", skipped[0])
+	}
+	return batch, skipped, batch.Validate()
+}
+
+// DecodeLogPayload reads a log batch of any supported version and validates it.
+// Log batches did not change between version 1 and 2.
+func DecodeLogPayload(r io.Reader) (LogPayload, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return LogPayload{}, err
+	}
+
+	if _, err := peekVersion(data); err != nil {
+		return LogPayload{}, err
+	}
+
+	var payload LogPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return LogPayload{}, err
+	}
+	payload.Version = Version
+
+	return payload, payload.Validate()
+}
+
+// DecodeEventPayload reads an event batch and validates it. Events were
+// introduced in version 2.
+func DecodeEventPayload(r io.Reader) (EventPayload, error) {
+	var payload EventPayload
+	if err := decodeSince(r, 2, &payload); err != nil {
+		return EventPayload{}, err
+	}
+	payload.Version = Version
+	return payload, payload.Validate()
+}
+
+// Validate checks a current-version metrics payload
+func (p MetricsPayload) Validate() error {
+	if p.Version != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, p.Version)
+	}
+	if p.HostID == "" {
+		return errors.New("missing host_id")
+	}
+	if p.Timestamp != "" {
+		if _, err := time.Parse(time.RFC3339Nano, p.Timestamp); err != nil {
+			return fmt.Errorf("invalid timestamp %q", p.Timestamp)
+		}
+	}
+	for i, c := range p.Containers {
+		if c.ID == "" {
+			return fmt.Errorf("container %d: missing id", i)
+		}
+	}
+	return nil
+}
+
+// Validate checks a batch and every payload in it
+func (b MetricsBatch) Validate() error {
+	if b.Version != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, b.Version)
+	}
+	if b.HostID == "" {
+		return errors.New("missing host_id")
+	}
+	if len(b.Payloads) == 0 {
+		return errors.New("empty batch")
+	}
+	for i, p := range b.Payloads {
+		if p.HostID != b.HostID {
+			return fmt.Errorf("payload %d: host_id %q does not match batch", i, p.HostID)
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("payload %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks a current-version log batch
+func (p LogPayload) Validate() error {
+	if p.Version != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, p.Version)
+	}
+	if p.HostID == "" {
+		return errors.New("missing host_id")
+	}
+	for i, l := range p.Lines {
+		if l.ContainerID == "" {
+			return fmt.Errorf("line %d: missing container_id", i)
+		}
+	}
+	return nil
+}
+
+// Validate checks a current-version event batch
+func (p EventPayload) Validate() error {
+	if p.Version != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, p.Version)
+	}
+	if p.HostID == "" {
+		return errors.New("missing host_id")
+	}
+	for i, e := range p.Events {
+		if e.ContainerID == "" || e.Action == "" {
+			return fmt.Errorf("event %d: missing container_id or action", i)
+		}
+	}
+	return nil
+}
+
+// Time returns the collection time, or the zero time if the agent sent none
+func (p MetricsPayload) Time() time.Time {
+	ts, _ := time.Parse(time.RFC3339Nano, p.Timestamp)
+	return ts
+}
+
+// decodeSince decodes a payload of a type introduced in version since.
+// These have not changed shape since, so callers only restamp the version.
+func decodeSince(r io.Reader, since int, v any) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	version, err := peekVersion(data)
+	if err != nil {
+		return err
+	}
+	if version < since {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// peekVersion reads the version field; a missing field means version 1
+func peekVersion(data []byte) (int, error) {
+	var header struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, err
+	}
+	if header.Version == nil {
+		return 1, nil
+	}
+	if *header.Version < MinVersion || *header.Version > Version {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, *header.Version)
+	}
+	return *header.Version, nil
+}
+
+func upgradeMetricsV1(legacy legacyMetricsPayload) MetricsPayload {
+	containers := make([]ContainerMetrics, 0, len(legacy.Containers))
+	for _, c := range legacy.Containers {
+		containers = append(containers, ContainerMetrics{
+			ID:         c.ID,
+			Name:       c.Name,
+			Image:      c.Image,
+			CPUPercent: c.CPU,
+			MemoryMB:   c.Memory,
+		})
+	}
+	return MetricsPayload{
+		Version:    Version,
+		HostID:     legacy.HostID,
+		Timestamp:  legacy.Timestamp,
+		Containers: containers,
+	}
+}
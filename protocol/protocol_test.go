@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeMetricsPayloadV1(t *testing.T) {
+	v1 := `{"host_id":"h1","timestamp":"2024-05-01T10:00:00Z","containers":[{"id":"abc","name":"web","image":"nginx","cpu":12.5,"memory":256}]}`
+
+	payload, err := DecodeMetricsPayload(strings.NewReader(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Version != Version || payload.HostID != "h1" || payload.Timestamp != "2024-05-01T10:00:00Z" {
+		t.Errorf("payload = %+v, want an upgraded payload for h1", payload)
+	}
+	if len(payload.Containers) != 1 {
+		t.Fatalf("%d containers, want 1", len(payload.Containers))
+	}
+	c := payload.Containers[0]
+	if c.ID != "abc" || c.Name != "web" || c.Image != "nginx" || c.CPUPercent != 12.5 || c.MemoryMB != 256 {
+		t.Errorf("container = %+v, want cpu and memory carried over", c)
+	}
+}
+
+func TestDecodeMetricsPayloadRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	want := NewMetricsPayload("h1", ts, []ContainerMetrics{{ID: "abc", Name: "web", CPUPercent: 12.5, MemoryMB: 256, Health: "healthy"}})
+	want.Host = &HostMetrics{CPUs: 4, Load1: 0.5}
+
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeMetricsPayload(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, _ := json.Marshal(got)
+	if !bytes.Equal(gotJSON, data) {
+		t.Errorf("round trip changed the payload:\n got %s\nwant %s", gotJSON, data)
+	}
+	if !got.Time().Equal(ts) {
+		t.Errorf("Time() = %s, want %s", got.Time(), ts)
+	}
+}
+
+func TestDecodeUnsupportedVersion(t *testing.T) {
+	decoders := map[string]func(string) error{
+		"metrics":  func(s string) error { _, err := DecodeMetricsPayload(strings.NewReader(s)); return err },
+		"batch":    func(s string) error { _, _, err := DecodeMetricsBatch(strings.NewReader(s)); return err },
+		"logs":     func(s string) error { _, err := DecodeLogPayload(strings.NewReader(s)); return err },
+		"events":   func(s string) error { _, err := DecodeEventPayload(strings.NewReader(s)); return err },
+		"register": func(s string) error { _, err := DecodeRegistration(strings.NewReader(s)); return err },
+		"alerts":   func(s string) error { _, err := DecodeAgentAlertPayload(strings.NewReader(s)); return err },
+	}
+	for name, decode := range decoders {
+		for _, version := range []string{"0", "99", "-1"} {
+			err := decode(`{"version":` + version + `,"host_id":"h1"}`)
+			if !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("%s version %s: error = %v, want ErrUnsupportedVersion", name, version, err)
+			}
+		}
+	}
+}
+
+func TestDecodeRejectsV1OfNewerTypes(t *testing.T) {
+	// Without a version field a payload is version 1, which predates these
+	for name, decode := range map[string]func() error{
+		"batch": func() error {
+			_, _, err := DecodeMetricsBatch(strings.NewReader(`{"host_id":"h1","payloads":[]}`))
+			return err
+		},
+		"events": func() error {
+			_, err := DecodeEventPayload(strings.NewReader(`{"host_id":"h1","events":[]}`))
+			return err
+		},
+		"register": func() error { _, err := DecodeRegistration(strings.NewReader(`{"host_id":"h1"}`)); return err },
+	} {
+		if err := decode(); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("%s: error = %v, want ErrUnsupportedVersion", name, err)
+		}
+	}
+}
+
+func TestDecodeLogPayloadV1(t *testing.T) {
+	payload, err := DecodeLogPayload(strings.NewReader(`{"host_id":"h1","lines":[{"container_id":"abc","stream":"stdout","message":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Version != Version || len(payload.Lines) != 1 || payload.Lines[0].Message != "hi" {
+		t.Errorf("payload = %+v, want one upgraded line", payload)
+	}
+}
+
+func TestDecodeEventPayloadRoundTrip(t *testing.T) {
+	want := NewEventPayload("h1", []ContainerEvent{{ContainerID: "abc", Action: "die", ExitCode: "137", Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}})
+	data, _ := json.Marshal(want)
+
+	got, err := DecodeEventPayload(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HostID != "h1" || len(got.Events) != 1 || got.Events[0].ExitCode != "137" || !got.Events[0].Timestamp.Equal(want.Events[0].Timestamp) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeMetricsBatchMixedVersions(t *testing.T) {
+	batch := `{"version":2,"host_id":"h1","payloads":[
+		{"host_id":"h1","containers":[{"id":"abc","cpu":50}]},
+		{"version":2,"host_id":"h1","containers":[{"id":"abc","cpu_percent":60}]},
+		{"version":99,"host_id":"h1"},
+		{"version":2,"host_id":"h2"}
+	]}`
+
+	got, skipped, err := DecodeMetricsBatch(strings.NewReader(batch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Payloads) != 2 || got.Payloads[0].Containers[0].CPUPercent != 50 || got.Payloads[1].Containers[0].CPUPercent != 60 {
+		t.Errorf("payloads = %+v, want the v1 and v2 payloads", got.Payloads)
+	}
+	if len(skipped) != 2 || !errors.Is(skipped[0], ErrUnsupportedVersion) {
+		t.Errorf("skipped = %v, want the unknown version and the foreign host", skipped)
+	}
+
+	_, _, err = DecodeMetricsBatch(strings.NewReader(`{"version":2,"host_id":"h1","payloads":[{"version":99,"host_id":"h1"}]}`))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("batch without valid payloads: error = %v, want ErrUnsupportedVersion", err)
+	}
+}
@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a five-field cron expression: minute, hour, day of month,
+// month and day of week. Fields take `*`, values, ranges, lists and steps
+// (`*/15`, `1-5`, `mon,wed`); @hourly, @daily, @weekly and @monthly are
+// shorthands. Like cron, a day matches if either day field does when both
+// are restricted.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit n set when value n matches
+	domAny, dowAny                bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+var (
+	cronMonthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseCronSchedule parses a cron expression or one of its shorthands
+func ParseCronSchedule(expr string) (CronSchedule, error) {
+	if full, ok := cronShorthands[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = full
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return CronSchedule{}, fmt.Errorf("schedule needs 5 fields (minute hour day month weekday), got %d", len(fields))
+	}
+
+	var s CronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return CronSchedule{}, fmt.Errorf("minute: %v", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return CronSchedule{}, fmt.Errorf("hour: %v", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return CronSchedule{}, fmt.Errorf("day of month: %v", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return CronSchedule{}, fmt.Errorf("month: %v", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return CronSchedule{}, fmt.Errorf("day of week: %v", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 // 7 is Sunday too
+	}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+	return s, nil
+}
+
+// parseCronField parses one comma-separated field into a bit set. names, if
+// given, spell out the values from the field's minimum on.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(v string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(v, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", v, min, max)
+		}
+		return n, nil
+	}
+
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max // "5/15" means from 5 on
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %q runs backwards", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// Matches reports whether the schedule fires in the minute of t
+func (s CronSchedule) Matches(t time.Time) bool {
+	return s.minute&(1<<t.Minute()) != 0 && s.hour&(1<<t.Hour()) != 0 && s.dayMatches(t)
+}
+
+func (s CronSchedule) dayMatches(t time.Time) bool {
+	if s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// LastStart returns the latest time the schedule fired at or before t, if
+// it did within the given lookback. Days and hours that cannot match are
+// skipped whole, so a week's lookback takes at most a few hundred steps.
+func (s CronSchedule) LastStart(t time.Time, lookback time.Duration) (time.Time, bool) {
+	earliest := t.Add(-lookback)
+	for m := t.Truncate(time.Minute); !m.Before(earliest); {
+		if !s.dayMatches(m) {
+			m = time.Date(m.Year(), m.Month(), m.Day(), 0, 0, 0, 0, m.Location()).Add(-time.Minute)
+			continue
+		}
+		if s.hour&(1<<m.Hour()) == 0 {
+			m = m.Add(-time.Duration(m.Minute()+1) * time.Minute)
+			continue
+		}
+		// Latest matching minute in this hour up to m's
+		if earlier := s.minute & (1<<(m.Minute()+1) - 1); earlier != 0 {
+			start := m.Add(-time.Duration(m.Minute()-(63-bits.LeadingZeros64(earlier))) * time.Minute)
+			if start.Before(earliest) {
+				break
+			}
+			return start, true
+		}
+		m = m.Add(-time.Duration(m.Minute()+1) * time.Minute)
+	}
+	return time.Time{}, false
+}
+
+// Next returns the first time after t the schedule fires, looking at most
+// a year ahead
+func (s CronSchedule) Next(t time.Time) (time.Time, bool) {
+	m := t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(1, 0, 1)
+	for m.Before(limit) {
+		if !s.dayMatches(m) {
+			m = time.Date(m.Year(), m.Month(), m.Day()+1, 0, 0, 0, 0, m.Location())
+			continue
+		}
+		if s.hour&(1<<m.Hour()) == 0 {
+			m = m.Add(time.Duration(60-m.Minute()) * time.Minute)
+			continue
+		}
+		// Earliest matching minute in this hour from m's on
+		if later := s.minute >> m.Minute() << m.Minute(); later != 0 {
+			return m.Add(time.Duration(bits.TrailingZeros64(later)-m.Minute()) * time.Minute), true
+		}
+		m = m.Add(time.Duration(60-m.Minute()) * time.Minute)
+	}
+	return time.Time{}, false
+}
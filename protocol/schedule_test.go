@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// scanLastStart and scanNext walk minute by minute, as a reference for the
+// skipping versions
+func scanLastStart(s CronSchedule, t time.Time, lookback time.Duration) (time.Time, bool) {
+	earliest := t.Add(-lookback)
+	for m := t.Truncate(time.Minute); !m.Before(earliest); m = m.Add(-time.Minute) {
+		if s.Matches(m) {
+			return m, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func scanNext(s CronSchedule, t time.Time) (time.Time, bool) {
+	limit := t.AddDate(1, 0, 1)
+	for m := t.Truncate(time.Minute).Add(time.Minute); m.Before(limit); m = m.Add(time.Minute) {
+		if s.Matches(m) {
+			return m, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func TestCronScheduleLastStartAndNext(t *testing.T) {
+	exprs := []string{
+		"* * * * *", "0 2 * * sat", "*/15 9-17 * * mon-fri", "30 23 31 * *", "5,55 0,12 1 jan,jul *",
+		"0 0 13 * fri", "@hourly", "@daily", "@weekly", "@monthly", "59 23 29 feb *",
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no timezone data:", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, expr := range exprs {
+		s, err := ParseCronSchedule(expr)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		for i := 0; i < 40; i++ {
+			at := base.Add(time.Duration(rng.Int63n(int64(365 * 24 * time.Hour)))).Add(time.Duration(rng.Intn(60)) * time.Second)
+			for _, loc := range []*time.Location{time.UTC, berlin} {
+				at := at.In(loc)
+				lookback := 7 * 24 * time.Hour
+
+				got, ok := s.LastStart(at, lookback)
+				want, wantOK := scanLastStart(s, at, lookback)
+				if ok != wantOK || !got.Equal(want) {
+					t.Errorf("%q.LastStart(%s) = %s %v, want %s %v", expr, at, got, ok, want, wantOK)
+				}
+
+				got, ok = s.Next(at)
+				want, wantOK = scanNext(s, at)
+				if ok != wantOK || !got.Equal(want) {
+					t.Errorf("%q.Next(%s) = %s %v, want %s %v", expr, at, got, ok, want, wantOK)
+				}
+			}
+		}
+	}
+}
+
+func TestSilenceWindow(t *testing.T) {
+	s := Silence{
+		StartsAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Schedule: "0 2 * * sat",
+		Duration: "2h",
+	}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	sat := time.Date(2024, 1, 6, 3, 30, 0, 0, time.UTC) // a Saturday
+	if open, until := s.Window(sat); !open || !until.Equal(time.Date(2024, 1, 6, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("Window(%s) = %v %s, want open until 04:00", sat, open, until)
+	}
+	if open, _ := s.Window(sat.Add(time.Hour)); open {
+		t.Errorf("Window(%s) is open after the 2h window", sat.Add(time.Hour))
+	}
+	if next, ok := s.NextStart(sat); !ok || !next.Equal(time.Date(2024, 1, 13, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("NextStart(%s) = %s %v, want the next Saturday 02:00", sat, next, ok)
+	}
+
+	// Without Compile the window is parsed on the fly
+	uncompiled := Silence{StartsAt: s.StartsAt, Schedule: s.Schedule, Duration: s.Duration}
+	if open, _ := uncompiled.Window(sat); !open {
+		t.Errorf("uncompiled Window(%s) is closed", sat)
+	}
+}
+
+func TestSilenceMatchesContainer(t *testing.T) {
+	s := Silence{ContainerID: "abc123"}
+	for _, tc := range []struct {
+		id, name string
+		want     bool
+	}{
+		{"abc123def456", "web", true},
+		{"", "abc123", true}, // by name
+		{"abc", "web", false},
+		{"", "web", false},
+		{"def456", "web", false},
+	} {
+		if got := s.MatchesContainer(tc.id, tc.name, "", nil); got != tc.want {
+			t.Errorf("MatchesContainer(%q, %q) = %v, want %v", tc.id, tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// Silence mutes matching alerts while its window is open: once from
+// StartsAt to EndsAt or, with a schedule, for Duration each time the
+// schedule fires. The master pushes the silences of a host to its agent
+// with the alert rules, so alerts the agent notifies itself are muted too.
+type Silence struct {
+	ID string `json:"id"`
+
+	// Matchers besides the host, which the master has already applied
+	ContainerID string            `json:"container_id,omitempty"` // ID prefix or name
+	Image       string            `json:"image,omitempty"`        // glob, e.g. "registry/app:*"
+	Labels      map[string]string `json:"labels,omitempty"`       // all must be present with these values
+	RuleID      string            `json:"rule_id,omitempty"`
+
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`            // zero for recurring silences without an end
+	Schedule string    `json:"schedule,omitempty"` // e.g. "0 2 * * sat"
+	Duration string    `json:"duration,omitempty"` // window length; for one-off silences instead of ends_at
+	Timezone string    `json:"timezone,omitempty"` // for the schedule, default UTC
+
+	// Parsed schedule, set by Compile
+	cron     *CronSchedule
+	loc      *time.Location
+	duration time.Duration
+}
+
+// Compile parses the schedule, timezone and duration once so Window does
+// not on every call. A silence that is not compiled still works.
+func (s *Silence) Compile() error {
+	s.loc = time.UTC
+	if loc, err := time.LoadLocation(s.Timezone); err == nil {
+		s.loc = loc
+	}
+	s.duration, _ = time.ParseDuration(s.Duration)
+	if s.Schedule == "" {
+		s.cron = nil
+		return nil
+	}
+	cron, err := ParseCronSchedule(s.Schedule)
+	if err != nil {
+		return err
+	}
+	s.cron = &cron
+	return nil
+}
+
+// Location is the timezone the schedule is read in
+func (s Silence) Location() *time.Location {
+	if s.loc == nil {
+		s.Compile()
+	}
+	return s.loc
+}
+
+// Window reports whether the silence is open at t and until when
+func (s Silence) Window(t time.Time) (bool, time.Time) {
+	if t.Before(s.StartsAt) || (!s.EndsAt.IsZero() && !t.Before(s.EndsAt)) {
+		return false, time.Time{}
+	}
+	if s.Schedule == "" {
+		return true, s.EndsAt
+	}
+
+	if s.cron == nil {
+		if err := s.Compile(); err != nil {
+			return false, time.Time{}
+		}
+	}
+	start, ok := s.cron.LastStart(t.In(s.loc), s.duration)
+	if !ok || !t.Before(start.Add(s.duration)) {
+		return false, time.Time{}
+	}
+	end := start.Add(s.duration)
+	if !s.EndsAt.IsZero() && s.EndsAt.Before(end) {
+		end = s.EndsAt
+	}
+	return true, end
+}
+
+// NextStart returns the next time a recurring silence opens after t
+func (s Silence) NextStart(t time.Time) (time.Time, bool) {
+	if s.Schedule == "" {
+		return time.Time{}, false
+	}
+	if s.cron == nil {
+		if err := s.Compile(); err != nil {
+			return time.Time{}, false
+		}
+	}
+	from := t
+	if s.StartsAt.After(from) {
+		from = s.StartsAt.Add(-time.Minute)
+	}
+	next, ok := s.cron.Next(from.In(s.loc))
+	if !ok || (!s.EndsAt.IsZero() && !next.Before(s.EndsAt)) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// MatchesRule checks the rule matcher
+func (s Silence) MatchesRule(ruleID string) bool {
+	return s.RuleID == "" || s.RuleID == ruleID
+}
+
+// NeedsContainer reports whether matching takes the container's details
+func (s Silence) NeedsContainer() bool {
+	return s.ContainerID != "" || s.Image != "" || len(s.Labels) > 0
+}
+
+// MatchesContainer checks the container, image and label matchers. The
+// container matcher is the name or a prefix of the full container ID.
+func (s Silence) MatchesContainer(containerID, name, image string, labels map[string]string) bool {
+	if s.ContainerID != "" && s.ContainerID != name &&
+		(containerID == "" || !strings.HasPrefix(containerID, s.ContainerID)) {
+		return false
+	}
+	if s.Image != "" {
+		if ok, _ := path.Match(s.Image, image); !ok && s.Image != image {
+			return false
+		}
+	}
+	for key, value := range s.Labels {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Message types multiplexed over the persistent agent WebSocket (/agent/ws)
+const (
+	TypeHello   = "hello"   // agent → master, first message on every connection
+	TypeMetrics = "metrics" // agent → master, MetricsPayload
+	TypeLogs    = "logs"    // agent → master, LogPayload
+	TypeEvents  = "events"  // agent → master, EventPayload
+	TypeAck     = "ack"     // master → agent, Ack
+	TypeCommand = "command" // master → agent, Command
+
+	TypeCommandResult = "command_result" // agent → master, CommandResult
+	TypeRegister      = "register"       // agent → master, Registration
+	TypeMetricsBatch  = "metrics_batch"  // agent → master, MetricsBatch
+	TypeAlerts        = "alerts"         // agent → master, AgentAlertPayload
+	TypeAlertRules    = "alert_rules"    // master → agent, AlertRuleSet
+)
+
+// Commands the master can push down to a connected agent
+const (
+	CommandSetInterval = "set_interval"
+	CommandSendLogs    = "send_logs"
+
+	// Container actions, executed against the agent's Docker daemon and
+	// reported back with a CommandResult
+	CommandStart   = "start"
+	CommandStop    = "stop"
+	CommandRestart = "restart"
+	CommandPause   = "pause"
+	CommandUnpause = "unpause"
+	CommandKill    = "kill"
+)
+
+// Command result statuses
+const (
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+)
+
+// IsContainerAction reports whether action is a container action command
+func IsContainerAction(action string) bool {
+	switch action {
+	case CommandStart, CommandStop, CommandRestart, CommandPause, CommandUnpause, CommandKill:
+		return true
+	}
+	return false
+}
+
+// Envelope wraps every WebSocket message. Seq is assigned by the sender and
+// is echoed back in the matching Ack.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Hello opens a stream
+type Hello struct {
+	Version int    `json:"version"`
+	HostID  string `json:"host_id"`
+}
+
+// Ack confirms (or rejects, when Error is set) the message with sequence Seq.
+// Rejected means the master refuses the message for good, e.g. because it
+// does not decode, so resending it is pointless.
+type Ack struct {
+	Seq      uint64 `json:"seq"`
+	Error    string `json:"error,omitempty"`
+	Rejected bool   `json:"rejected,omitempty"`
+}
+
+// Command is an instruction pushed by the master
+type Command struct {
+	ID              string `json:"id,omitempty"`
+	Action          string `json:"action"`
+	ContainerID     string `json:"container_id,omitempty"`
+	IntervalSeconds int    `json:"interval_seconds,omitempty"`
+	Tail            int    `json:"tail,omitempty"`
+}
+
+// CommandResult reports the outcome of a container action
+type CommandResult struct {
+	Version   int    `json:"version"`
+	HostID    string `json:"host_id"`
+	CommandID string `json:"command_id"`
+	Status    string `json:"status"` // succeeded or failed
+	Error     string `json:"error,omitempty"`
+}
+
+// Validate checks a command result
+func (r CommandResult) Validate() error {
+	if r.HostID == "" || r.CommandID == "" {
+		return errors.New("missing host_id or command_id")
+	}
+	if r.Status != CommandSucceeded && r.Status != CommandFailed {
+		return fmt.Errorf("invalid status %q", r.Status)
+	}
+	return nil
+}
+
+// NewEnvelope marshals payload into an envelope of the given type
+func NewEnvelope(msgType string, seq uint64, payload any) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Type: msgType, Seq: seq, Payload: data}, nil
+}